@@ -7,8 +7,11 @@ import (
 	"io/ioutil"
 	"os"
 
+	"github.com/d2verb/gemu/pkg/audio"
 	"github.com/d2verb/gemu/pkg/debug"
 	"github.com/d2verb/gemu/pkg/gameboy"
+	"github.com/d2verb/gemu/pkg/gameboy/lcd"
+	"github.com/d2verb/gemu/pkg/gameboy/serial"
 	"github.com/d2verb/gemu/pkg/gui"
 	"github.com/d2verb/gemu/pkg/log"
 )
@@ -16,9 +19,19 @@ import (
 const version = "0.0.1"
 
 type Config struct {
-	RomPath   string
-	Ratio     int
-	DebugMode bool
+	RomPath       string
+	Ratio         int
+	DebugMode     bool
+	CycleAccurate bool
+	PixelFIFO     bool
+	KeyMap        gui.KeyMap
+	Link          serial.Link
+	Palette       lcd.Palette
+	Audio         audio.Sink
+	AudioRate     int
+	AudioSync     bool
+	RecordAudio   string
+	RecordStems   bool
 }
 
 func SetUp() (*Config, error) {
@@ -28,6 +41,18 @@ func SetUp() (*Config, error) {
 	r := flag.Int("r", 1, "magnification ratio of screen")
 	l := flag.String("l", log.ModeToString(log.DebugMode), "log level")
 	d := flag.Bool("d", false, "start debug server")
+	a := flag.Bool("a", false, "cycle accurate mode")
+	f := flag.Bool("f", false, "pixel FIFO renderer")
+	k := flag.String("k", "", "key map")
+	p := flag.String("palette", "gray", "palette of DMG shades")
+	s := flag.String("serial", "null", "serial link")
+	ll := flag.String("link-listen", "", "wait for a link cable partner on the address")
+	lc := flag.String("link-connect", "", "connect a link cable to the partner on the address")
+	au := flag.String("audio", "null", "audio output")
+	ar := flag.Int("audio-rate", 48000, "sample rate of audio output")
+	as := flag.Bool("audio-sync", false, "pace emulation by audio output")
+	ra := flag.String("record-audio", "", "record audio to a WAV file")
+	rs := flag.Bool("record-stems", false, "record each channel to a WAV file as well")
 	flag.Parse()
 
 	if *v {
@@ -45,14 +70,49 @@ func SetUp() (*Config, error) {
 	}
 	log.SetMode(mode)
 
+	keyMap, err := gui.ParseKeyMap(*k)
+	if err != nil {
+		return nil, err
+	}
+
+	palette, err := lcd.ParsePalette(*p)
+	if err != nil {
+		return nil, err
+	}
+
+	sink, err := audio.NewSink(*au, *ar, *as)
+	if err != nil {
+		return nil, err
+	}
+
+	// The link is opened last, as listening blocks until a partner connects
+	link, err := newLink(*s, *ll, *lc)
+	if err != nil {
+		sink.Close()
+		return nil, err
+	}
+
 	return &Config{
-		RomPath:   flag.Arg(0),
-		Ratio:     *r,
-		DebugMode: *d,
+		RomPath:       flag.Arg(0),
+		Ratio:         *r,
+		DebugMode:     *d,
+		CycleAccurate: *a,
+		PixelFIFO:     *f,
+		KeyMap:        keyMap,
+		Link:          link,
+		Palette:       palette,
+		Audio:         sink,
+		AudioRate:     *ar,
+		AudioSync:     *as,
+		RecordAudio:   *ra,
+		RecordStems:   *rs,
 	}, nil
 }
 
 func Run(config *Config) error {
+	defer config.Audio.Close()
+	defer config.Link.Close()
+
 	romContent, err := ioutil.ReadFile(config.RomPath)
 	if err != nil {
 		return err
@@ -68,24 +128,68 @@ func Run(config *Config) error {
 		return err
 	}
 
-	gui := gui.NewGUI("Gemu", gb.LCD(), config.Ratio)
+	if config.CycleAccurate {
+		gb.EnableCycleAccurateMode()
+	}
+	if config.PixelFIFO {
+		gb.EnablePixelFIFOMode()
+	}
+	gb.ConnectLink(config.Link)
+	gb.SetAudioSink(config.Audio)
+	if config.RecordAudio != "" {
+		if err := gb.RecordAudio(config.RecordAudio, config.AudioRate, config.RecordStems); err != nil {
+			return err
+		}
+	}
+
+	gui := gui.NewGUI("Gemu", gb.LCD(), config.Ratio, gb, config.KeyMap, config.Palette)
+	if config.AudioSync {
+		gui.PaceByAudio()
+	}
 	dbg := debug.NewDebugServer(9000, ch, config.DebugMode)
 
 	go gb.Start(ctx, cancel)
 	go dbg.Start(ctx, cancel)
 	gui.Start(ctx, cancel)
 
-	return nil
+	return gb.StopRecording()
+}
+
+func newLink(name string, listenAddr string, connectAddr string) (serial.Link, error) {
+	switch {
+	case listenAddr != "" && connectAddr != "":
+		return nil, fmt.Errorf("-link-listen and -link-connect cannot be used together")
+	case listenAddr != "":
+		return serial.ListenTCPLink(listenAddr)
+	case connectAddr != "":
+		return serial.DialTCPLink(connectAddr)
+	default:
+		return serial.NewLink(name)
+	}
 }
 
 func flagUsage() {
 	usageText := `Usage of gemu:
 
-gemu [-vrd] ROM
-    -v         display version
-    -r int     magnification ratio of screen (default: 1)
-    -l string  log level {verbose, debug, warn, error, fatal} (default: debug)
-    -d         start debug mode`
+gemu [-vrdafk] [-palette string] [-serial string] [-link-listen addr | -link-connect addr]
+     [-audio string] [-audio-rate int] [-audio-sync] [-record-audio file [-record-stems]] ROM
+    -v                    display version
+    -r int                magnification ratio of screen (default: 1)
+    -l string             log level {verbose, debug, warn, error, fatal} (default: debug)
+    -d                    start debug mode
+    -a                    cycle accurate mode (tick the system on every memory access)
+    -f                    pixel FIFO renderer (accurate mode 3 timing, slower)
+    -k string             key map as "button=key,..." (e.g. "a=S,b=A,start=Space")
+    -palette string       palette of DMG shades {gray, dmg, pocket} or 4 colors
+                          like "e0f8d0,88c070,346856,081820" (default: gray)
+    -serial string        serial link {null, stdout, log} (default: null)
+    -link-listen string   wait for a link cable partner on the address (e.g. ":9001")
+    -link-connect string  connect a link cable to the partner (e.g. "localhost:9001")
+    -audio string         audio output {null, aplay, pacat} (default: null)
+    -audio-rate int       sample rate of audio output {44100, 48000} (default: 48000)
+    -audio-sync           pace emulation by audio output instead of video
+    -record-audio string  record audio to a 16-bit stereo WAV file at the audio rate
+    -record-stems         record each channel as well (e.g. out.ch1.wav for out.wav)`
 
 	fmt.Fprintf(os.Stderr, "%s\n", usageText)
 }
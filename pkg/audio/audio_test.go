@@ -0,0 +1,266 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/d2verb/gemu/pkg/gameboy/apu"
+)
+
+func sine(frequency float64, count int) []apu.Sample {
+	samples := make([]apu.Sample, count)
+	for i := range samples {
+		v := float32(math.Sin(2 * math.Pi * frequency * float64(i) / apu.SampleRate))
+		samples[i] = apu.Sample{Left: v, Right: v}
+	}
+	return samples
+}
+
+// peak returns the peak of the left channel, skipping the start of the filter
+func peak(samples []apu.Sample) float32 {
+	var max float32
+	for _, s := range samples[len(samples)/4:] {
+		if v := float32(math.Abs(float64(s.Left))); v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+func TestResamplerRate(t *testing.T) {
+	for _, rate := range []int{44100, 48000} {
+		r := NewResampler(rate)
+		count := 0
+		// 1 second in chunks
+		for i := 0; i < apu.SampleRate/512; i++ {
+			count += len(r.Process(make([]apu.Sample, 512)))
+		}
+		if diff := count - rate; diff < -r.halfWidth || diff > 0 {
+			t.Errorf("%d Hz: expected about %d samples, got %d", rate, rate, count)
+		}
+	}
+}
+
+func TestResamplerDC(t *testing.T) {
+	r := NewResampler(48000)
+	in := make([]apu.Sample, apu.SampleRate/10)
+	for i := range in {
+		in[i] = apu.Sample{Left: 0.5, Right: -0.25}
+	}
+
+	out := r.Process(in)
+	last := out[len(out)-1]
+	if math.Abs(float64(last.Left-0.5)) > 0.005 || math.Abs(float64(last.Right+0.25)) > 0.005 {
+		t.Errorf("expected {0.5, -0.25}, got %v", last)
+	}
+}
+
+func TestResamplerFilter(t *testing.T) {
+	tests := []struct {
+		frequency float64
+		min       float32
+		max       float32
+	}{
+		{1000, 0.99, 1.01},
+		{15000, 0.99, 1.01},
+		// Above the Nyquist frequency of 48 kHz
+		{30000, 0, 0.01},
+		{50000, 0, 0.01},
+	}
+
+	for _, tt := range tests {
+		r := NewResampler(48000)
+		got := peak(r.Process(sine(tt.frequency, apu.SampleRate/10)))
+		if got < tt.min || got > tt.max {
+			t.Errorf("%.0f Hz: expected a peak in [%.2f, %.2f], got %f", tt.frequency, tt.min, tt.max, got)
+		}
+	}
+}
+
+func TestEncodePCM(t *testing.T) {
+	pcm := encodePCM([]apu.Sample{{Left: 1, Right: -1}, {Left: 2, Right: 0.5}})
+
+	expected := []int16{32767, -32767, 32767, 16383}
+	for i, v := range expected {
+		if got := int16(binary.LittleEndian.Uint16(pcm[i*2:])); got != v {
+			t.Errorf("%d: expected %d, got %d", i, v, got)
+		}
+	}
+}
+
+// testDevice blocks writes until it is released
+type testDevice struct {
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	released chan struct{}
+}
+
+func (d *testDevice) Write(p []uint8) (int, error) {
+	<-d.released
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.buf.Write(p)
+}
+
+func TestPlayer(t *testing.T) {
+	d := &testDevice{released: make(chan struct{})}
+	close(d.released)
+	p := NewPlayer(d, 48000, false)
+
+	in := make([]apu.Sample, apu.SampleRate/100)
+	if err := p.Write(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.buf.Len() == 0 || d.buf.Len()%bytesPerFrame != 0 {
+		t.Errorf("expected whole frames, got %d bytes", d.buf.Len())
+	}
+	if err := p.Write(in); err == nil {
+		t.Error("expected an error after close")
+	}
+}
+
+func TestPlayerDrop(t *testing.T) {
+	d := &testDevice{released: make(chan struct{})}
+	p := NewPlayer(d, 48000, false)
+
+	// 1 second is written at once without blocking
+	if err := p.Write(make([]apu.Sample, apu.SampleRate)); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Buffered(); got > p.maxBuffered {
+		t.Errorf("expected at most %d bytes, got %d", p.maxBuffered, got)
+	}
+
+	close(d.released)
+	p.Close()
+}
+
+func TestPlayerPace(t *testing.T) {
+	d := &testDevice{released: make(chan struct{})}
+	p := NewPlayer(d, 48000, true)
+
+	// The buffer stays filled while the device takes a period
+	in := make([]apu.Sample, apu.SampleRate/10)
+	if err := p.Write(in); err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan struct{})
+	go func() {
+		p.Write(in)
+		close(written)
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("write was not blocked while the buffer was filled")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(d.released)
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("write was blocked after the device played")
+	}
+	p.Close()
+}
+
+func TestNewSink(t *testing.T) {
+	if _, err := NewSink("null", 48000, false); err != nil {
+		t.Error(err)
+	}
+	if _, err := NewSink("null", 22050, false); err == nil {
+		t.Error("expected an error for an unsupported rate")
+	}
+	if _, err := NewSink("null", 44100, true); err == nil {
+		t.Error("expected an error for pacing by the null sink")
+	}
+	if _, err := NewSink("speaker", 44100, false); err == nil {
+		t.Error("expected an error for an unknown output")
+	}
+}
+
+func TestWAVFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.wav")
+	w, err := CreateWAV(path, 44100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(sine(440, apu.SampleRate/10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[0:4]) != "RIFF" || string(data[8:16]) != "WAVEfmt " || string(data[36:40]) != "data" {
+		t.Fatalf("invalid header: %q", data[:wavHeaderSize])
+	}
+
+	le := binary.LittleEndian
+	if got := le.Uint32(data[4:]); int(got) != len(data)-8 {
+		t.Errorf("expected RIFF size %d, got %d", len(data)-8, got)
+	}
+	if got := le.Uint16(data[22:]); got != 2 {
+		t.Errorf("expected 2 channels, got %d", got)
+	}
+	if got := le.Uint32(data[24:]); got != 44100 {
+		t.Errorf("expected 44100 Hz, got %d", got)
+	}
+	if got := le.Uint16(data[34:]); got != 16 {
+		t.Errorf("expected 16 bits, got %d", got)
+	}
+	size := le.Uint32(data[40:])
+	if int(size) != len(data)-wavHeaderSize || size == 0 || size%bytesPerFrame != 0 {
+		t.Errorf("invalid data size %d for %d bytes", size, len(data)-wavHeaderSize)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewRecorder(filepath.Join(dir, "out.wav"), 48000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var channels [apu.ChannelCount][]apu.Sample
+	for i := range channels {
+		channels[i] = sine(440*float64(i+1), apu.SampleRate/100)
+	}
+	if err := r.Write(sine(440, apu.SampleRate/100), channels); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Writes after close are ignored
+	if err := r.Write(sine(440, apu.SampleRate/100), channels); err != nil {
+		t.Error(err)
+	}
+
+	for _, name := range []string{"out.wav", "out.ch1.wav", "out.ch2.wav", "out.ch3.wav", "out.ch4.wav"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if info.Size() <= wavHeaderSize {
+			t.Errorf("%s: no samples were written", name)
+		}
+	}
+}
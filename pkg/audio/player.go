@@ -0,0 +1,179 @@
+package audio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+
+	"github.com/d2verb/gemu/pkg/gameboy/apu"
+)
+
+const (
+	// 16-bit stereo
+	bytesPerFrame = 4
+	// Bytes passed to the device at once
+	periodFrames = 512
+)
+
+// Player resamples the samples to the host rate and plays them on a device
+// which consumes 16-bit little endian stereo PCM at that rate. Writing to the
+// device is expected to block until it has room, so the buffer of the player
+// is filled as fast as the device plays.
+type Player struct {
+	resampler *Resampler
+	device    io.Writer
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	queue       []uint8
+	maxBuffered int // PCM bytes beyond this are dropped
+	target      int // Writes block above this when pacing
+	pace        bool
+	closed      bool
+	err         error
+	done        chan struct{}
+}
+
+// NewPlayer starts playing on the device. The player buffers up to 100ms,
+// and keeps 50ms buffered when pacing the emulation.
+func NewPlayer(device io.Writer, rate int, pace bool) *Player {
+	p := &Player{
+		resampler:   NewResampler(rate),
+		device:      device,
+		maxBuffered: rate / 10 * bytesPerFrame,
+		target:      rate / 20 * bytesPerFrame,
+		pace:        pace,
+		done:        make(chan struct{}),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	go p.play()
+	return p
+}
+
+func (p *Player) Write(samples []apu.Sample) error {
+	pcm := encodePCM(p.resampler.Process(samples))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.pace && len(p.queue) >= p.target && !p.closed && p.err == nil {
+		p.cond.Wait()
+	}
+	if p.err != nil {
+		return p.err
+	}
+	if p.closed {
+		return fmt.Errorf("Audio player is closed")
+	}
+
+	// Without pacing, the emulation may run faster than the device plays
+	if room := p.maxBuffered - len(p.queue); len(pcm) > room {
+		pcm = pcm[:room-room%bytesPerFrame]
+	}
+	p.queue = append(p.queue, pcm...)
+	p.cond.Broadcast()
+	return nil
+}
+
+// Buffered returns the bytes waiting to be played
+func (p *Player) Buffered() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue)
+}
+
+// play passes the queued PCM to the device until the player is closed
+func (p *Player) play() {
+	defer close(p.done)
+
+	period := make([]uint8, periodFrames*bytesPerFrame)
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if len(p.queue) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		n := copy(period, p.queue)
+		p.queue = append(p.queue[:0], p.queue[n:]...)
+		p.cond.Broadcast()
+		p.mu.Unlock()
+
+		if _, err := p.device.Write(period[:n]); err != nil {
+			p.mu.Lock()
+			p.err = err
+			p.cond.Broadcast()
+			p.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Close waits until the queued samples are passed to the device
+func (p *Player) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	<-p.done
+	return p.err
+}
+
+// encodePCM converts the samples to 16-bit little endian stereo PCM
+func encodePCM(samples []apu.Sample) []uint8 {
+	pcm := make([]uint8, len(samples)*bytesPerFrame)
+	for i, s := range samples {
+		binary.LittleEndian.PutUint16(pcm[i*4:], uint16(toInt16(s.Left)))
+		binary.LittleEndian.PutUint16(pcm[i*4+2:], uint16(toInt16(s.Right)))
+	}
+	return pcm
+}
+
+func toInt16(v float32) int16 {
+	switch {
+	case v > 1:
+		v = 1
+	case v < -1:
+		v = -1
+	}
+	return int16(v * 32767)
+}
+
+// CommandSink plays samples with an external command (e.g. aplay) reading
+// PCM from its standard input
+type CommandSink struct {
+	*Player
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+func NewCommandSink(rate int, pace bool, name string, args ...string) (*CommandSink, error) {
+	cmd := exec.Command(name, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &CommandSink{
+		Player: NewPlayer(stdin, rate, pace),
+		cmd:    cmd,
+		stdin:  stdin,
+	}, nil
+}
+
+func (c *CommandSink) Close() error {
+	err := c.Player.Close()
+	c.stdin.Close()
+	if waitErr := c.cmd.Wait(); err == nil {
+		err = waitErr
+	}
+	return err
+}
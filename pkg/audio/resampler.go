@@ -0,0 +1,103 @@
+package audio
+
+import (
+	"math"
+
+	"github.com/d2verb/gemu/pkg/gameboy/apu"
+)
+
+const (
+	// The filter passes up to 90% of the output Nyquist frequency
+	cutoffRatio = 0.9
+	// Zero crossings of the sinc on each side of the kernel
+	zeroCrossings = 8
+	// Kernel values per input sample in the kernel table
+	kernelPhases = 64
+)
+
+// Resampler converts samples from apu.SampleRate to the host rate. It filters
+// them with a windowed sinc, so frequencies above the host Nyquist frequency
+// are removed instead of being aliased.
+type Resampler struct {
+	step      float64   // Input samples per output sample
+	halfWidth int       // Half width of the kernel in input samples
+	kernel    []float32 // Kernel from 0 to halfWidth in kernelPhases steps
+	history   []apu.Sample
+	pos       float64 // Position of the next output sample in history
+}
+
+func NewResampler(rate int) *Resampler {
+	step := float64(apu.SampleRate) / float64(rate)
+	// Cutoff frequency in cycles per input sample
+	cutoff := cutoffRatio * 0.5 / step
+	halfWidth := int(math.Ceil(zeroCrossings / (2 * cutoff)))
+
+	kernel := make([]float32, halfWidth*kernelPhases+2)
+	for i := range kernel {
+		x := float64(i) / kernelPhases
+		if x > float64(halfWidth) {
+			break
+		}
+		kernel[i] = float32(2 * cutoff * sinc(2*cutoff*x) * blackman(x/float64(halfWidth)))
+	}
+
+	return &Resampler{
+		step:      step,
+		halfWidth: halfWidth,
+		kernel:    kernel,
+		// Start with silence so the first samples have a full kernel
+		history: make([]apu.Sample, halfWidth),
+		pos:     float64(halfWidth),
+	}
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// blackman returns the Blackman window at x in [-1, 1]
+func blackman(x float64) float64 {
+	return 0.42 + 0.5*math.Cos(math.Pi*x) + 0.08*math.Cos(2*math.Pi*x)
+}
+
+// at returns the kernel value x input samples away from the center
+func (r *Resampler) at(x float64) float32 {
+	x = math.Abs(x) * kernelPhases
+	i := int(x)
+	if i >= len(r.kernel)-1 {
+		return 0
+	}
+	frac := float32(x - float64(i))
+	return r.kernel[i] + (r.kernel[i+1]-r.kernel[i])*frac
+}
+
+// Process returns the output samples available after the given input samples.
+// The output lags behind the input by the half width of the kernel.
+func (r *Resampler) Process(samples []apu.Sample) []apu.Sample {
+	r.history = append(r.history, samples...)
+
+	var out []apu.Sample
+	for int(r.pos)+r.halfWidth < len(r.history) {
+		first := int(math.Ceil(r.pos)) - r.halfWidth
+		last := int(r.pos) + r.halfWidth
+
+		var sample apu.Sample
+		for i := first; i <= last; i++ {
+			k := r.at(r.pos - float64(i))
+			sample.Left += r.history[i].Left * k
+			sample.Right += r.history[i].Right * k
+		}
+		out = append(out, sample)
+		r.pos += r.step
+	}
+
+	// Drop the samples which no longer fall in the kernel
+	if drop := int(r.pos) - r.halfWidth; drop > 0 {
+		r.history = append(r.history[:0], r.history[drop:]...)
+		r.pos -= float64(drop)
+	}
+	return out
+}
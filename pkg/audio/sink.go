@@ -0,0 +1,53 @@
+package audio
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/d2verb/gemu/pkg/gameboy/apu"
+)
+
+// Sink receives the samples generated by the APU at apu.SampleRate
+type Sink interface {
+	// Write may block to pace the emulation by the audio output
+	Write(samples []apu.Sample) error
+	Close() error
+}
+
+// NullSink discards all samples without blocking
+type NullSink struct{}
+
+func NewNullSink() *NullSink {
+	return &NullSink{}
+}
+
+func (n *NullSink) Write(samples []apu.Sample) error {
+	return nil
+}
+
+func (n *NullSink) Close() error {
+	return nil
+}
+
+// NewSink creates an audio backend by name {null, aplay, pacat} playing at the
+// given rate. With pace, writes are blocked while the output buffer is filled,
+// so the emulation runs at the speed of the audio output.
+func NewSink(name string, rate int, pace bool) (Sink, error) {
+	if rate != 44100 && rate != 48000 {
+		return nil, fmt.Errorf("Audio rate must be 44100 or 48000, got %d", rate)
+	}
+	if pace && name == "null" {
+		return nil, fmt.Errorf("Pacing by audio needs an audio output other than null")
+	}
+
+	switch name {
+	case "null":
+		return NewNullSink(), nil
+	case "aplay":
+		return NewCommandSink(rate, pace, "aplay", "-q", "-t", "raw", "-f", "S16_LE", "-c", "2", "-r", strconv.Itoa(rate))
+	case "pacat":
+		return NewCommandSink(rate, pace, "pacat", "--raw", "--format=s16le", "--channels=2", "--rate="+strconv.Itoa(rate))
+	default:
+		return nil, fmt.Errorf("No corresponding audio output for %s", name)
+	}
+}
@@ -0,0 +1,151 @@
+package audio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/d2verb/gemu/pkg/gameboy/apu"
+)
+
+const wavHeaderSize = 44
+
+// WAVFile writes samples to a 16-bit PCM stereo WAV file, resampled to the
+// given rate
+type WAVFile struct {
+	f         *os.File
+	w         *bufio.Writer
+	resampler *Resampler
+	rate      int
+	dataSize  int
+}
+
+func CreateWAV(path string, rate int) (*WAVFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAVFile{
+		f:         f,
+		w:         bufio.NewWriter(f),
+		resampler: NewResampler(rate),
+		rate:      rate,
+	}
+	// The sizes are filled in on Close
+	if _, err := w.w.Write(w.header()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *WAVFile) header() []uint8 {
+	h := make([]uint8, 0, wavHeaderSize)
+	h = append(h, "RIFF"...)
+	h = binary.LittleEndian.AppendUint32(h, uint32(wavHeaderSize-8+w.dataSize))
+	h = append(h, "WAVEfmt "...)
+	h = binary.LittleEndian.AppendUint32(h, 16)
+	h = binary.LittleEndian.AppendUint16(h, 1) // PCM
+	h = binary.LittleEndian.AppendUint16(h, 2) // Stereo
+	h = binary.LittleEndian.AppendUint32(h, uint32(w.rate))
+	h = binary.LittleEndian.AppendUint32(h, uint32(w.rate*bytesPerFrame))
+	h = binary.LittleEndian.AppendUint16(h, bytesPerFrame)
+	h = binary.LittleEndian.AppendUint16(h, 16)
+	h = append(h, "data"...)
+	h = binary.LittleEndian.AppendUint32(h, uint32(w.dataSize))
+	return h
+}
+
+func (w *WAVFile) Write(samples []apu.Sample) error {
+	pcm := encodePCM(w.resampler.Process(samples))
+	w.dataSize += len(pcm)
+	_, err := w.w.Write(pcm)
+	return err
+}
+
+// Close fills in the sizes in the header
+func (w *WAVFile) Close() error {
+	err := w.w.Flush()
+	if err == nil {
+		_, err = w.f.WriteAt(w.header(), 0)
+	}
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Recorder writes the mixed APU output to a WAV file, and optionally the
+// output of each channel to stems next to it (e.g. out.ch1.wav for out.wav).
+// It can be closed from a goroutine other than the one writing.
+type Recorder struct {
+	mu     sync.Mutex
+	mix    *WAVFile
+	stems  []*WAVFile
+	closed bool
+}
+
+func NewRecorder(path string, rate int, stems bool) (*Recorder, error) {
+	mix, err := CreateWAV(path, rate)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{mix: mix}
+
+	if !stems {
+		return r, nil
+	}
+	ext := filepath.Ext(path)
+	for i := 0; i < apu.ChannelCount; i++ {
+		stem, err := CreateWAV(fmt.Sprintf("%s.ch%d%s", strings.TrimSuffix(path, ext), i+1, ext), rate)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.stems = append(r.stems, stem)
+	}
+	return r, nil
+}
+
+// Write writes the mixed samples, and the channel samples if recording stems
+func (r *Recorder) Write(samples []apu.Sample, channels [apu.ChannelCount][]apu.Sample) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	if err := r.mix.Write(samples); err != nil {
+		return err
+	}
+	for i, stem := range r.stems {
+		if err := stem.Write(channels[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close finishes all files. Writes after Close are ignored.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	err := r.mix.Close()
+	for _, stem := range r.stems {
+		if stemErr := stem.Close(); err == nil {
+			err = stemErr
+		}
+	}
+	return err
+}
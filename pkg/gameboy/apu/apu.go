@@ -1,33 +1,380 @@
 package apu
 
-import "github.com/d2verb/gemu/pkg/gameboy/bus"
+import (
+	"math"
+
+	"github.com/d2verb/gemu/pkg/gameboy/bus"
+	"github.com/d2verb/gemu/pkg/log"
+)
+
+const (
+	// The frame sequencer is clocked at 512 Hz
+	CyclesPerFrameStep = 8192
+	// Samples are taken at 131072 Hz, which is high enough for the host to
+	// resample to its own rate
+	CyclesPerSample = 32
+	SampleRate      = 4194304 / CyclesPerSample
+	// Samples which are not drained in time are dropped
+	MaxBufferedSamples = SampleRate / 4
+	ChannelCount       = 4
+)
+
+// NR50 bit flags
+const (
+	LeftVolumeMask  = 0b1110000
+	RightVolumeMask = 0b111
+)
+
+// NR52 bit flags
+const (
+	PowerFlag = 0b10000000
+)
+
+// Bits read back from each register, as unused and write-only bits are read as 1
+var readMasks = [...]uint8{
+	0x80, 0x3f, 0x00, 0xff, 0xbf, // NR10-NR14
+	0xff, 0x3f, 0x00, 0xff, 0xbf, // NR21-NR24
+	0x7f, 0xff, 0x9f, 0xff, 0xbf, // NR30-NR34
+	0xff, 0xff, 0x00, 0x00, 0xbf, // NR41-NR44
+	0x00, 0x00, 0x70, // NR50-NR52
+}
+
+// The high-pass filter removes the DC offset of the DACs like the capacitor on
+// the hardware. It keeps 0.999958 of its charge per cycle.
+var highPassCharge = float32(math.Pow(0.999958, CyclesPerSample))
+
+// Sample is an analog output of the APU in [-1, 1]
+type Sample struct {
+	Left  float32
+	Right float32
+}
+
+type highPass struct {
+	capacitor float32
+}
+
+func (h *highPass) filter(in float32) float32 {
+	out := in - h.capacitor
+	h.capacitor = in - out*highPassCharge
+	return out
+}
+
+type stereoHighPass struct {
+	left  highPass
+	right highPass
+}
+
+func (s *stereoHighPass) filter(in Sample) Sample {
+	return Sample{
+		Left:  s.left.filter(in.Left),
+		Right: s.right.filter(in.Right),
+	}
+}
 
 type APU struct {
-	bus *bus.Bus
+	regs         [0x17]uint8
+	ch1          *pulse
+	ch2          *pulse
+	ch3          *wave
+	ch4          *noise
+	powered      bool
+	frameCycles  int
+	frameStep    int
+	sampleCycles int
+	samples      []Sample
+	filter       stereoHighPass
+	cgbMode      bool
+
+	// Output of each channel, recorded only when enabled
+	recordChannels bool
+	channels       [ChannelCount][]Sample
+	channelFilters [ChannelCount]stereoHighPass
+
+	regsRange bus.AddressRange
+	waveRange bus.AddressRange
+	bus       *bus.Bus
 }
 
 func New() *APU {
-	return &APU{}
+	a := &APU{
+		ch1:       newPulse(true),
+		ch2:       newPulse(false),
+		ch3:       newWave(),
+		ch4:       newNoise(),
+		powered:   true,
+		regsRange: bus.NewAddressRange(0xff10, 0xff26),
+		waveRange: bus.NewAddressRange(0xff30, 0xff3f),
+	}
+
+	// Values set by the boot ROM
+	a.regs[0x14] = 0x77
+	a.regs[0x15] = 0xf3
+	return a
+}
+
+// EnableChannelSamples records the output of each channel as well as the mix
+func (a *APU) EnableChannelSamples() {
+	a.recordChannels = true
+}
+
+// EnableCGBMode removes the DMG restrictions on wave RAM access, and resets
+// length counters on power off
+func (a *APU) EnableCGBMode() {
+	a.cgbMode = true
+	a.ch3.cgbMode = true
 }
 
 func (a *APU) ConnectToBus(b *bus.Bus) error {
-	if err := b.Map(bus.NewAddressRange(0xff10, 0xff26), a); err != nil {
+	if err := b.Map(a.regsRange, a); err != nil {
+		return err
+	}
+	if err := b.Map(a.waveRange, a); err != nil {
 		return err
 	}
 	a.bus = b
 	return nil
 }
 
+// Step advances the APU by the given cycles. The APU keeps its clock in double
+// speed mode like the PPU.
+func (a *APU) Step(cycles int) {
+	if a.powered {
+		a.ch1.step(cycles)
+		a.ch2.step(cycles)
+		a.ch3.step(cycles)
+		a.ch4.step(cycles)
+
+		a.frameCycles += cycles
+		for a.frameCycles >= CyclesPerFrameStep {
+			a.frameCycles -= CyclesPerFrameStep
+			a.stepFrameSequencer()
+		}
+	}
+
+	a.sampleCycles += cycles
+	for a.sampleCycles >= CyclesPerSample {
+		a.sampleCycles -= CyclesPerSample
+		if len(a.samples) < MaxBufferedSamples {
+			a.samples = append(a.samples, a.mix())
+		}
+	}
+}
+
+// stepFrameSequencer clocks length counters at 256 Hz, sweep at 128 Hz and
+// envelopes at 64 Hz
+func (a *APU) stepFrameSequencer() {
+	if a.frameStep%2 == 0 {
+		a.ch1.clockLength()
+		a.ch2.clockLength()
+		a.ch3.clockLength()
+		a.ch4.clockLength()
+	}
+	if a.frameStep == 2 || a.frameStep == 6 {
+		a.ch1.clockSweep()
+	}
+	if a.frameStep == 7 {
+		a.ch1.clockEnvelope()
+		a.ch2.clockEnvelope()
+		a.ch4.clockEnvelope()
+	}
+	a.frameStep = (a.frameStep + 1) % 8
+}
+
+// outputs returns the analog output of each channel
+func (a *APU) outputs() [ChannelCount]float32 {
+	if !a.powered {
+		return [ChannelCount]float32{}
+	}
+	return [ChannelCount]float32{
+		a.ch1.output(),
+		a.ch2.output(),
+		a.ch3.output(),
+		a.ch4.output(),
+	}
+}
+
+// panChannels pans the channels with NR51 and scales the volume with NR50
+func (a *APU) panChannels() [ChannelCount]Sample {
+	nr50 := a.regs[0x14]
+	nr51 := a.regs[0x15]
+	leftVolume := float32((nr50&LeftVolumeMask)>>4+1) / 8 / ChannelCount
+	rightVolume := float32(nr50&RightVolumeMask+1) / 8 / ChannelCount
+
+	var channels [ChannelCount]Sample
+	for i, out := range a.outputs() {
+		if nr51&(1<<(i+4)) != 0 {
+			channels[i].Left = out * leftVolume
+		}
+		if nr51&(1<<i) != 0 {
+			channels[i].Right = out * rightVolume
+		}
+	}
+	return channels
+}
+
+func mixChannels(channels [ChannelCount]Sample) Sample {
+	var mixed Sample
+	for _, c := range channels {
+		mixed.Left += c.Left
+		mixed.Right += c.Right
+	}
+	return mixed
+}
+
+func (a *APU) mix() Sample {
+	channels := a.panChannels()
+	if a.recordChannels {
+		for i, c := range channels {
+			a.channels[i] = append(a.channels[i], a.channelFilters[i].filter(c))
+		}
+	}
+	return a.filter.filter(mixChannels(channels))
+}
+
+// Samples returns the samples generated since the last call at SampleRate
+func (a *APU) Samples() []Sample {
+	samples := a.samples
+	a.samples = nil
+	return samples
+}
+
+// ChannelSamples returns the output of each channel generated since the last
+// call. The channels are panned and scaled like the mix, so they add up to the
+// samples returned by Samples.
+func (a *APU) ChannelSamples() [ChannelCount][]Sample {
+	channels := a.channels
+	a.channels = [ChannelCount][]Sample{}
+	return channels
+}
+
 func (a *APU) Read8(address uint16) uint8 {
-	return 0
+	if a.waveRange.Contains(address) {
+		return a.ch3.readRAM(address - 0xff30)
+	}
+	if !a.regsRange.Contains(address) {
+		log.Fatalf("APU cannot be accessed at 0x%04x", address)
+	}
+
+	if address == 0xff26 {
+		return a.readNR52()
+	}
+	offset := address - 0xff10
+	return a.regs[offset] | readMasks[offset]
 }
 
-func (a *APU) Write8(address uint16, data uint8) {
+// readNR52 returns the power state and whether each channel is playing
+func (a *APU) readNR52() uint8 {
+	data := readMasks[0x16]
+	if a.powered {
+		data |= PowerFlag
+	}
+	for i, enabled := range []bool{a.ch1.enabled, a.ch2.enabled, a.ch3.enabled, a.ch4.enabled} {
+		if enabled {
+			data |= 1 << i
+		}
+	}
+	return data
 }
 
 func (a *APU) Read16(address uint16) uint16 {
-	return 0
+	loByte := a.Read8(address)
+	hiByte := a.Read8(address + 1)
+	return ((uint16)(hiByte)<<8 | (uint16)(loByte))
+}
+
+func (a *APU) Write8(address uint16, data uint8) {
+	if a.waveRange.Contains(address) {
+		a.ch3.writeRAM(address-0xff30, data)
+		return
+	}
+	if !a.regsRange.Contains(address) {
+		log.Fatalf("APU cannot be accessed at 0x%04x", address)
+	}
+
+	if address == 0xff26 {
+		a.writeNR52(data)
+		return
+	}
+
+	// Registers are read-only while powered off, except the length counters
+	// on DMG
+	if !a.powered {
+		if a.cgbMode || !isLengthRegister(address) {
+			return
+		}
+		if address == 0xff11 || address == 0xff16 {
+			data &= 0b111111
+		}
+	}
+	a.writeRegister(address, data)
+}
+
+func isLengthRegister(address uint16) bool {
+	return address == 0xff11 || address == 0xff16 || address == 0xff1b || address == 0xff20
+}
+
+func (a *APU) writeRegister(address uint16, data uint8) {
+	a.regs[address-0xff10] = data
+
+	switch {
+	case address <= 0xff14:
+		a.ch1.write(address-0xff10, data)
+	case address >= 0xff16 && address <= 0xff19:
+		a.ch2.write(address-0xff15, data)
+	case address >= 0xff1a && address <= 0xff1e:
+		a.ch3.write(address-0xff1a, data)
+	case address >= 0xff20 && address <= 0xff23:
+		a.ch4.write(address-0xff1f, data)
+	}
+}
+
+func (a *APU) writeNR52(data uint8) {
+	powered := data&PowerFlag != 0
+	switch {
+	case a.powered && !powered:
+		a.powerOff()
+	case !a.powered && powered:
+		a.powerOn()
+	}
+}
+
+// powerOff clears NR10-NR51, which also disables all channels. Length counters
+// are kept on DMG, and cleared on CGB.
+func (a *APU) powerOff() {
+	lengths := [ChannelCount]int{
+		a.ch1.length.counter,
+		a.ch2.length.counter,
+		a.ch3.length.counter,
+		a.ch4.length.counter,
+	}
+	if a.cgbMode {
+		lengths = [ChannelCount]int{}
+	}
+
+	for address := uint16(0xff10); address < 0xff26; address++ {
+		a.writeRegister(address, 0)
+	}
+	a.ch1.length.counter = lengths[0]
+	a.ch2.length.counter = lengths[1]
+	a.ch3.length.counter = lengths[2]
+	a.ch4.length.counter = lengths[3]
+	a.powered = false
+}
+
+// powerOn restarts the frame sequencer and the duty steps
+func (a *APU) powerOn() {
+	a.powered = true
+	a.frameCycles = 0
+	a.frameStep = 0
+	a.ch1.dutyStep = 0
+	a.ch2.dutyStep = 0
+	a.ch3.buffer = 0
 }
 
 func (a *APU) Write16(address uint16, data uint16) {
+	hiByte := (uint8)(data >> 8)
+	loByte := (uint8)(data & 0xff)
+
+	a.Write8(address, loByte)
+	a.Write8(address+1, hiByte)
 }
@@ -0,0 +1,516 @@
+package apu
+
+import (
+	"math"
+	"testing"
+
+	"github.com/d2verb/gemu/pkg/gameboy/bus"
+)
+
+func newTestAPU(t *testing.T) *APU {
+	t.Helper()
+
+	a := New()
+	if err := a.ConnectToBus(bus.New()); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// trigger starts channel 1 or 2 at full volume without envelope and length
+func trigger(a *APU, base uint16, duty uint8, period uint16) {
+	a.Write8(base+1, duty<<6)
+	a.Write8(base+2, 0xf0)
+	a.Write8(base+3, uint8(period))
+	a.Write8(base+4, TriggerFlag|uint8(period>>8))
+}
+
+func TestReadMasks(t *testing.T) {
+	a := newTestAPU(t)
+
+	for i := range readMasks {
+		address := 0xff10 + uint16(i)
+		if address == 0xff26 {
+			continue
+		}
+		a.Write8(address, 0)
+		if got := a.Read8(address); got != readMasks[i] {
+			t.Errorf("0x%04x: expected 0x%02x, got 0x%02x", address, readMasks[i], got)
+		}
+	}
+
+	a.Write8(0xff11, 0b10101010)
+	if got := a.Read8(0xff11); got != 0b10111111 {
+		t.Errorf("NR11: expected duty only, got 0b%08b", got)
+	}
+}
+
+func TestPulseDuty(t *testing.T) {
+	tests := []struct {
+		duty uint8
+		high int
+	}{
+		{0, 1},
+		{1, 2},
+		{2, 4},
+		{3, 6},
+	}
+
+	for _, tt := range tests {
+		a := newTestAPU(t)
+		// 4 cycles per duty step
+		trigger(a, 0xff15, tt.duty, 2047)
+
+		high := 0
+		for i := 0; i < 8; i++ {
+			if a.ch2.output() == dac(15) {
+				high++
+			}
+			a.ch2.step(4)
+		}
+		if high != tt.high {
+			t.Errorf("duty %d: expected %d high steps, got %d", tt.duty, tt.high, high)
+		}
+	}
+}
+
+func TestPulsePeriod(t *testing.T) {
+	a := newTestAPU(t)
+	trigger(a, 0xff15, 2, 2048-10)
+
+	a.ch2.step(39)
+	if a.ch2.dutyStep != 0 {
+		t.Errorf("expected duty step 0, got %d", a.ch2.dutyStep)
+	}
+	a.ch2.step(1)
+	if a.ch2.dutyStep != 1 {
+		t.Errorf("expected duty step 1, got %d", a.ch2.dutyStep)
+	}
+}
+
+func TestLength(t *testing.T) {
+	a := newTestAPU(t)
+	a.Write8(0xff12, 0xf0)
+	// 2 ticks of the 256 Hz length counter
+	a.Write8(0xff11, 62)
+	a.Write8(0xff14, TriggerFlag|LengthEnableFlag)
+
+	a.Step(CyclesPerFrameStep * 2)
+	if !a.ch1.enabled {
+		t.Fatal("channel 1 was disabled too early")
+	}
+	a.Step(CyclesPerFrameStep * 2)
+	if a.ch1.enabled {
+		t.Error("channel 1 was not disabled after the length expired")
+	}
+
+	// Trigger reloads the expired counter with 64
+	a.Write8(0xff14, TriggerFlag)
+	if a.ch1.length.counter != 64 {
+		t.Errorf("expected length 64, got %d", a.ch1.length.counter)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	a := newTestAPU(t)
+	// Volume 2, decrease every envelope tick
+	a.Write8(0xff17, 0x21)
+	a.Write8(0xff19, TriggerFlag)
+
+	for _, expected := range []uint8{2, 1, 0, 0} {
+		if a.ch2.envelope.volume != expected {
+			t.Errorf("expected volume %d, got %d", expected, a.ch2.envelope.volume)
+		}
+		a.Step(CyclesPerFrameStep * 8)
+	}
+
+	// Volume 14, increase every 2 envelope ticks
+	a.Write8(0xff17, 0xea)
+	a.Write8(0xff19, TriggerFlag)
+	a.Step(CyclesPerFrameStep * 8 * 4)
+	if a.ch2.envelope.volume != 15 {
+		t.Errorf("expected volume 15, got %d", a.ch2.envelope.volume)
+	}
+}
+
+func TestDACOff(t *testing.T) {
+	a := newTestAPU(t)
+	trigger(a, 0xff10, 2, 0)
+
+	a.Write8(0xff12, 0x00)
+	if a.ch1.enabled {
+		t.Error("channel 1 was not disabled with the DAC")
+	}
+	a.Write8(0xff14, TriggerFlag)
+	if a.ch1.enabled {
+		t.Error("channel 1 was triggered with the DAC off")
+	}
+	if a.ch1.output() != 0 {
+		t.Errorf("expected no output, got %f", a.ch1.output())
+	}
+}
+
+func TestSweep(t *testing.T) {
+	a := newTestAPU(t)
+	// Pace 1, increase by period >> 1
+	a.Write8(0xff10, 0x11)
+	trigger(a, 0xff10, 2, 0x100)
+
+	// Sweep is clocked at frame step 2 and 6
+	a.Step(CyclesPerFrameStep * 3)
+	if a.ch1.period != 0x180 {
+		t.Errorf("expected period 0x180, got 0x%03x", a.ch1.period)
+	}
+	a.Step(CyclesPerFrameStep * 4)
+	if a.ch1.period != 0x240 {
+		t.Errorf("expected period 0x240, got 0x%03x", a.ch1.period)
+	}
+
+	// Overflow disables the channel
+	trigger(a, 0xff10, 2, 0x700)
+	a.Step(CyclesPerFrameStep * 4)
+	if a.ch1.enabled {
+		t.Error("channel 1 was not disabled on sweep overflow")
+	}
+}
+
+func TestSweepDecrease(t *testing.T) {
+	a := newTestAPU(t)
+	// Pace 1, decrease by period >> 2
+	a.Write8(0xff10, 0x1a)
+	trigger(a, 0xff10, 2, 0x400)
+
+	a.Step(CyclesPerFrameStep * 3)
+	if a.ch1.period != 0x300 {
+		t.Errorf("expected period 0x300, got 0x%03x", a.ch1.period)
+	}
+
+	// Leaving decrease mode after it has been used disables the channel
+	a.Write8(0xff10, 0x12)
+	if a.ch1.enabled {
+		t.Error("channel 1 was not disabled on leaving decrease mode")
+	}
+}
+
+func TestSamples(t *testing.T) {
+	a := newTestAPU(t)
+	trigger(a, 0xff10, 2, 2047)
+
+	a.Step(CyclesPerSample * 10)
+	samples := a.Samples()
+	if len(samples) != 10 {
+		t.Fatalf("expected 10 samples, got %d", len(samples))
+	}
+	if len(a.Samples()) != 0 {
+		t.Error("samples were not drained")
+	}
+
+	a.Step(CyclesPerSample * (MaxBufferedSamples + 1))
+	if len(a.Samples()) != MaxBufferedSamples {
+		t.Error("samples were not dropped when the buffer is full")
+	}
+}
+
+// triggerWave starts channel 3 at full volume without length
+func triggerWave(a *APU, period uint16) {
+	a.Write8(0xff1a, WaveDACFlag)
+	a.Write8(0xff1c, 0b0100000)
+	a.Write8(0xff1d, uint8(period))
+	a.Write8(0xff1e, TriggerFlag|uint8(period>>8))
+}
+
+func TestWave(t *testing.T) {
+	tests := []struct {
+		level    uint8
+		expected uint8
+	}{
+		{0, 0},
+		{1, 0xc},
+		{2, 0x6},
+		{3, 0x3},
+	}
+
+	for _, tt := range tests {
+		a := newTestAPU(t)
+		a.Write8(0xff30, 0x0c)
+		triggerWave(a, 2047)
+		a.Write8(0xff1c, tt.level<<5)
+
+		// Sample 1 is played first after the trigger delay
+		a.Step(2 + waveTriggerDelay)
+		if a.ch3.position != 1 {
+			t.Fatalf("expected position 1, got %d", a.ch3.position)
+		}
+		if got := a.ch3.output(); got != dac(tt.expected) {
+			t.Errorf("level %d: expected %f, got %f", tt.level, dac(tt.expected), got)
+		}
+	}
+}
+
+func TestWaveLength(t *testing.T) {
+	a := newTestAPU(t)
+	a.Write8(0xff1b, 255)
+	a.Write8(0xff1a, WaveDACFlag)
+	a.Write8(0xff1e, TriggerFlag|LengthEnableFlag)
+
+	a.Step(CyclesPerFrameStep)
+	if a.ch3.enabled {
+		t.Error("channel 3 was not disabled after the length expired")
+	}
+
+	a.Write8(0xff1e, TriggerFlag)
+	if a.ch3.length.counter != 256 {
+		t.Errorf("expected length 256, got %d", a.ch3.length.counter)
+	}
+
+	a.Write8(0xff1a, 0)
+	if a.ch3.enabled {
+		t.Error("channel 3 was not disabled with the DAC")
+	}
+}
+
+func TestWaveRAM(t *testing.T) {
+	a := newTestAPU(t)
+	for i := uint16(0); i < WaveRAMSize; i++ {
+		a.Write8(0xff30+i, uint8(i))
+	}
+	for i := uint16(0); i < WaveRAMSize; i++ {
+		if got := a.Read8(0xff30 + i); got != uint8(i) {
+			t.Errorf("0x%04x: expected 0x%02x, got 0x%02x", 0xff30+i, i, got)
+		}
+	}
+}
+
+func TestWaveRAMWhilePlaying(t *testing.T) {
+	// 2 samples per 64 cycles
+	period := uint16(2048 - 16)
+
+	a := newTestAPU(t)
+	for i := uint16(0); i < WaveRAMSize; i++ {
+		a.Write8(0xff30+i, uint8(i))
+	}
+	triggerWave(a, period)
+
+	// The channel reads sample 2 in byte 1
+	a.Step(waveTriggerDelay + 64)
+	if got := a.Read8(0xff3f); got != 0x01 {
+		t.Errorf("expected the byte being read, got 0x%02x", got)
+	}
+	a.Write8(0xff3f, 0xab)
+	if a.ch3.ram[1] != 0xab || a.ch3.ram[0xf] != 0xf {
+		t.Error("the write did not go to the byte being read")
+	}
+
+	// DMG blocks the access when the channel is not reading
+	a.Step(8)
+	if got := a.Read8(0xff30); got != 0xff {
+		t.Errorf("expected 0xff, got 0x%02x", got)
+	}
+	a.Write8(0xff30, 0xcd)
+	if a.ch3.ram[0] != 0x00 || a.ch3.ram[1] != 0xab {
+		t.Error("wave RAM was written while inaccessible")
+	}
+
+	// CGB always accesses the byte being read
+	a = newTestAPU(t)
+	a.EnableCGBMode()
+	for i := uint16(0); i < WaveRAMSize; i++ {
+		a.Write8(0xff30+i, uint8(i))
+	}
+	triggerWave(a, period)
+	a.Step(waveTriggerDelay + 64 + 8)
+	if got := a.Read8(0xff30); got != 0x01 {
+		t.Errorf("expected the byte being read, got 0x%02x", got)
+	}
+}
+
+func TestWaveTriggerCorruption(t *testing.T) {
+	period := uint16(2048 - 16)
+
+	a := newTestAPU(t)
+	for i := uint16(0); i < WaveRAMSize; i++ {
+		a.Write8(0xff30+i, uint8(i))
+	}
+	triggerWave(a, period)
+
+	// Retrigger right before the channel reads byte 4 (sample 8)
+	a.Step(waveTriggerDelay + 32*8 - 1)
+	a.Write8(0xff1e, TriggerFlag|uint8(period>>8))
+	expected := [WaveRAMSize]uint8{4, 5, 6, 7, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	if a.ch3.ram != expected {
+		t.Errorf("expected %v, got %v", expected, a.ch3.ram)
+	}
+}
+
+func TestNoiseLFSR(t *testing.T) {
+	a := newTestAPU(t)
+	a.Write8(0xff21, 0xf0)
+	// Divisor 8 without shift
+	a.Write8(0xff22, 0x00)
+	a.Write8(0xff23, TriggerFlag)
+
+	a.Step(8)
+	if a.ch4.lfsr != 0x3fff {
+		t.Errorf("expected 0x3fff, got 0x%04x", a.ch4.lfsr)
+	}
+	a.Step(8 * 13)
+	if a.ch4.lfsr != 0x0001 {
+		t.Errorf("expected 0x0001, got 0x%04x", a.ch4.lfsr)
+	}
+	if got := a.ch4.output(); got != dac(0) {
+		t.Errorf("expected %f, got %f", dac(0), got)
+	}
+	a.Step(8)
+	if a.ch4.lfsr != 0x4000 {
+		t.Errorf("expected 0x4000, got 0x%04x", a.ch4.lfsr)
+	}
+	if got := a.ch4.output(); got != dac(15) {
+		t.Errorf("expected %f, got %f", dac(15), got)
+	}
+}
+
+func TestNoiseShortLFSR(t *testing.T) {
+	a := newTestAPU(t)
+	a.Write8(0xff21, 0xf0)
+	// Divisor 16 shifted by 2, 7-bit mode
+	a.Write8(0xff22, 0x20|LFSRWidthFlag|1)
+	a.Write8(0xff23, TriggerFlag)
+
+	a.Step(64 - 1)
+	if a.ch4.lfsr != 0x7fff {
+		t.Errorf("expected 0x7fff, got 0x%04x", a.ch4.lfsr)
+	}
+
+	// The sequence repeats every 127 clocks
+	seen := map[uint16]bool{}
+	for i := 0; i < 127; i++ {
+		a.Step(64)
+		seen[a.ch4.lfsr&0x7f] = true
+	}
+	if len(seen) != 127 {
+		t.Errorf("expected 127 states, got %d", len(seen))
+	}
+}
+
+func TestMix(t *testing.T) {
+	a := newTestAPU(t)
+	trigger(a, 0xff10, 2, 2047)
+	trigger(a, 0xff15, 2, 2047)
+	a.ch1.dutyStep = 7
+	a.ch2.dutyStep = 7
+
+	a.Write8(0xff24, 0x70)
+	a.Write8(0xff25, 0x12)
+	mixed := mixChannels(a.panChannels())
+	if expected := dac(15) / 4; mixed.Left != expected {
+		t.Errorf("left: expected %f, got %f", expected, mixed.Left)
+	}
+	if expected := dac(15) / 8 / 4; mixed.Right != expected {
+		t.Errorf("right: expected %f, got %f", expected, mixed.Right)
+	}
+
+	a.Write8(0xff25, 0x00)
+	if mixed := mixChannels(a.panChannels()); mixed.Left != 0 || mixed.Right != 0 {
+		t.Errorf("expected silence, got %v", mixed)
+	}
+}
+
+func TestHighPass(t *testing.T) {
+	a := newTestAPU(t)
+	// The DAC is on but the channel is silent
+	a.Write8(0xff12, 0xf0)
+
+	a.Step(CyclesPerSample)
+	first := a.Samples()[0].Left
+	a.Step(SampleRate * CyclesPerSample)
+	samples := a.Samples()
+	last := samples[len(samples)-1].Left
+	if first == 0 || last < -0.001 || last > 0.001 {
+		t.Errorf("expected the DC offset to decay, got %f then %f", first, last)
+	}
+}
+
+func TestPower(t *testing.T) {
+	a := newTestAPU(t)
+	trigger(a, 0xff10, 2, 0)
+	a.Write8(0xff1a, WaveDACFlag)
+	a.Write8(0xff1e, TriggerFlag)
+	a.Write8(0xff30, 0x12)
+
+	if got := a.Read8(0xff26); got != 0xf5 {
+		t.Errorf("expected 0xf5, got 0x%02x", got)
+	}
+
+	a.Write8(0xff26, 0x00)
+	if got := a.Read8(0xff26); got != 0x70 {
+		t.Errorf("expected 0x70, got 0x%02x", got)
+	}
+	for address := uint16(0xff10); address < 0xff26; address++ {
+		if got := a.Read8(address); got != readMasks[address-0xff10] {
+			t.Errorf("0x%04x: expected 0x%02x, got 0x%02x", address, readMasks[address-0xff10], got)
+		}
+	}
+	if got := a.Read8(0xff30); got != 0x12 {
+		t.Errorf("wave RAM was cleared, got 0x%02x", got)
+	}
+
+	// Registers are read-only but the length counters on DMG
+	a.Write8(0xff12, 0xf0)
+	a.Write8(0xff11, 0xff)
+	if a.Read8(0xff12) != 0 {
+		t.Error("NR12 was written while powered off")
+	}
+	if a.ch1.duty != 0 || a.ch1.length.counter != 1 {
+		t.Error("only the length counter should be written while powered off")
+	}
+
+	a.Write8(0xff26, PowerFlag)
+	a.Write8(0xff12, 0xf0)
+	if a.Read8(0xff12) != 0xf0 {
+		t.Error("NR12 was not written after powered on")
+	}
+}
+
+func TestPowerCGB(t *testing.T) {
+	a := newTestAPU(t)
+	a.EnableCGBMode()
+	a.Write8(0xff11, 0x3e)
+
+	a.Write8(0xff26, 0x00)
+	if a.ch1.length.counter != 0 {
+		t.Errorf("expected the length counter to be cleared, got %d", a.ch1.length.counter)
+	}
+	a.Write8(0xff11, 0x3e)
+	if a.ch1.length.counter != 0 {
+		t.Error("the length counter was written while powered off")
+	}
+}
+
+func TestChannelSamples(t *testing.T) {
+	a := newTestAPU(t)
+	a.Step(CyclesPerSample)
+	a.Samples()
+	if channels := a.ChannelSamples(); len(channels[0]) != 0 {
+		t.Error("channel samples were recorded without being enabled")
+	}
+
+	a.EnableChannelSamples()
+	trigger(a, 0xff10, 2, 2047)
+	a.Write8(0xff1a, WaveDACFlag)
+	a.Write8(0xff1e, TriggerFlag)
+	a.Step(CyclesPerSample * 100)
+
+	samples := a.Samples()
+	channels := a.ChannelSamples()
+	for i := range channels {
+		if len(channels[i]) != len(samples) {
+			t.Fatalf("channel %d: expected %d samples, got %d", i+1, len(samples), len(channels[i]))
+		}
+	}
+	for i, s := range samples {
+		sum := mixChannels([ChannelCount]Sample{channels[0][i], channels[1][i], channels[2][i], channels[3][i]})
+		if math.Abs(float64(sum.Left-s.Left)) > 1e-5 || math.Abs(float64(sum.Right-s.Right)) > 1e-5 {
+			t.Fatalf("%d: channels add up to %v, expected %v", i, sum, s)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package apu
+
+// lengthCounter silences a channel after the given number of 256 Hz ticks
+type lengthCounter struct {
+	max     int
+	counter int
+	enabled bool
+}
+
+func (l *lengthCounter) load(length int) {
+	l.counter = l.max - length
+}
+
+// trigger reloads the counter only if it has expired
+func (l *lengthCounter) trigger() {
+	if l.counter == 0 {
+		l.counter = l.max
+	}
+}
+
+// clock returns true when the counter expires and the channel has to be
+// disabled
+func (l *lengthCounter) clock() bool {
+	if !l.enabled || l.counter == 0 {
+		return false
+	}
+	l.counter--
+	return l.counter == 0
+}
+
+// envelope changes the volume of a channel at 64 Hz
+type envelope struct {
+	initial  uint8
+	increase bool
+	pace     uint8
+	volume   uint8
+	timer    uint8
+}
+
+// write sets NRx2. The new volume takes effect on the next trigger.
+func (e *envelope) write(data uint8) {
+	e.initial = data >> 4
+	e.increase = data&0b1000 != 0
+	e.pace = data & 0b111
+}
+
+// dacEnabled returns false when the upper 5 bits of NRx2 are all 0
+func (e *envelope) dacEnabled() bool {
+	return e.initial != 0 || e.increase
+}
+
+func (e *envelope) trigger() {
+	e.volume = e.initial
+	e.timer = e.pace
+}
+
+func (e *envelope) clock() {
+	if e.pace == 0 {
+		return
+	}
+	e.timer--
+	if e.timer > 0 {
+		return
+	}
+	e.timer = e.pace
+
+	if e.increase && e.volume < 15 {
+		e.volume++
+	} else if !e.increase && e.volume > 0 {
+		e.volume--
+	}
+}
+
+// dac converts a 4-bit digital output to an analog value in [-1, 1]
+func dac(digital uint8) float32 {
+	return 1 - float32(digital)/7.5
+}
@@ -0,0 +1,108 @@
+package apu
+
+// NR43 bit flags
+const (
+	LFSRWidthFlag  = 0b1000
+	ClockShiftMask = 0b11110000
+	DivisorMask    = 0b111
+)
+
+// CPU cycles per LFSR clock for each divisor code, before the shift
+var noiseDivisors = [8]int{8, 16, 32, 48, 64, 80, 96, 112}
+
+// noise outputs a pseudo-random bit sequence generated by a LFSR (channel 4)
+type noise struct {
+	enabled  bool
+	shift    uint8
+	short    bool // 7-bit LFSR
+	divisor  uint8
+	timer    int
+	lfsr     uint16
+	length   lengthCounter
+	envelope envelope
+}
+
+func newNoise() *noise {
+	return &noise{
+		length: lengthCounter{max: 64},
+	}
+}
+
+// write handles NR41-NR44 given the offset of the register
+func (n *noise) write(offset uint16, data uint8) {
+	switch offset {
+	case 1:
+		n.length.load(int(data & 0b111111))
+	case 2:
+		n.envelope.write(data)
+		if !n.envelope.dacEnabled() {
+			n.enabled = false
+		}
+	case 3:
+		n.shift = data >> 4
+		n.short = data&LFSRWidthFlag != 0
+		n.divisor = data & DivisorMask
+	case 4:
+		n.length.enabled = data&LengthEnableFlag != 0
+		if data&TriggerFlag != 0 {
+			n.trigger()
+		}
+	}
+}
+
+func (n *noise) trigger() {
+	n.enabled = n.envelope.dacEnabled()
+	n.timer = n.periodCycles()
+	n.lfsr = 0x7fff
+	n.length.trigger()
+	n.envelope.trigger()
+}
+
+// periodCycles returns the CPU cycles per LFSR clock
+func (n *noise) periodCycles() int {
+	return noiseDivisors[n.divisor] << n.shift
+}
+
+func (n *noise) step(cycles int) {
+	// The LFSR is not clocked with shift 14 and 15
+	if n.shift >= 14 {
+		return
+	}
+
+	n.timer -= cycles
+	for n.timer <= 0 {
+		n.timer += n.periodCycles()
+		n.clockLFSR()
+	}
+}
+
+// clockLFSR shifts the LFSR to the right, feeding XOR of the lowest 2 bits
+// into bit 14, and also into bit 6 in 7-bit mode
+func (n *noise) clockLFSR() {
+	bit := (n.lfsr ^ n.lfsr>>1) & 1
+	n.lfsr = n.lfsr>>1 | bit<<14
+	if n.short {
+		n.lfsr = n.lfsr&^(1<<6) | bit<<6
+	}
+}
+
+func (n *noise) clockLength() {
+	if n.length.clock() {
+		n.enabled = false
+	}
+}
+
+func (n *noise) clockEnvelope() {
+	n.envelope.clock()
+}
+
+// output returns the analog output of the channel
+func (n *noise) output() float32 {
+	if !n.envelope.dacEnabled() {
+		return 0
+	}
+	if !n.enabled {
+		return dac(0)
+	}
+	return dac(uint8(^n.lfsr&1) * n.envelope.volume)
+}
@@ -0,0 +1,176 @@
+package apu
+
+// Output of the 8 duty steps for each duty cycle (12.5%, 25%, 50% and 75%)
+var dutyWaveforms = [4][8]uint8{
+	{0, 0, 0, 0, 0, 0, 0, 1},
+	{1, 0, 0, 0, 0, 0, 0, 1},
+	{1, 0, 0, 0, 0, 1, 1, 1},
+	{0, 1, 1, 1, 1, 1, 1, 0},
+}
+
+// NRx4 bit flags, shared by all channels
+const (
+	TriggerFlag      = 0b10000000
+	LengthEnableFlag = 0b1000000
+	PeriodHighMask   = 0b111
+)
+
+const maxPeriod = 2047
+
+// sweep periodically changes the period of channel 1
+type sweep struct {
+	pace      uint8
+	decrease  bool
+	step      uint8
+	timer     uint8
+	shadow    uint16
+	enabled   bool
+	decreased bool // A period was calculated in decrease mode since the trigger
+}
+
+// pulse is a square wave channel (channel 1 and 2). Only channel 1 has sweep.
+type pulse struct {
+	enabled  bool
+	hasSweep bool
+	duty     uint8
+	dutyStep int
+	period   uint16
+	timer    int
+	length   lengthCounter
+	envelope envelope
+	sweep    sweep
+}
+
+func newPulse(hasSweep bool) *pulse {
+	return &pulse{
+		hasSweep: hasSweep,
+		length:   lengthCounter{max: 64},
+	}
+}
+
+// write handles NRx0-NRx4 given the offset of the register
+func (p *pulse) write(offset uint16, data uint8) {
+	switch offset {
+	case 0:
+		p.sweep.pace = (data >> 4) & 0b111
+		p.sweep.step = data & 0b111
+		decrease := data&0b1000 != 0
+		// Leaving decrease mode after it has been used disables the channel
+		if p.sweep.decrease && !decrease && p.sweep.decreased {
+			p.enabled = false
+		}
+		p.sweep.decrease = decrease
+	case 1:
+		p.duty = data >> 6
+		p.length.load(int(data & 0b111111))
+	case 2:
+		p.envelope.write(data)
+		if !p.envelope.dacEnabled() {
+			p.enabled = false
+		}
+	case 3:
+		p.period = p.period&0x700 | uint16(data)
+	case 4:
+		p.period = p.period&0xff | uint16(data&PeriodHighMask)<<8
+		p.length.enabled = data&LengthEnableFlag != 0
+		if data&TriggerFlag != 0 {
+			p.trigger()
+		}
+	}
+}
+
+func (p *pulse) trigger() {
+	p.enabled = p.envelope.dacEnabled()
+	p.timer = p.periodCycles()
+	p.length.trigger()
+	p.envelope.trigger()
+
+	if !p.hasSweep {
+		return
+	}
+	p.sweep.shadow = p.period
+	p.sweep.timer = p.sweepPace()
+	p.sweep.enabled = p.sweep.pace != 0 || p.sweep.step != 0
+	p.sweep.decreased = false
+	if p.sweep.step != 0 {
+		p.nextPeriod()
+	}
+}
+
+// periodCycles returns the CPU cycles per duty step
+func (p *pulse) periodCycles() int {
+	return (2048 - int(p.period)) * 4
+}
+
+// sweepPace returns the sweep pace, where 0 is treated as 8
+func (p *pulse) sweepPace() uint8 {
+	if p.sweep.pace == 0 {
+		return 8
+	}
+	return p.sweep.pace
+}
+
+// nextPeriod calculates the period after a sweep iteration, and disables the
+// channel on overflow
+func (p *pulse) nextPeriod() uint16 {
+	delta := p.sweep.shadow >> p.sweep.step
+	period := p.sweep.shadow + delta
+	if p.sweep.decrease {
+		period = p.sweep.shadow - delta
+		p.sweep.decreased = true
+	}
+	if period > maxPeriod {
+		p.enabled = false
+	}
+	return period
+}
+
+func (p *pulse) step(cycles int) {
+	p.timer -= cycles
+	for p.timer <= 0 {
+		p.timer += p.periodCycles()
+		p.dutyStep = (p.dutyStep + 1) % 8
+	}
+}
+
+func (p *pulse) clockLength() {
+	if p.length.clock() {
+		p.enabled = false
+	}
+}
+
+func (p *pulse) clockEnvelope() {
+	p.envelope.clock()
+}
+
+func (p *pulse) clockSweep() {
+	if p.sweep.timer > 0 {
+		p.sweep.timer--
+	}
+	if p.sweep.timer > 0 {
+		return
+	}
+	p.sweep.timer = p.sweepPace()
+
+	if !p.sweep.enabled || p.sweep.pace == 0 {
+		return
+	}
+	period := p.nextPeriod()
+	if period <= maxPeriod && p.sweep.step != 0 {
+		p.sweep.shadow = period
+		p.period = period
+		// The overflow check is done again with the new period
+		p.nextPeriod()
+	}
+}
+
+// output returns the analog output of the channel
+func (p *pulse) output() float32 {
+	if !p.envelope.dacEnabled() {
+		return 0
+	}
+	if !p.enabled {
+		return dac(0)
+	}
+	return dac(dutyWaveforms[p.duty][p.dutyStep] * p.envelope.volume)
+}
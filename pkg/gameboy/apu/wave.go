@@ -0,0 +1,157 @@
+package apu
+
+// NR30 bit flags
+const (
+	WaveDACFlag = 0b10000000
+)
+
+const (
+	WaveRAMSize = 0x10
+	// The first sample is read a bit later than the period after the trigger
+	waveTriggerDelay = 6
+	// On DMG, wave RAM is accessible while the channel plays only in the cycle
+	// the channel reads it
+	waveAccessCycles = 2
+)
+
+// Right shift of the samples for each output level (mute, 100%, 50% and 25%)
+var waveShifts = [4]uint8{4, 0, 1, 2}
+
+// wave plays 32 4-bit samples in wave RAM (channel 3)
+type wave struct {
+	enabled   bool
+	dacOn     bool
+	level     uint8
+	period    uint16
+	timer     int
+	position  int
+	buffer    uint8 // The last sample read from wave RAM
+	sinceRead int   // Cycles since wave RAM was last read
+	ram       [WaveRAMSize]uint8
+	length    lengthCounter
+	cgbMode   bool
+}
+
+func newWave() *wave {
+	return &wave{
+		length: lengthCounter{max: 256},
+	}
+}
+
+// write handles NR30-NR34 given the offset of the register
+func (w *wave) write(offset uint16, data uint8) {
+	switch offset {
+	case 0:
+		w.dacOn = data&WaveDACFlag != 0
+		if !w.dacOn {
+			w.enabled = false
+		}
+	case 1:
+		w.length.load(int(data))
+	case 2:
+		w.level = (data >> 5) & 0b11
+	case 3:
+		w.period = w.period&0x700 | uint16(data)
+	case 4:
+		w.period = w.period&0xff | uint16(data&PeriodHighMask)<<8
+		w.length.enabled = data&LengthEnableFlag != 0
+		if data&TriggerFlag != 0 {
+			w.trigger()
+		}
+	}
+}
+
+func (w *wave) trigger() {
+	// On DMG, triggering the channel right when it reads wave RAM corrupts
+	// the first bytes of wave RAM
+	if !w.cgbMode && w.enabled && w.timer <= waveAccessCycles {
+		w.corrupt()
+	}
+
+	w.enabled = w.dacOn
+	w.timer = w.periodCycles() + waveTriggerDelay
+	w.position = 0
+	w.length.trigger()
+}
+
+// corrupt copies the byte about to be read (or its 4-byte aligned block) to
+// the beginning of wave RAM
+func (w *wave) corrupt() {
+	next := ((w.position + 1) % 32) / 2
+	if next < 4 {
+		w.ram[0] = w.ram[next]
+		return
+	}
+	copy(w.ram[:4], w.ram[next&^3:next&^3+4])
+}
+
+// periodCycles returns the CPU cycles per sample
+func (w *wave) periodCycles() int {
+	return (2048 - int(w.period)) * 2
+}
+
+func (w *wave) step(cycles int) {
+	w.sinceRead += cycles
+	if !w.enabled {
+		return
+	}
+
+	w.timer -= cycles
+	for w.timer <= 0 {
+		w.sinceRead = -w.timer
+		w.timer += w.periodCycles()
+		w.position = (w.position + 1) % 32
+		w.buffer = w.ram[w.position/2]
+	}
+}
+
+func (w *wave) clockLength() {
+	if w.length.clock() {
+		w.enabled = false
+	}
+}
+
+// ramOffset returns the offset of wave RAM the CPU accesses, or false if it
+// cannot be accessed. While the channel plays, the CPU accesses the byte the
+// channel is reading instead.
+func (w *wave) ramOffset(offset uint16) (uint16, bool) {
+	if !w.enabled {
+		return offset, true
+	}
+	if !w.cgbMode && w.sinceRead >= waveAccessCycles {
+		return 0, false
+	}
+	return uint16(w.position / 2), true
+}
+
+func (w *wave) readRAM(offset uint16) uint8 {
+	offset, ok := w.ramOffset(offset)
+	if !ok {
+		return 0xff
+	}
+	return w.ram[offset]
+}
+
+func (w *wave) writeRAM(offset uint16, data uint8) {
+	offset, ok := w.ramOffset(offset)
+	if !ok {
+		return
+	}
+	w.ram[offset] = data
+}
+
+// output returns the analog output of the channel
+func (w *wave) output() float32 {
+	if !w.dacOn {
+		return 0
+	}
+	if !w.enabled {
+		return dac(0)
+	}
+
+	sample := w.buffer >> 4
+	if w.position%2 == 1 {
+		sample = w.buffer & 0xf
+	}
+	return dac(sample >> waveShifts[w.level])
+}
@@ -7,6 +7,9 @@ import (
 
 const Hz = 4194304
 
+// The CPU pauses for 2050 M-cycles while switching the speed
+const SpeedSwitchCycles = 8200
+
 const (
 	IntVBlank    = 1 << 0
 	IntLCD       = 1 << 1
@@ -19,9 +22,19 @@ const (
 type CPU struct {
 	regs           Registers
 	ime            bool  // Interrupt Master Enable Flag
+	imeScheduled   bool  // EI takes effect after the next instruction
 	ie             uint8 // Interrupt Enable
 	_if            uint8 // Interrupt Flag
 	halt           bool
+	haltBug        bool // PC fails to increment on the next opcode fetch
+	stop           bool
+	cgbMode        bool
+	doubleSpeed    bool // CGB double speed mode
+	speedSwitch    bool // KEY1 bit 0: Prepare speed switch on the next STOP
+	tick           func(cycles int)
+	ticked         int // Cycles already passed to tick in the current step
+	accessible     func(address uint16) bool
+	stalled        int // Cycles the CPU is halted by a DMA transfer or a speed switch
 	bus            *bus.Bus
 	instructionSet map[uint16]instruction
 }
@@ -34,10 +47,44 @@ func New() *CPU {
 	}
 }
 
+// SetAccessCheck restricts the memory the CPU can access, e.g. during OAM DMA.
+// Reads from an inaccessible address return 0xff and writes are ignored.
+func (c *CPU) SetAccessCheck(accessible func(address uint16) bool) {
+	c.accessible = accessible
+}
+
+// Stall halts the CPU for the given cycles from the next step
+func (c *CPU) Stall(cycles int) {
+	c.stalled += cycles
+}
+
+// EnableCGBMode makes KEY1 (0xff4d) available so STOP can switch the CPU speed
+func (c *CPU) EnableCGBMode() {
+	c.cgbMode = true
+	// The CGB boot ROM leaves 0x11 in A, which games use to detect CGB
+	c.regs.A = 0x11
+}
+
+// DoubleSpeed reports whether the CPU runs at 2x speed relative to the PPU
+func (c *CPU) DoubleSpeed() bool {
+	return c.doubleSpeed
+}
+
+// SetTick makes the CPU advance the rest of the system through tick for every
+// memory access (4 cycles each) instead of leaving it to the caller of Step.
+// Cycles spent without memory access are ticked as well, so tick receives
+// exactly the cycles returned by Step.
+func (c *CPU) SetTick(tick func(cycles int)) {
+	c.tick = tick
+}
+
 func (c *CPU) ConnectToBus(b *bus.Bus) error {
 	if err := b.Map(bus.NewAddressRange(0xff0f, 0xff0f), c); err != nil {
 		return err
 	}
+	if err := b.Map(bus.NewAddressRange(0xff4d, 0xff4d), c); err != nil {
+		return err
+	}
 	if err := b.Map(bus.NewAddressRange(0xffff, 0xffff), c); err != nil {
 		return err
 	}
@@ -46,14 +93,40 @@ func (c *CPU) ConnectToBus(b *bus.Bus) error {
 }
 
 func (c *CPU) Step() int {
+	c.ticked = 0
+	cycles := c.step()
+
+	// Tick the remaining internal cycles at the end of the instruction
+	if c.tick != nil && cycles > c.ticked {
+		c.tick(cycles - c.ticked)
+	}
+
+	return cycles
+}
+
+func (c *CPU) step() int {
+	// The CPU does nothing while a DMA transfer holds the bus
+	if c.stalled > 0 {
+		cycles := c.stalled
+		c.stalled = 0
+		return cycles
+	}
+
+	// Handle interrupts
+	if cycles := c.handleInterrupts(); cycles > 0 {
+		return cycles
+	}
+
 	if c.halt {
-		if c.ie&c._if != 0 {
-			c.halt = false
-		}
+		return 4
+	}
+
+	if c.stop {
 		return 4
 	}
 
 	instAddr := c.regs.PC
+	enableIME := c.imeScheduled
 
 	// Fetch opcode
 	opcode := c.fetch()
@@ -67,30 +140,78 @@ func (c *CPU) Step() int {
 	// Execute instruction
 	cycles := instruction.handler(c)
 
-	// Handle interrupts
-	if c.ime {
-		cycles += c.handleInterrupts()
+	// EI enables interrupts only after the instruction following it is executed.
+	// DI in between cancels the scheduled enable.
+	if enableIME && c.imeScheduled {
+		c.ime = true
+		c.imeScheduled = false
 	}
 
 	return cycles
 }
 
 func (c *CPU) fetch() uint16 {
-	var opcode uint16 = uint16(c.bus.Read8(c.regs.PC))
-	c.regs.PC++
+	var opcode uint16 = uint16(c.read8(c.regs.PC))
+	if c.haltBug {
+		// The byte after HALT is read twice
+		c.haltBug = false
+	} else {
+		c.regs.PC++
+	}
 
 	if opcode == 0xcb {
-		opcode = (opcode << 8) | uint16(c.bus.Read8(c.regs.PC))
+		opcode = (opcode << 8) | uint16(c.read8(c.regs.PC))
 		c.regs.PC++
 	}
 
 	return opcode
 }
 
+// idle spends an M-cycle without memory access
+func (c *CPU) idle() {
+	if c.tick == nil {
+		return
+	}
+	c.tick(4)
+	c.ticked += 4
+}
+
+// The memory access happens at the end of its M-cycle, so the rest of the
+// system is ticked before the access
+func (c *CPU) read8(address uint16) uint8 {
+	c.idle()
+	if c.accessible != nil && !c.accessible(address) {
+		return 0xff
+	}
+	return c.bus.Read8(address)
+}
+
+func (c *CPU) write8(address uint16, data uint8) {
+	c.idle()
+	if c.accessible != nil && !c.accessible(address) {
+		return
+	}
+	c.bus.Write8(address, data)
+}
+
+func (c *CPU) read16(address uint16) uint16 {
+	loByte := c.read8(address)
+	hiByte := c.read8(address + 1)
+	return ((uint16)(hiByte)<<8 | (uint16)(loByte))
+}
+
+func (c *CPU) write16(address uint16, data uint16) {
+	c.write8(address, (uint8)(data&0xff))
+	c.write8(address+1, (uint8)(data>>8))
+}
+
 func (c *CPU) Read8(address uint16) uint8 {
 	switch address {
 	case 0xff0f:
-		return c._if
+		// Upper 3 bits are unused and always read as 1
+		return c._if | 0xe0
+	case 0xff4d:
+		return c.key1()
 	case 0xffff:
 		return c.ie
 	default:
@@ -102,7 +223,11 @@ func (c *CPU) Read8(address uint16) uint8 {
 func (c *CPU) Write8(address uint16, data uint8) {
 	switch address {
 	case 0xff0f:
-		c._if = data
+		c._if = data & 0x1f
+	case 0xff4d:
+		if c.cgbMode {
+			c.speedSwitch = data&0x01 != 0
+		}
 	case 0xffff:
 		c.ie = data
 	default:
@@ -110,6 +235,44 @@ func (c *CPU) Write8(address uint16, data uint8) {
 	}
 }
 
+// KEY1 - Prepare Speed Switch (CGB only)
+//
+// Bit 7 - Current Speed (0=Normal, 1=Double) (Read only)
+// Bit 0 - Prepare Speed Switch (0=No, 1=Prepare)
+func (c *CPU) key1() uint8 {
+	if !c.cgbMode {
+		return 0xff
+	}
+
+	var data uint8 = 0x7e
+	if c.doubleSpeed {
+		data |= 0x80
+	}
+	if c.speedSwitch {
+		data |= 0x01
+	}
+	return data
+}
+
+// STOP switches the CPU speed if it is prepared through KEY1. Otherwise the
+// CPU enters the low power mode and waits for a joypad input.
+func (c *CPU) stopCPU() int {
+	// STOP resets the divider of the timer
+	c.bus.Write8(0xff04, 0)
+
+	if c.cgbMode && c.speedSwitch {
+		c.Stall(SpeedSwitchCycles)
+		c.doubleSpeed = !c.doubleSpeed
+		c.speedSwitch = false
+		return 4
+	}
+
+	// A joypad input before STOP does not wake the CPU up
+	c.bus.ClearIF(IntJoypad)
+	c.stop = true
+	return 4
+}
+
 func (c *CPU) Read16(address uint16) uint16 {
 	log.Fatalf("CPU cannot be accessed at 0x%04x", address+1)
 	return 0
@@ -119,16 +282,33 @@ func (c *CPU) Write16(address uint16, data uint16) {
 	log.Fatalf("CPU cannot be accessed at 0x%04x", address+1)
 }
 
+// Only the pending interrupt with the highest priority (the lowest bit) is
+// serviced. The others stay pending in IF until the ISR returns.
 func (c *CPU) handleInterrupts() int {
-	filteredFlags := c.ie & c._if
-	accumulatedCycles := 0
+	// Only a joypad input can bring the CPU back from STOP mode, even if the
+	// joypad interrupt is disabled
+	if c._if&IntJoypad != 0 {
+		c.stop = false
+	}
+
+	filteredFlags := c.ie & c._if & (1<<intrSentinel - 1)
+	if filteredFlags == 0 {
+		return 0
+	}
+
+	// Any pending interrupt wakes the CPU up from HALT even if IME is disabled
+	c.halt = false
+
+	if !c.ime {
+		return 0
+	}
+
 	for i := 0; i < intrSentinel; i++ {
-		if filteredFlags&(1<<i) == 0 {
-			continue
+		if filteredFlags&(1<<i) != 0 {
+			return c.handleInterrupt(1 << i)
 		}
-		accumulatedCycles += c.handleInterrupt(1 << i)
 	}
-	return accumulatedCycles
+	return 0
 }
 
 func (c *CPU) handleInterrupt(flag uint8) int {
@@ -147,25 +327,32 @@ func (c *CPU) handleInterrupt(flag uint8) int {
 	return c.callISR(address)
 }
 
+// Dispatching an interrupt takes 5 M-cycles: 2 wait states, 2 for pushing PC
+// and 1 for setting PC to the ISR address
 func (c *CPU) callISR(address uint16) int {
 	c.ime = false
-
-	// Save current PC to the stack as a return address
-	c.regs.SP = c.regs.SP - 2
-	c.bus.Write16(c.regs.SP, c.regs.PC)
+	c.imeScheduled = false
+	c.idle()
+
+	// Save current PC to the stack as a return address. After the HALT bug,
+	// PC still points to the byte after HALT, so the ISR returns to HALT.
+	if c.haltBug {
+		c.haltBug = false
+		c.regs.PC--
+	}
+	c.push16(c.regs.PC)
 
 	// Jump to the ISR
 	c.regs.PC = address
 
-	return 12
+	return 20
 }
 
 func (c *CPU) retISR() int {
 	c.ime = true
 
-	// Get return address from stack adn set it to PC
-	c.regs.PC = c.bus.Read16(c.regs.SP)
-	c.regs.SP = c.regs.SP + 2
+	// Get return address from stack and set it to PC
+	c.regs.PC = c.pop16()
 
-	return 12
+	return 16
 }
@@ -1,6 +1,10 @@
 package cpu
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/d2verb/gemu/pkg/gameboy/bus"
+)
 
 func TestSignExtU8ToU16(t *testing.T) {
 	tests := []struct {
@@ -105,3 +109,1253 @@ func TestBit8(t *testing.T) {
 		t.Errorf("Z flag should be set")
 	}
 }
+
+// testMemory is a flat 64KB memory which covers the whole address space
+// except the registers owned by the CPU
+type testMemory struct {
+	data    [0x10000]uint8
+	onWrite func(address uint16)
+}
+
+func (m *testMemory) ConnectToBus(b *bus.Bus) error {
+	if err := b.Map(bus.NewAddressRange(0x0000, 0xff0e), m); err != nil {
+		return err
+	}
+	if err := b.Map(bus.NewAddressRange(0xff10, 0xff4c), m); err != nil {
+		return err
+	}
+	if err := b.Map(bus.NewAddressRange(0xff4e, 0xfffe), m); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *testMemory) Read8(address uint16) uint8 {
+	return m.data[address]
+}
+
+func (m *testMemory) Read16(address uint16) uint16 {
+	return (uint16)(m.data[address+1])<<8 | (uint16)(m.data[address])
+}
+
+func (m *testMemory) Write8(address uint16, data uint8) {
+	m.data[address] = data
+	if m.onWrite != nil {
+		m.onWrite(address)
+	}
+}
+
+func (m *testMemory) Write16(address uint16, data uint16) {
+	m.data[address] = (uint8)(data & 0xff)
+	m.data[address+1] = (uint8)(data >> 8)
+}
+
+func newTestCPU(t *testing.T, program ...uint8) (*CPU, *testMemory) {
+	t.Helper()
+
+	b := bus.New()
+	m := &testMemory{}
+	c := New()
+	if err := m.ConnectToBus(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ConnectToBus(b); err != nil {
+		t.Fatal(err)
+	}
+	copy(m.data[c.regs.PC:], program)
+
+	return c, m
+}
+
+func TestInstructionSetCoverage(t *testing.T) {
+	invalid := map[uint16]bool{
+		0xd3: true, 0xdb: true, 0xdd: true, 0xe3: true, 0xe4: true, 0xeb: true,
+		0xec: true, 0xed: true, 0xf4: true, 0xfc: true, 0xfd: true,
+	}
+	set := newInstructionSet()
+
+	for opcode := uint16(0); opcode < 0x100; opcode++ {
+		_, ok := set[opcode]
+		switch {
+		case opcode == 0xcb:
+			if ok {
+				t.Errorf("0xcb is a prefix and must not be in the instruction set")
+			}
+		case invalid[opcode]:
+			if ok {
+				t.Errorf("0x%02x is not a valid opcode but is in the instruction set", opcode)
+			}
+		default:
+			if !ok {
+				t.Errorf("0x%02x is missing from the instruction set", opcode)
+			}
+		}
+	}
+}
+
+func TestPrefixedInstructionSetCoverage(t *testing.T) {
+	set := newInstructionSet()
+
+	for opcode := uint16(0xcb00); opcode <= 0xcbff; opcode++ {
+		if _, ok := set[opcode]; !ok {
+			t.Errorf("0x%04x is missing from the instruction set", opcode)
+		}
+	}
+}
+
+func TestInstructions(t *testing.T) {
+	tests := []struct {
+		name    string
+		program []uint8
+		setup   func(c *CPU, m *testMemory)
+		want    func(r *Registers)
+		check   func(t *testing.T, c *CPU, m *testMemory)
+		cycles  int
+	}{
+		{
+			name:    "nop",
+			program: []uint8{0x00},
+			want:    func(r *Registers) { r.PC = 0x101 },
+			cycles:  4,
+		},
+		{
+			name:    "ld BC, d16",
+			program: []uint8{0x01, 0x34, 0x12},
+			want:    func(r *Registers) { r.B, r.C, r.PC = 0x12, 0x34, 0x103 },
+			cycles:  12,
+		},
+		{
+			name:    "ld (BC), A",
+			program: []uint8{0x02},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A, c.regs.B, c.regs.C = 0x42, 0xc0, 0x00 },
+			check: func(t *testing.T, c *CPU, m *testMemory) {
+				if m.data[0xc000] != 0x42 {
+					t.Errorf("(0xc000) = 0x%02x, want 0x42", m.data[0xc000])
+				}
+			},
+			cycles: 8,
+		},
+		{
+			name:    "inc BC wraps around",
+			program: []uint8{0x03},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SetBC(0xffff) },
+			want:    func(r *Registers) { r.B, r.C, r.PC = 0, 0, 0x101 },
+			cycles:  8,
+		},
+		{
+			name:    "inc B keeps C flag",
+			program: []uint8{0x04},
+			setup:   func(c *CPU, m *testMemory) { c.regs.B, c.regs.F = 0xff, CFlag },
+			want:    func(r *Registers) { r.B, r.F, r.PC = 0, ZFlag|HFlag|CFlag, 0x101 },
+			cycles:  4,
+		},
+		{
+			name:    "dec B",
+			program: []uint8{0x05},
+			setup:   func(c *CPU, m *testMemory) { c.regs.B = 0x10 },
+			want:    func(r *Registers) { r.B, r.F, r.PC = 0x0f, NFlag|HFlag, 0x101 },
+			cycles:  4,
+		},
+		{
+			name:    "rlca",
+			program: []uint8{0x07},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A = 0x80 },
+			want:    func(r *Registers) { r.A, r.F, r.PC = 0x01, CFlag, 0x101 },
+			cycles:  4,
+		},
+		{
+			name:    "ld (a16), SP",
+			program: []uint8{0x08, 0x00, 0xc0},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SP = 0xbeef },
+			check: func(t *testing.T, c *CPU, m *testMemory) {
+				if m.Read16(0xc000) != 0xbeef {
+					t.Errorf("(0xc000) = 0x%04x, want 0xbeef", m.Read16(0xc000))
+				}
+			},
+			cycles: 20,
+		},
+		{
+			name:    "add HL, BC",
+			program: []uint8{0x09},
+			setup: func(c *CPU, m *testMemory) {
+				c.regs.SetHL(0x8fff)
+				c.regs.SetBC(0x8001)
+				c.regs.F = ZFlag
+			},
+			want:   func(r *Registers) { r.H, r.L, r.F, r.PC = 0x10, 0x00, ZFlag|HFlag|CFlag, 0x101 },
+			cycles: 8,
+		},
+		{
+			name:    "rrca",
+			program: []uint8{0x0f},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A = 0x01 },
+			want:    func(r *Registers) { r.A, r.F, r.PC = 0x80, CFlag, 0x101 },
+			cycles:  4,
+		},
+		{
+			name:    "rla",
+			program: []uint8{0x17},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A, c.regs.F = 0x80, CFlag },
+			want:    func(r *Registers) { r.A, r.F, r.PC = 0x01, CFlag, 0x101 },
+			cycles:  4,
+		},
+		{
+			name:    "rra",
+			program: []uint8{0x1f},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A = 0x01 },
+			want:    func(r *Registers) { r.A, r.F, r.PC = 0x00, CFlag, 0x101 },
+			cycles:  4,
+		},
+		{
+			name:    "jr r8 backwards",
+			program: []uint8{0x18, 0xfe},
+			want:    func(r *Registers) { r.PC = 0x100 },
+			cycles:  12,
+		},
+		{
+			name:    "jr NZ, r8 taken",
+			program: []uint8{0x20, 0x10},
+			want:    func(r *Registers) { r.PC = 0x112 },
+			cycles:  12,
+		},
+		{
+			name:    "jr NZ, r8 not taken",
+			program: []uint8{0x20, 0x10},
+			setup:   func(c *CPU, m *testMemory) { c.regs.F = ZFlag },
+			want:    func(r *Registers) { r.F, r.PC = ZFlag, 0x102 },
+			cycles:  8,
+		},
+		{
+			name:    "jr C, r8 taken",
+			program: []uint8{0x38, 0x10},
+			setup:   func(c *CPU, m *testMemory) { c.regs.F = CFlag },
+			want:    func(r *Registers) { r.F, r.PC = CFlag, 0x112 },
+			cycles:  12,
+		},
+		{
+			name:    "ld (HL+), A",
+			program: []uint8{0x22},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A = 0x42; c.regs.SetHL(0xc0ff) },
+			want:    func(r *Registers) { r.A, r.H, r.L, r.PC = 0x42, 0xc1, 0x00, 0x101 },
+			check: func(t *testing.T, c *CPU, m *testMemory) {
+				if m.data[0xc0ff] != 0x42 {
+					t.Errorf("(0xc0ff) = 0x%02x, want 0x42", m.data[0xc0ff])
+				}
+			},
+			cycles: 8,
+		},
+		{
+			name:    "ld A, (HL-)",
+			program: []uint8{0x3a},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SetHL(0xc000); m.data[0xc000] = 0x99 },
+			want:    func(r *Registers) { r.A, r.H, r.L, r.PC = 0x99, 0xbf, 0xff, 0x101 },
+			cycles:  8,
+		},
+		{
+			name:    "cpl",
+			program: []uint8{0x2f},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A = 0x35 },
+			want:    func(r *Registers) { r.A, r.F, r.PC = 0xca, NFlag|HFlag, 0x101 },
+			cycles:  4,
+		},
+		{
+			name:    "inc (HL)",
+			program: []uint8{0x34},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SetHL(0xc000); m.data[0xc000] = 0x0f },
+			want:    func(r *Registers) { r.H, r.L, r.F, r.PC = 0xc0, 0x00, HFlag, 0x101 },
+			check: func(t *testing.T, c *CPU, m *testMemory) {
+				if m.data[0xc000] != 0x10 {
+					t.Errorf("(0xc000) = 0x%02x, want 0x10", m.data[0xc000])
+				}
+			},
+			cycles: 12,
+		},
+		{
+			name:    "ld (HL), d8",
+			program: []uint8{0x36, 0x77},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SetHL(0xc000) },
+			check: func(t *testing.T, c *CPU, m *testMemory) {
+				if m.data[0xc000] != 0x77 {
+					t.Errorf("(0xc000) = 0x%02x, want 0x77", m.data[0xc000])
+				}
+			},
+			cycles: 12,
+		},
+		{
+			name:    "scf",
+			program: []uint8{0x37},
+			setup:   func(c *CPU, m *testMemory) { c.regs.F = ZFlag | NFlag | HFlag },
+			want:    func(r *Registers) { r.F, r.PC = ZFlag|CFlag, 0x101 },
+			cycles:  4,
+		},
+		{
+			name:    "ccf",
+			program: []uint8{0x3f},
+			setup:   func(c *CPU, m *testMemory) { c.regs.F = NFlag | HFlag | CFlag },
+			want:    func(r *Registers) { r.F, r.PC = 0, 0x101 },
+			cycles:  4,
+		},
+		{
+			name:    "ld B, C",
+			program: []uint8{0x41},
+			setup:   func(c *CPU, m *testMemory) { c.regs.C = 0x12 },
+			want:    func(r *Registers) { r.B, r.C, r.PC = 0x12, 0x12, 0x101 },
+			cycles:  4,
+		},
+		{
+			name:    "ld D, (HL)",
+			program: []uint8{0x56},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SetHL(0xc000); m.data[0xc000] = 0x5a },
+			want:    func(r *Registers) { r.D, r.H, r.L, r.PC = 0x5a, 0xc0, 0x00, 0x101 },
+			cycles:  8,
+		},
+		{
+			name:    "ld (HL), E",
+			program: []uint8{0x73},
+			setup:   func(c *CPU, m *testMemory) { c.regs.E = 0xa5; c.regs.SetHL(0xc000) },
+			check: func(t *testing.T, c *CPU, m *testMemory) {
+				if m.data[0xc000] != 0xa5 {
+					t.Errorf("(0xc000) = 0x%02x, want 0xa5", m.data[0xc000])
+				}
+			},
+			cycles: 8,
+		},
+		{
+			name:    "halt",
+			program: []uint8{0x76},
+			check: func(t *testing.T, c *CPU, m *testMemory) {
+				if !c.halt {
+					t.Errorf("CPU should be halted")
+				}
+			},
+			cycles: 4,
+		},
+		{
+			name:    "add A, B",
+			program: []uint8{0x80},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A, c.regs.B = 0x3a, 0xc6 },
+			want:    func(r *Registers) { r.A, r.B, r.F, r.PC = 0x00, 0xc6, ZFlag|HFlag|CFlag, 0x101 },
+			cycles:  4,
+		},
+		{
+			name:    "add A, B without carry",
+			program: []uint8{0x80},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A, c.regs.B, c.regs.F = 0x10, 0x00, CFlag },
+			want:    func(r *Registers) { r.A, r.F, r.PC = 0x10, 0, 0x101 },
+			cycles:  4,
+		},
+		{
+			name:    "adc A, C",
+			program: []uint8{0x89},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A, c.regs.C, c.regs.F = 0xe1, 0x0f, CFlag },
+			want:    func(r *Registers) { r.A, r.C, r.F, r.PC = 0xf1, 0x0f, HFlag, 0x101 },
+			cycles:  4,
+		},
+		{
+			name:    "sub (HL)",
+			program: []uint8{0x96},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A = 0x3e; c.regs.SetHL(0xc000); m.data[0xc000] = 0x3e },
+			want:    func(r *Registers) { r.A, r.H, r.L, r.F, r.PC = 0x00, 0xc0, 0x00, ZFlag|NFlag, 0x101 },
+			cycles:  8,
+		},
+		{
+			name:    "sbc A, H",
+			program: []uint8{0x9c},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A, c.regs.H, c.regs.F = 0x3b, 0x2a, CFlag },
+			want:    func(r *Registers) { r.A, r.H, r.F, r.PC = 0x10, 0x2a, NFlag, 0x101 },
+			cycles:  4,
+		},
+		{
+			name:    "and L",
+			program: []uint8{0xa5},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A, c.regs.L = 0x5a, 0x3f },
+			want:    func(r *Registers) { r.A, r.L, r.F, r.PC = 0x1a, 0x3f, HFlag, 0x101 },
+			cycles:  4,
+		},
+		{
+			name:    "xor A",
+			program: []uint8{0xaf},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A, c.regs.F = 0xff, CFlag },
+			want:    func(r *Registers) { r.A, r.F, r.PC = 0x00, ZFlag, 0x101 },
+			cycles:  4,
+		},
+		{
+			name:    "or D",
+			program: []uint8{0xb2},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A, c.regs.D = 0x50, 0x05 },
+			want:    func(r *Registers) { r.A, r.D, r.F, r.PC = 0x55, 0x05, 0, 0x101 },
+			cycles:  4,
+		},
+		{
+			name:    "cp E",
+			program: []uint8{0xbb},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A, c.regs.E = 0x3c, 0x40 },
+			want:    func(r *Registers) { r.A, r.E, r.F, r.PC = 0x3c, 0x40, NFlag|CFlag, 0x101 },
+			cycles:  4,
+		},
+		{
+			name:    "ret NZ taken",
+			program: []uint8{0xc0},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SP = 0xdffe; m.Write16(0xdffe, 0x1234) },
+			want:    func(r *Registers) { r.SP, r.PC = 0xe000, 0x1234 },
+			cycles:  20,
+		},
+		{
+			name:    "ret Z not taken",
+			program: []uint8{0xc8},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SP = 0xdffe; m.Write16(0xdffe, 0x1234) },
+			want:    func(r *Registers) { r.SP, r.PC = 0xdffe, 0x101 },
+			cycles:  8,
+		},
+		{
+			name:    "pop BC",
+			program: []uint8{0xc1},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SP = 0xdffe; m.Write16(0xdffe, 0xabcd) },
+			want:    func(r *Registers) { r.B, r.C, r.SP, r.PC = 0xab, 0xcd, 0xe000, 0x101 },
+			cycles:  12,
+		},
+		{
+			name:    "jp NC, a16 taken",
+			program: []uint8{0xd2, 0x00, 0x20},
+			want:    func(r *Registers) { r.PC = 0x2000 },
+			cycles:  16,
+		},
+		{
+			name:    "jp C, a16 not taken",
+			program: []uint8{0xda, 0x00, 0x20},
+			want:    func(r *Registers) { r.PC = 0x103 },
+			cycles:  12,
+		},
+		{
+			name:    "jp a16",
+			program: []uint8{0xc3, 0x50, 0x01},
+			want:    func(r *Registers) { r.PC = 0x150 },
+			cycles:  16,
+		},
+		{
+			name:    "call NZ, a16 taken",
+			program: []uint8{0xc4, 0x00, 0x20},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SP = 0xe000 },
+			want:    func(r *Registers) { r.SP, r.PC = 0xdffe, 0x2000 },
+			check: func(t *testing.T, c *CPU, m *testMemory) {
+				if m.Read16(0xdffe) != 0x103 {
+					t.Errorf("return address = 0x%04x, want 0x0103", m.Read16(0xdffe))
+				}
+			},
+			cycles: 24,
+		},
+		{
+			name:    "call Z, a16 not taken",
+			program: []uint8{0xcc, 0x00, 0x20},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SP = 0xe000 },
+			want:    func(r *Registers) { r.SP, r.PC = 0xe000, 0x103 },
+			cycles:  12,
+		},
+		{
+			name:    "push DE",
+			program: []uint8{0xd5},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SP = 0xe000; c.regs.SetDE(0x1357) },
+			want:    func(r *Registers) { r.D, r.E, r.SP, r.PC = 0x13, 0x57, 0xdffe, 0x101 },
+			check: func(t *testing.T, c *CPU, m *testMemory) {
+				if m.Read16(0xdffe) != 0x1357 {
+					t.Errorf("(SP) = 0x%04x, want 0x1357", m.Read16(0xdffe))
+				}
+			},
+			cycles: 16,
+		},
+		{
+			name:    "pop AF masks lower bits of F",
+			program: []uint8{0xf1},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SP = 0xdffe; m.Write16(0xdffe, 0x12ff) },
+			want:    func(r *Registers) { r.A, r.F, r.SP, r.PC = 0x12, 0xf0, 0xe000, 0x101 },
+			cycles:  12,
+		},
+		{
+			name:    "add A, d8",
+			program: []uint8{0xc6, 0x01},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A = 0x0f },
+			want:    func(r *Registers) { r.A, r.F, r.PC = 0x10, HFlag, 0x102 },
+			cycles:  8,
+		},
+		{
+			name:    "adc A, d8",
+			program: []uint8{0xce, 0xff},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A, c.regs.F = 0x00, CFlag },
+			want:    func(r *Registers) { r.A, r.F, r.PC = 0x00, ZFlag|HFlag|CFlag, 0x102 },
+			cycles:  8,
+		},
+		{
+			name:    "sub d8",
+			program: []uint8{0xd6, 0x01},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A = 0x00 },
+			want:    func(r *Registers) { r.A, r.F, r.PC = 0xff, NFlag|HFlag|CFlag, 0x102 },
+			cycles:  8,
+		},
+		{
+			name:    "sbc A, d8",
+			program: []uint8{0xde, 0x00},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A, c.regs.F = 0x10, CFlag },
+			want:    func(r *Registers) { r.A, r.F, r.PC = 0x0f, NFlag|HFlag, 0x102 },
+			cycles:  8,
+		},
+		{
+			name:    "and d8",
+			program: []uint8{0xe6, 0x0f},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A = 0xf0 },
+			want:    func(r *Registers) { r.A, r.F, r.PC = 0x00, ZFlag|HFlag, 0x102 },
+			cycles:  8,
+		},
+		{
+			name:    "or d8",
+			program: []uint8{0xf6, 0x0f},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A = 0xf0 },
+			want:    func(r *Registers) { r.A, r.F, r.PC = 0xff, 0, 0x102 },
+			cycles:  8,
+		},
+		{
+			name:    "cp d8",
+			program: []uint8{0xfe, 0x2f},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A = 0x3c },
+			want:    func(r *Registers) { r.A, r.F, r.PC = 0x3c, NFlag|HFlag, 0x102 },
+			cycles:  8,
+		},
+		{
+			name:    "rst 28H",
+			program: []uint8{0xef},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SP = 0xe000 },
+			want:    func(r *Registers) { r.SP, r.PC = 0xdffe, 0x28 },
+			check: func(t *testing.T, c *CPU, m *testMemory) {
+				if m.Read16(0xdffe) != 0x101 {
+					t.Errorf("return address = 0x%04x, want 0x0101", m.Read16(0xdffe))
+				}
+			},
+			cycles: 16,
+		},
+		{
+			name:    "ret",
+			program: []uint8{0xc9},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SP = 0xdffe; m.Write16(0xdffe, 0x4000) },
+			want:    func(r *Registers) { r.SP, r.PC = 0xe000, 0x4000 },
+			cycles:  16,
+		},
+		{
+			name:    "reti",
+			program: []uint8{0xd9},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SP = 0xdffe; m.Write16(0xdffe, 0x4000) },
+			want:    func(r *Registers) { r.SP, r.PC = 0xe000, 0x4000 },
+			check: func(t *testing.T, c *CPU, m *testMemory) {
+				if !c.ime {
+					t.Errorf("IME should be enabled")
+				}
+			},
+			cycles: 16,
+		},
+		{
+			name:    "ldh (a8), A",
+			program: []uint8{0xe0, 0x80},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A = 0x11 },
+			check: func(t *testing.T, c *CPU, m *testMemory) {
+				if m.data[0xff80] != 0x11 {
+					t.Errorf("(0xff80) = 0x%02x, want 0x11", m.data[0xff80])
+				}
+			},
+			cycles: 12,
+		},
+		{
+			name:    "ld (C), A",
+			program: []uint8{0xe2},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A, c.regs.C = 0x22, 0x81 },
+			check: func(t *testing.T, c *CPU, m *testMemory) {
+				if m.data[0xff81] != 0x22 {
+					t.Errorf("(0xff81) = 0x%02x, want 0x22", m.data[0xff81])
+				}
+			},
+			cycles: 8,
+		},
+		{
+			name:    "ld A, (C)",
+			program: []uint8{0xf2},
+			setup:   func(c *CPU, m *testMemory) { c.regs.C = 0x82; m.data[0xff82] = 0x33 },
+			want:    func(r *Registers) { r.A, r.C, r.PC = 0x33, 0x82, 0x101 },
+			cycles:  8,
+		},
+		{
+			name:    "add SP, r8",
+			program: []uint8{0xe8, 0xff},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SP, c.regs.F = 0x00ff, ZFlag|NFlag },
+			want:    func(r *Registers) { r.SP, r.F, r.PC = 0x00fe, HFlag|CFlag, 0x102 },
+			cycles:  16,
+		},
+		{
+			name:    "ld HL, SP+r8",
+			program: []uint8{0xf8, 0x02},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SP = 0xfff0 },
+			want:    func(r *Registers) { r.H, r.L, r.SP, r.F, r.PC = 0xff, 0xf2, 0xfff0, 0, 0x102 },
+			cycles:  12,
+		},
+		{
+			name:    "jp HL",
+			program: []uint8{0xe9},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SetHL(0x3000) },
+			want:    func(r *Registers) { r.H, r.L, r.PC = 0x30, 0x00, 0x3000 },
+			cycles:  4,
+		},
+		{
+			name:    "ld SP, HL",
+			program: []uint8{0xf9},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SetHL(0xcfff) },
+			want:    func(r *Registers) { r.H, r.L, r.SP, r.PC = 0xcf, 0xff, 0xcfff, 0x101 },
+			cycles:  8,
+		},
+		{
+			name:    "ld (a16), A",
+			program: []uint8{0xea, 0x34, 0xc2},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A = 0x44 },
+			check: func(t *testing.T, c *CPU, m *testMemory) {
+				if m.data[0xc234] != 0x44 {
+					t.Errorf("(0xc234) = 0x%02x, want 0x44", m.data[0xc234])
+				}
+			},
+			cycles: 16,
+		},
+		{
+			name:    "ld A, (a16)",
+			program: []uint8{0xfa, 0x34, 0xc2},
+			setup:   func(c *CPU, m *testMemory) { m.data[0xc234] = 0x55 },
+			want:    func(r *Registers) { r.A, r.PC = 0x55, 0x103 },
+			cycles:  16,
+		},
+		{
+			name:    "di",
+			program: []uint8{0xf3},
+			setup:   func(c *CPU, m *testMemory) { c.ime = true },
+			check: func(t *testing.T, c *CPU, m *testMemory) {
+				if c.ime {
+					t.Errorf("IME should be disabled")
+				}
+			},
+			cycles: 4,
+		},
+		{
+			name:    "rlc B",
+			program: []uint8{0xcb, 0x00},
+			setup:   func(c *CPU, m *testMemory) { c.regs.B = 0x85 },
+			want:    func(r *Registers) { r.B, r.F, r.PC = 0x0b, CFlag, 0x102 },
+			cycles:  8,
+		},
+		{
+			name:    "rrc (HL)",
+			program: []uint8{0xcb, 0x0e},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SetHL(0xc000); m.data[0xc000] = 0x00 },
+			want:    func(r *Registers) { r.F, r.PC = ZFlag, 0x102 },
+			cycles:  16,
+		},
+		{
+			name:    "rl C",
+			program: []uint8{0xcb, 0x11},
+			setup:   func(c *CPU, m *testMemory) { c.regs.C = 0x80 },
+			want:    func(r *Registers) { r.C, r.F, r.PC = 0x00, ZFlag|CFlag, 0x102 },
+			cycles:  8,
+		},
+		{
+			name:    "rr A",
+			program: []uint8{0xcb, 0x1f},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A, c.regs.F = 0x01, CFlag },
+			want:    func(r *Registers) { r.A, r.F, r.PC = 0x80, CFlag, 0x102 },
+			cycles:  8,
+		},
+		{
+			name:    "sla D",
+			program: []uint8{0xcb, 0x22},
+			setup:   func(c *CPU, m *testMemory) { c.regs.D = 0xff },
+			want:    func(r *Registers) { r.D, r.F, r.PC = 0xfe, CFlag, 0x102 },
+			cycles:  8,
+		},
+		{
+			name:    "sra E keeps sign bit",
+			program: []uint8{0xcb, 0x2b},
+			setup:   func(c *CPU, m *testMemory) { c.regs.E = 0x8a },
+			want:    func(r *Registers) { r.E, r.F, r.PC = 0xc5, 0, 0x102 },
+			cycles:  8,
+		},
+		{
+			name:    "swap H",
+			program: []uint8{0xcb, 0x34},
+			setup:   func(c *CPU, m *testMemory) { c.regs.H, c.regs.F = 0xf1, CFlag },
+			want:    func(r *Registers) { r.H, r.F, r.PC = 0x1f, 0, 0x102 },
+			cycles:  8,
+		},
+		{
+			name:    "srl L",
+			program: []uint8{0xcb, 0x3d},
+			setup:   func(c *CPU, m *testMemory) { c.regs.L = 0x01 },
+			want:    func(r *Registers) { r.L, r.F, r.PC = 0x00, ZFlag|CFlag, 0x102 },
+			cycles:  8,
+		},
+		{
+			name:    "bit 7, (HL) keeps C flag",
+			program: []uint8{0xcb, 0x7e},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SetHL(0xc000); c.regs.F = CFlag; m.data[0xc000] = 0x7f },
+			want:    func(r *Registers) { r.F, r.PC = ZFlag|HFlag|CFlag, 0x102 },
+			cycles:  12,
+		},
+		{
+			name:    "bit 0, A",
+			program: []uint8{0xcb, 0x47},
+			setup:   func(c *CPU, m *testMemory) { c.regs.A = 0x01 },
+			want:    func(r *Registers) { r.F, r.PC = HFlag, 0x102 },
+			cycles:  8,
+		},
+		{
+			name:    "res 3, B",
+			program: []uint8{0xcb, 0x98},
+			setup:   func(c *CPU, m *testMemory) { c.regs.B = 0xff },
+			want:    func(r *Registers) { r.B, r.PC = 0xf7, 0x102 },
+			cycles:  8,
+		},
+		{
+			name:    "set 5, (HL)",
+			program: []uint8{0xcb, 0xee},
+			setup:   func(c *CPU, m *testMemory) { c.regs.SetHL(0xc000) },
+			check: func(t *testing.T, c *CPU, m *testMemory) {
+				if m.data[0xc000] != 0x20 {
+					t.Errorf("(0xc000) = 0x%02x, want 0x20", m.data[0xc000])
+				}
+			},
+			cycles: 16,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, m := newTestCPU(t, tt.program...)
+			if tt.setup != nil {
+				tt.setup(c, m)
+			}
+
+			want := c.regs
+			if tt.want != nil {
+				tt.want(&want)
+			}
+
+			cycles := c.Step()
+			if cycles != tt.cycles {
+				t.Errorf("cycles = %d, want %d", cycles, tt.cycles)
+			}
+			if tt.want != nil && c.regs != want {
+				t.Errorf("registers = %+v, want %+v", c.regs, want)
+			}
+			if tt.check != nil {
+				tt.check(t, c, m)
+			}
+		})
+	}
+}
+
+// daaReference adjusts A in two sequential steps, each one seeing the result
+// of the previous step. It is written differently from CPU.daa on purpose.
+func daaReference(a uint8, f uint8) (uint8, uint8) {
+	result := (uint16)(a)
+	carry := f&CFlag != 0
+
+	if f&NFlag != 0 {
+		if f&HFlag != 0 {
+			result = (result - 0x06) & 0xff
+		}
+		if carry {
+			result -= 0x60
+		}
+	} else {
+		if f&HFlag != 0 || result&0x0f > 0x09 {
+			result += 0x06
+		}
+		if carry || result > 0x9f {
+			result += 0x60
+		}
+	}
+
+	flags := f & NFlag
+	if result&0x100 != 0 || carry {
+		flags |= CFlag
+	}
+	if result&0xff == 0 {
+		flags |= ZFlag
+	}
+	return (uint8)(result & 0xff), flags
+}
+
+func TestDAAAllInputs(t *testing.T) {
+	c := New()
+	for a := 0; a < 0x100; a++ {
+		for f := 0; f < 0x100; f += 0x10 {
+			c.regs.A, c.regs.F = (uint8)(a), (uint8)(f)
+			c.daa()
+
+			wantA, wantF := daaReference((uint8)(a), (uint8)(f))
+			if c.regs.A != wantA || c.regs.F != wantF {
+				t.Errorf("daa(A=0x%02x, F=0x%02x) = (A=0x%02x, F=0x%02x), want (A=0x%02x, F=0x%02x)",
+					a, f, c.regs.A, c.regs.F, wantA, wantF)
+			}
+		}
+	}
+}
+
+func toBCD(n int) uint8 {
+	return (uint8)((n/10)<<4 | n%10)
+}
+
+func TestDAAAfterBCDArithmetic(t *testing.T) {
+	c := New()
+	for x := 0; x < 100; x++ {
+		for y := 0; y < 100; y++ {
+			for carry := 0; carry < 2; carry++ {
+				c.regs.SetFlag(CFlag, carry == 1)
+				c.regs.A = c.adc8(toBCD(x), toBCD(y))
+				c.daa()
+
+				sum := x + y + carry
+				if c.regs.A != toBCD(sum%100) || (c.regs.Flag(CFlag) != 0) != (sum >= 100) {
+					t.Errorf("%d + %d + %d: A=0x%02x C=%t", x, y, carry, c.regs.A, c.regs.Flag(CFlag) != 0)
+				}
+
+				c.regs.SetFlag(CFlag, carry == 1)
+				c.regs.A = c.sbc8(toBCD(x), toBCD(y))
+				c.daa()
+
+				diff := x - y - carry
+				borrow := diff < 0
+				if borrow {
+					diff += 100
+				}
+				if c.regs.A != toBCD(diff) || (c.regs.Flag(CFlag) != 0) != borrow {
+					t.Errorf("%d - %d - %d: A=0x%02x C=%t", x, y, carry, c.regs.A, c.regs.Flag(CFlag) != 0)
+				}
+			}
+		}
+	}
+}
+
+func TestCarryInArithmetic(t *testing.T) {
+	tests := []struct {
+		name  string
+		op    func(c *CPU, a uint8, b uint8) uint8
+		a     uint8
+		b     uint8
+		f     uint8
+		want  uint8
+		wantF uint8
+	}{
+		{"adc half carry from carry-in", (*CPU).adc8, 0x0f, 0x00, CFlag, 0x10, HFlag},
+		{"adc carry from carry-in", (*CPU).adc8, 0xff, 0x00, CFlag, 0x00, ZFlag | HFlag | CFlag},
+		{"adc without carry-in", (*CPU).adc8, 0x0f, 0x00, 0, 0x0f, 0},
+		{"adc both carries", (*CPU).adc8, 0x8f, 0x8f, CFlag, 0x1f, HFlag | CFlag},
+		{"sbc half borrow from carry-in", (*CPU).sbc8, 0x10, 0x00, CFlag, 0x0f, NFlag | HFlag},
+		{"sbc borrow from carry-in", (*CPU).sbc8, 0x00, 0x00, CFlag, 0xff, NFlag | HFlag | CFlag},
+		{"sbc operand 0xff with carry-in", (*CPU).sbc8, 0x00, 0xff, CFlag, 0x00, ZFlag | NFlag | HFlag | CFlag},
+		{"sbc without carry-in", (*CPU).sbc8, 0x10, 0x10, 0, 0x00, ZFlag | NFlag},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New()
+			c.regs.F = tt.f
+
+			got := tt.op(c, tt.a, tt.b)
+			if got != tt.want || c.regs.F != tt.wantF {
+				t.Errorf("got (0x%02x, F=0x%02x), want (0x%02x, F=0x%02x)", got, c.regs.F, tt.want, tt.wantF)
+			}
+		})
+	}
+}
+
+func TestAdd16(t *testing.T) {
+	tests := []struct {
+		a     uint16
+		b     uint16
+		f     uint8
+		want  uint16
+		wantF uint8
+	}{
+		{0x0fff, 0x0001, 0, 0x1000, HFlag},
+		{0xffff, 0x0001, 0, 0x0000, HFlag | CFlag},
+		{0x00ff, 0x0001, NFlag, 0x0100, 0},
+		{0x1234, 0x1111, ZFlag, 0x2345, ZFlag},
+	}
+
+	for _, tt := range tests {
+		c := New()
+		c.regs.F = tt.f
+
+		got := c.add16(tt.a, tt.b)
+		if got != tt.want || c.regs.F != tt.wantF {
+			t.Errorf("add16(0x%04x, 0x%04x) = (0x%04x, F=0x%02x), want (0x%04x, F=0x%02x)",
+				tt.a, tt.b, got, c.regs.F, tt.want, tt.wantF)
+		}
+	}
+}
+
+func TestAddSP(t *testing.T) {
+	tests := []struct {
+		sp     uint16
+		offset uint8
+		want   uint16
+		wantF  uint8
+	}{
+		{0x000f, 0x01, 0x0010, HFlag},
+		{0x00ff, 0x01, 0x0100, HFlag | CFlag},
+		{0x0100, 0xff, 0x00ff, 0},
+		{0xffff, 0xff, 0xfffe, HFlag | CFlag},
+		{0xfff8, 0x08, 0x0000, HFlag | CFlag},
+	}
+
+	for _, tt := range tests {
+		c := New()
+		c.regs.SP = tt.sp
+		c.regs.F = ZFlag | NFlag
+
+		got := c.addSP(tt.offset)
+		if got != tt.want || c.regs.F != tt.wantF {
+			t.Errorf("addSP(SP=0x%04x, 0x%02x) = (0x%04x, F=0x%02x), want (0x%04x, F=0x%02x)",
+				tt.sp, tt.offset, got, c.regs.F, tt.want, tt.wantF)
+		}
+	}
+}
+
+func TestInterruptPriority(t *testing.T) {
+	c, m := newTestCPU(t, 0x00)
+	c.regs.SP = 0xe000
+	c.ime = true
+	c.ie = IntVBlank | IntTimer
+	c._if = IntTimer | IntVBlank
+
+	cycles := c.Step()
+	if cycles != 20 {
+		t.Errorf("cycles = %d, want 20", cycles)
+	}
+	if c.regs.PC != 0x40 {
+		t.Errorf("PC = 0x%04x, want 0x0040", c.regs.PC)
+	}
+	if c._if != IntTimer {
+		t.Errorf("IF = 0x%02x, want only the timer interrupt pending", c._if)
+	}
+	if c.ime {
+		t.Errorf("IME should be disabled in ISR")
+	}
+	if m.Read16(0xdffe) != 0x100 {
+		t.Errorf("return address = 0x%04x, want 0x0100", m.Read16(0xdffe))
+	}
+}
+
+func TestEIDelay(t *testing.T) {
+	// ei; nop; nop
+	c, _ := newTestCPU(t, 0xfb, 0x00, 0x00)
+	c.regs.SP = 0xe000
+	c.ie = IntVBlank
+	c._if = IntVBlank
+
+	c.Step()
+	if c.regs.PC != 0x101 || c.ime {
+		t.Fatalf("interrupt must not be enabled right after EI")
+	}
+	c.Step()
+	if c.regs.PC != 0x102 || !c.ime {
+		t.Fatalf("the instruction after EI must be executed before the interrupt")
+	}
+	c.Step()
+	if c.regs.PC != 0x40 {
+		t.Errorf("PC = 0x%04x, want 0x0040", c.regs.PC)
+	}
+}
+
+func TestEIFollowedByDI(t *testing.T) {
+	// ei; di; nop
+	c, _ := newTestCPU(t, 0xfb, 0xf3, 0x00)
+	c.ie = IntVBlank
+	c._if = IntVBlank
+
+	c.Step()
+	c.Step()
+	c.Step()
+	if c.ime || c.regs.PC != 0x103 {
+		t.Errorf("DI right after EI must keep interrupts disabled")
+	}
+}
+
+func TestHaltWakeUpWithoutIME(t *testing.T) {
+	// halt; nop
+	c, _ := newTestCPU(t, 0x76, 0x00)
+	c.ie = IntTimer
+
+	c.Step()
+	c.Step()
+	if !c.halt || c.regs.PC != 0x101 {
+		t.Fatalf("CPU should stay halted while no interrupt is pending")
+	}
+
+	c._if = IntTimer
+	c.Step()
+	if c.halt {
+		t.Errorf("pending interrupt should wake the CPU up")
+	}
+	if c.regs.PC != 0x102 {
+		t.Errorf("PC = 0x%04x, want 0x0102 (execution continues without ISR)", c.regs.PC)
+	}
+	if c._if != IntTimer {
+		t.Errorf("IF should be left untouched when IME is disabled")
+	}
+}
+
+func TestHaltBug(t *testing.T) {
+	// halt; inc A
+	c, _ := newTestCPU(t, 0x76, 0x3c)
+	c.ie = IntTimer
+	c._if = IntTimer
+
+	c.Step()
+	if c.halt {
+		t.Fatalf("HALT should exit immediately")
+	}
+	c.Step()
+	c.Step()
+	if c.regs.A != 2 || c.regs.PC != 0x102 {
+		t.Errorf("A = %d, PC = 0x%04x, want A = 2, PC = 0x0102", c.regs.A, c.regs.PC)
+	}
+}
+
+func TestHaltBugWithInterrupt(t *testing.T) {
+	// ei; halt
+	c, m := newTestCPU(t, 0xfb, 0x76)
+	// inc A; reti
+	copy(m.data[0x40:], []uint8{0x3c, 0xd9})
+	c.regs.SP = 0xfffe
+	c.ie = IntVBlank
+	c._if = IntVBlank
+
+	c.Step()
+	c.Step()
+	c.Step()
+	c.Step()
+	if c.regs.A != 1 {
+		t.Errorf("A = %d, want 1 (ISR opcode must not be fetched twice)", c.regs.A)
+	}
+	if got := uint16(m.data[c.regs.SP+1])<<8 | uint16(m.data[c.regs.SP]); got != 0x101 {
+		t.Errorf("return address = 0x%04x, want 0x0101 (HALT)", got)
+	}
+	c.Step()
+	if c.regs.PC != 0x101 {
+		t.Errorf("PC = 0x%04x, want 0x0101 after RETI", c.regs.PC)
+	}
+}
+
+func TestIFUnusedBits(t *testing.T) {
+	c, _ := newTestCPU(t)
+	c.Write8(0xff0f, 0xff)
+	if c._if != 0x1f {
+		t.Errorf("IF = 0x%02x, want 0x1f", c._if)
+	}
+	c.Write8(0xff0f, 0x01)
+	if got := c.Read8(0xff0f); got != 0xe1 {
+		t.Errorf("IF reads 0x%02x, want 0xe1", got)
+	}
+}
+
+func TestStopSpeedSwitch(t *testing.T) {
+	// stop; nop
+	c, _ := newTestCPU(t, 0x10, 0x00, 0x00)
+	c.EnableCGBMode()
+
+	if got := c.Read8(0xff4d); got != 0x7e {
+		t.Errorf("KEY1 = 0x%02x, want 0x7e", got)
+	}
+	c.Write8(0xff4d, 0x01)
+	if got := c.Read8(0xff4d); got != 0x7f {
+		t.Errorf("KEY1 = 0x%02x, want 0x7f", got)
+	}
+
+	c.Step()
+	if !c.DoubleSpeed() || c.stop {
+		t.Fatalf("STOP should switch to double speed without stopping the CPU")
+	}
+	if got := c.Read8(0xff4d); got != 0xfe {
+		t.Errorf("KEY1 = 0x%02x, want 0xfe", got)
+	}
+	if c.regs.PC != 0x102 {
+		t.Errorf("PC = 0x%04x, want 0x0102", c.regs.PC)
+	}
+
+	// The CPU pauses before executing the next instruction
+	if cycles := c.Step(); cycles != SpeedSwitchCycles || c.regs.PC != 0x102 {
+		t.Errorf("CPU should pause %d cycles after the speed switch, got %d", SpeedSwitchCycles, cycles)
+	}
+	if c.Step(); c.regs.PC != 0x103 {
+		t.Errorf("CPU should resume after the speed switch")
+	}
+}
+
+func TestStopLowPowerMode(t *testing.T) {
+	// stop; inc A
+	c, _ := newTestCPU(t, 0x10, 0x00, 0x3c)
+
+	if got := c.Read8(0xff4d); got != 0xff {
+		t.Errorf("KEY1 = 0x%02x, want 0xff on DMG", got)
+	}
+	c.Write8(0xff4d, 0x01)
+
+	c.Step()
+	c.Step()
+	if !c.stop || c.DoubleSpeed() || c.regs.A != 0 {
+		t.Fatalf("CPU should be stopped in normal speed")
+	}
+
+	c._if = IntJoypad
+	c.Step()
+	if c.stop || c.regs.A != 1 {
+		t.Errorf("joypad input should bring the CPU back from STOP mode")
+	}
+
+	// A joypad input left over from before STOP is ignored
+	c, _ = newTestCPU(t, 0x10, 0x00, 0x3c)
+	c._if = IntJoypad
+	c.Step()
+	c.Step()
+	if !c.stop || c.regs.A != 0 {
+		t.Errorf("stale joypad input should not bring the CPU back from STOP mode")
+	}
+
+	// With the joypad interrupt enabled, the ISR runs right after a press
+	c, m := newTestCPU(t, 0x10, 0x00, 0x00)
+	m.data[0x60] = 0x3c // inc A
+	c.regs.SP = 0xfffe
+	c.ime = true
+	c.ie = IntJoypad
+	c.Step()
+	c.Step()
+	if !c.stop {
+		t.Fatalf("CPU should be stopped")
+	}
+	c._if = IntJoypad
+	c.Step()
+	c.Step()
+	if c.stop || c.regs.A != 1 || c.regs.PC != 0x61 {
+		t.Errorf("A = %d, PC = 0x%04x, want the joypad ISR to run after a press", c.regs.A, c.regs.PC)
+	}
+}
+
+func TestTickMatchesCycles(t *testing.T) {
+	for opcode := range newInstructionSet() {
+		program := []uint8{(uint8)(opcode)}
+		if opcode > 0xff {
+			program = []uint8{0xcb, (uint8)(opcode & 0xff)}
+		}
+
+		c, _ := newTestCPU(t, program...)
+		c.regs.SP = 0xe000
+		ticked := 0
+		c.SetTick(func(cycles int) { ticked += cycles })
+
+		cycles := c.Step()
+		if ticked != cycles {
+			t.Errorf("0x%04x: ticked %d cycles, want %d", opcode, ticked, cycles)
+		}
+	}
+}
+
+func TestCycleAccurateAccessTiming(t *testing.T) {
+	tests := []struct {
+		name    string
+		program []uint8
+		setup   func(c *CPU)
+		want    map[uint16]int // Elapsed cycles when each address is written
+	}{
+		{
+			name:    "push BC",
+			program: []uint8{0xc5},
+			want:    map[uint16]int{0xdfff: 12, 0xdffe: 16},
+		},
+		{
+			name:    "ld (a16), A",
+			program: []uint8{0xea, 0x00, 0xc0},
+			want:    map[uint16]int{0xc000: 16},
+		},
+		{
+			name:    "ld (a16), SP",
+			program: []uint8{0x08, 0x00, 0xc0},
+			want:    map[uint16]int{0xc000: 16, 0xc001: 20},
+		},
+		{
+			name:    "call a16",
+			program: []uint8{0xcd, 0x00, 0x20},
+			want:    map[uint16]int{0xdfff: 20, 0xdffe: 24},
+		},
+		{
+			name:    "inc (HL)",
+			program: []uint8{0x34},
+			setup:   func(c *CPU) { c.regs.SetHL(0xc000) },
+			want:    map[uint16]int{0xc000: 12},
+		},
+		{
+			name:    "interrupt dispatch",
+			program: []uint8{0x00},
+			setup: func(c *CPU) {
+				c.ime = true
+				c.ie = IntVBlank
+				c._if = IntVBlank
+			},
+			want: map[uint16]int{0xdfff: 12, 0xdffe: 16},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, m := newTestCPU(t, tt.program...)
+			c.regs.SP = 0xe000
+			if tt.setup != nil {
+				tt.setup(c)
+			}
+
+			elapsed := 0
+			c.SetTick(func(cycles int) { elapsed += cycles })
+			got := map[uint16]int{}
+			m.onWrite = func(address uint16) { got[address] = elapsed }
+
+			c.Step()
+			for address, want := range tt.want {
+				if got[address] != want {
+					t.Errorf("0x%04x written at %d cycles, want %d", address, got[address], want)
+				}
+			}
+		})
+	}
+}
+
+func TestAccessCheck(t *testing.T) {
+	// ld a,(0xc000); ld (0xc001),a
+	c, m := newTestCPU(t, 0xfa, 0x00, 0xc0, 0xea, 0x01, 0xc0)
+	m.data[0xc000] = 0x42
+	c.SetAccessCheck(func(address uint16) bool {
+		return address < 0xc000
+	})
+
+	c.Step()
+	if c.regs.A != 0xff {
+		t.Errorf("A = 0x%02x, want 0xff", c.regs.A)
+	}
+	c.Step()
+	if m.data[0xc001] != 0 {
+		t.Errorf("write to an inaccessible address should be ignored")
+	}
+}
+
+func TestStall(t *testing.T) {
+	// inc a
+	c, _ := newTestCPU(t, 0x3c)
+	c.Stall(32)
+	c.Stall(32)
+
+	if cycles := c.Step(); cycles != 64 || c.regs.A != 0 {
+		t.Errorf("stalled CPU should spend 64 cycles without executing, got %d", cycles)
+	}
+	if cycles := c.Step(); cycles != 4 || c.regs.A != 1 {
+		t.Errorf("CPU should resume after the stall")
+	}
+}
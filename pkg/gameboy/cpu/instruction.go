@@ -1,5 +1,7 @@
 package cpu
 
+import "fmt"
+
 type instruction struct {
 	mnemonic string
 	handler  func(cpu *CPU) int
@@ -13,7 +15,7 @@ func newInstruction(mnemonic string, handler func(cpu *CPU) int) instruction {
 }
 
 func newInstructionSet() map[uint16]instruction {
-	return map[uint16]instruction{
+	set := map[uint16]instruction{
 		0x00: newInstruction("nop", func(cpu *CPU) int {
 			return 4
 		}),
@@ -21,6 +23,14 @@ func newInstructionSet() map[uint16]instruction {
 			cpu.regs.SetBC(cpu.operand16())
 			return 12
 		}),
+		0x02: newInstruction("ld (BC), A", func(cpu *CPU) int {
+			cpu.write8(cpu.regs.BC(), cpu.regs.A)
+			return 8
+		}),
+		0x03: newInstruction("inc BC", func(cpu *CPU) int {
+			cpu.regs.SetBC(cpu.regs.BC() + 1)
+			return 8
+		}),
 		0x04: newInstruction("inc B", func(cpu *CPU) int {
 			cpu.regs.B = cpu.add8(cpu.regs.B, 1, false)
 			return 4
@@ -33,6 +43,23 @@ func newInstructionSet() map[uint16]instruction {
 			cpu.regs.B = cpu.operand8()
 			return 8
 		}),
+		0x07: newInstruction("rlca", func(cpu *CPU) int {
+			cpu.regs.A = cpu.rlc8(cpu.regs.A)
+			cpu.regs.SetFlag(ZFlag, false)
+			return 4
+		}),
+		0x08: newInstruction("ld (a16), SP", func(cpu *CPU) int {
+			cpu.write16(cpu.operand16(), cpu.regs.SP)
+			return 20
+		}),
+		0x09: newInstruction("add HL, BC", func(cpu *CPU) int {
+			cpu.regs.SetHL(cpu.add16(cpu.regs.HL(), cpu.regs.BC()))
+			return 8
+		}),
+		0x0a: newInstruction("ld A, (BC)", func(cpu *CPU) int {
+			cpu.regs.A = cpu.read8(cpu.regs.BC())
+			return 8
+		}),
 		0x0b: newInstruction("dec BC", func(cpu *CPU) int {
 			cpu.regs.SetBC(cpu.regs.BC() - 1)
 			return 8
@@ -47,14 +74,24 @@ func newInstructionSet() map[uint16]instruction {
 		}),
 		0x0e: newInstruction("ld C, d8", func(cpu *CPU) int {
 			cpu.regs.C = cpu.operand8()
-			return 12
+			return 8
+		}),
+		0x0f: newInstruction("rrca", func(cpu *CPU) int {
+			cpu.regs.A = cpu.rrc8(cpu.regs.A)
+			cpu.regs.SetFlag(ZFlag, false)
+			return 4
+		}),
+		0x10: newInstruction("stop", func(cpu *CPU) int {
+			// STOP is followed by a padding byte which is skipped without being read
+			cpu.regs.PC++
+			return cpu.stopCPU()
 		}),
 		0x11: newInstruction("ld DE, d16", func(cpu *CPU) int {
 			cpu.regs.SetDE(cpu.operand16())
 			return 12
 		}),
 		0x12: newInstruction("ld (DE), A", func(cpu *CPU) int {
-			cpu.bus.Write8(cpu.regs.DE(), cpu.regs.A)
+			cpu.write8(cpu.regs.DE(), cpu.regs.A)
 			return 8
 		}),
 		0x13: newInstruction("inc DE", func(cpu *CPU) int {
@@ -63,236 +100,1037 @@ func newInstructionSet() map[uint16]instruction {
 		}),
 		0x14: newInstruction("inc D", func(cpu *CPU) int {
 			cpu.regs.D = cpu.add8(cpu.regs.D, 1, false)
-			return 1
+			return 4
+		}),
+		0x15: newInstruction("dec D", func(cpu *CPU) int {
+			cpu.regs.D = cpu.sub8(cpu.regs.D, 1, false)
+			return 4
+		}),
+		0x16: newInstruction("ld D, d8", func(cpu *CPU) int {
+			cpu.regs.D = cpu.operand8()
+			return 8
+		}),
+		0x17: newInstruction("rla", func(cpu *CPU) int {
+			cpu.regs.A = cpu.rl8(cpu.regs.A)
+			cpu.regs.SetFlag(ZFlag, false)
+			return 4
 		}),
 		0x18: newInstruction("jr r8", func(cpu *CPU) int {
-			cpu.regs.PC += signExtU8ToU16(cpu.operand8())
-			return 12
+			return cpu.jr(true)
+		}),
+		0x19: newInstruction("add HL, DE", func(cpu *CPU) int {
+			cpu.regs.SetHL(cpu.add16(cpu.regs.HL(), cpu.regs.DE()))
+			return 8
 		}),
 		0x1a: newInstruction("ld A, (DE)", func(cpu *CPU) int {
-			cpu.regs.A = cpu.bus.Read8(cpu.regs.DE())
+			cpu.regs.A = cpu.read8(cpu.regs.DE())
+			return 8
+		}),
+		0x1b: newInstruction("dec DE", func(cpu *CPU) int {
+			cpu.regs.SetDE(cpu.regs.DE() - 1)
+			return 8
+		}),
+		0x1c: newInstruction("inc E", func(cpu *CPU) int {
+			cpu.regs.E = cpu.add8(cpu.regs.E, 1, false)
+			return 4
+		}),
+		0x1d: newInstruction("dec E", func(cpu *CPU) int {
+			cpu.regs.E = cpu.sub8(cpu.regs.E, 1, false)
+			return 4
+		}),
+		0x1e: newInstruction("ld E, d8", func(cpu *CPU) int {
+			cpu.regs.E = cpu.operand8()
 			return 8
 		}),
-		0x20: newInstruction("jr nz, r8", func(cpu *CPU) int {
-			data := cpu.operand8()
-			if cpu.regs.Flag(ZFlag) != 0 {
-				return 8
-			}
-			cpu.regs.PC += signExtU8ToU16(data)
-			return 12
+		0x1f: newInstruction("rra", func(cpu *CPU) int {
+			cpu.regs.A = cpu.rr8(cpu.regs.A)
+			cpu.regs.SetFlag(ZFlag, false)
+			return 4
+		}),
+		0x20: newInstruction("jr NZ, r8", func(cpu *CPU) int {
+			return cpu.jr(cpu.regs.Flag(ZFlag) == 0)
+		}),
+		0x21: newInstruction("ld HL, d16", func(cpu *CPU) int {
+			cpu.regs.SetHL(cpu.operand16())
+			return 12
+		}),
+		0x22: newInstruction("ld (HL+), A", func(cpu *CPU) int {
+			cpu.write8(cpu.regs.HL(), cpu.regs.A)
+			cpu.regs.SetHL(cpu.regs.HL() + 1)
+			return 8
+		}),
+		0x23: newInstruction("inc HL", func(cpu *CPU) int {
+			cpu.regs.SetHL(cpu.regs.HL() + 1)
+			return 8
+		}),
+		0x24: newInstruction("inc H", func(cpu *CPU) int {
+			cpu.regs.H = cpu.add8(cpu.regs.H, 1, false)
+			return 4
+		}),
+		0x25: newInstruction("dec H", func(cpu *CPU) int {
+			cpu.regs.H = cpu.sub8(cpu.regs.H, 1, false)
+			return 4
+		}),
+		0x26: newInstruction("ld H, d8", func(cpu *CPU) int {
+			cpu.regs.H = cpu.operand8()
+			return 8
+		}),
+		0x27: newInstruction("daa", func(cpu *CPU) int {
+			cpu.daa()
+			return 4
+		}),
+		0x28: newInstruction("jr Z, r8", func(cpu *CPU) int {
+			return cpu.jr(cpu.regs.Flag(ZFlag) != 0)
+		}),
+		0x29: newInstruction("add HL, HL", func(cpu *CPU) int {
+			cpu.regs.SetHL(cpu.add16(cpu.regs.HL(), cpu.regs.HL()))
+			return 8
+		}),
+		0x2a: newInstruction("ld A, (HL+)", func(cpu *CPU) int {
+			cpu.regs.A = cpu.read8(cpu.regs.HL())
+			cpu.regs.SetHL(cpu.regs.HL() + 1)
+			return 8
+		}),
+		0x2b: newInstruction("dec HL", func(cpu *CPU) int {
+			cpu.regs.SetHL(cpu.regs.HL() - 1)
+			return 8
+		}),
+		0x2c: newInstruction("inc L", func(cpu *CPU) int {
+			cpu.regs.L = cpu.add8(cpu.regs.L, 1, false)
+			return 4
+		}),
+		0x2d: newInstruction("dec L", func(cpu *CPU) int {
+			cpu.regs.L = cpu.sub8(cpu.regs.L, 1, false)
+			return 4
+		}),
+		0x2e: newInstruction("ld L, d8", func(cpu *CPU) int {
+			cpu.regs.L = cpu.operand8()
+			return 8
+		}),
+		0x2f: newInstruction("cpl", func(cpu *CPU) int {
+			cpu.regs.A = ^cpu.regs.A
+			cpu.regs.SetFlag(NFlag, true)
+			cpu.regs.SetFlag(HFlag, true)
+			return 4
+		}),
+		0x30: newInstruction("jr NC, r8", func(cpu *CPU) int {
+			return cpu.jr(cpu.regs.Flag(CFlag) == 0)
+		}),
+		0x31: newInstruction("ld SP, d16", func(cpu *CPU) int {
+			cpu.regs.SP = cpu.operand16()
+			return 12
+		}),
+		0x32: newInstruction("ld (HL-), A", func(cpu *CPU) int {
+			cpu.write8(cpu.regs.HL(), cpu.regs.A)
+			cpu.regs.SetHL(cpu.regs.HL() - 1)
+			return 8
+		}),
+		0x33: newInstruction("inc SP", func(cpu *CPU) int {
+			cpu.regs.SP = cpu.regs.SP + 1
+			return 8
+		}),
+		0x34: newInstruction("inc (HL)", func(cpu *CPU) int {
+			value := cpu.add8(cpu.read8(cpu.regs.HL()), 1, false)
+			cpu.write8(cpu.regs.HL(), value)
+			return 12
+		}),
+		0x35: newInstruction("dec (HL)", func(cpu *CPU) int {
+			value := cpu.sub8(cpu.read8(cpu.regs.HL()), 1, false)
+			cpu.write8(cpu.regs.HL(), value)
+			return 12
+		}),
+		0x36: newInstruction("ld (HL), d8", func(cpu *CPU) int {
+			cpu.write8(cpu.regs.HL(), cpu.operand8())
+			return 12
+		}),
+		0x37: newInstruction("scf", func(cpu *CPU) int {
+			cpu.regs.SetFlag(NFlag, false)
+			cpu.regs.SetFlag(HFlag, false)
+			cpu.regs.SetFlag(CFlag, true)
+			return 4
+		}),
+		0x38: newInstruction("jr C, r8", func(cpu *CPU) int {
+			return cpu.jr(cpu.regs.Flag(CFlag) != 0)
+		}),
+		0x39: newInstruction("add HL, SP", func(cpu *CPU) int {
+			cpu.regs.SetHL(cpu.add16(cpu.regs.HL(), cpu.regs.SP))
+			return 8
+		}),
+		0x3a: newInstruction("ld A, (HL-)", func(cpu *CPU) int {
+			cpu.regs.A = cpu.read8(cpu.regs.HL())
+			cpu.regs.SetHL(cpu.regs.HL() - 1)
+			return 8
+		}),
+		0x3b: newInstruction("dec SP", func(cpu *CPU) int {
+			cpu.regs.SP = cpu.regs.SP - 1
+			return 8
+		}),
+		0x3c: newInstruction("inc A", func(cpu *CPU) int {
+			cpu.regs.A = cpu.add8(cpu.regs.A, 1, false)
+			return 4
+		}),
+		0x3d: newInstruction("dec A", func(cpu *CPU) int {
+			cpu.regs.A = cpu.sub8(cpu.regs.A, 1, false)
+			return 4
+		}),
+		0x3e: newInstruction("ld A, d8", func(cpu *CPU) int {
+			cpu.regs.A = cpu.operand8()
+			return 8
+		}),
+		0x3f: newInstruction("ccf", func(cpu *CPU) int {
+			cpu.regs.SetFlag(NFlag, false)
+			cpu.regs.SetFlag(HFlag, false)
+			cpu.regs.SetFlag(CFlag, cpu.regs.Flag(CFlag) == 0)
+			return 4
+		}),
+		0x40: newInstruction("ld B, B", func(cpu *CPU) int {
+			return 4
+		}),
+		0x41: newInstruction("ld B, C", func(cpu *CPU) int {
+			cpu.regs.B = cpu.regs.C
+			return 4
+		}),
+		0x42: newInstruction("ld B, D", func(cpu *CPU) int {
+			cpu.regs.B = cpu.regs.D
+			return 4
+		}),
+		0x43: newInstruction("ld B, E", func(cpu *CPU) int {
+			cpu.regs.B = cpu.regs.E
+			return 4
+		}),
+		0x44: newInstruction("ld B, H", func(cpu *CPU) int {
+			cpu.regs.B = cpu.regs.H
+			return 4
+		}),
+		0x45: newInstruction("ld B, L", func(cpu *CPU) int {
+			cpu.regs.B = cpu.regs.L
+			return 4
+		}),
+		0x46: newInstruction("ld B, (HL)", func(cpu *CPU) int {
+			cpu.regs.B = cpu.read8(cpu.regs.HL())
+			return 8
+		}),
+		0x47: newInstruction("ld B, A", func(cpu *CPU) int {
+			cpu.regs.B = cpu.regs.A
+			return 4
+		}),
+		0x48: newInstruction("ld C, B", func(cpu *CPU) int {
+			cpu.regs.C = cpu.regs.B
+			return 4
+		}),
+		0x49: newInstruction("ld C, C", func(cpu *CPU) int {
+			return 4
+		}),
+		0x4a: newInstruction("ld C, D", func(cpu *CPU) int {
+			cpu.regs.C = cpu.regs.D
+			return 4
+		}),
+		0x4b: newInstruction("ld C, E", func(cpu *CPU) int {
+			cpu.regs.C = cpu.regs.E
+			return 4
+		}),
+		0x4c: newInstruction("ld C, H", func(cpu *CPU) int {
+			cpu.regs.C = cpu.regs.H
+			return 4
+		}),
+		0x4d: newInstruction("ld C, L", func(cpu *CPU) int {
+			cpu.regs.C = cpu.regs.L
+			return 4
+		}),
+		0x4e: newInstruction("ld C, (HL)", func(cpu *CPU) int {
+			cpu.regs.C = cpu.read8(cpu.regs.HL())
+			return 8
+		}),
+		0x4f: newInstruction("ld C, A", func(cpu *CPU) int {
+			cpu.regs.C = cpu.regs.A
+			return 4
+		}),
+		0x50: newInstruction("ld D, B", func(cpu *CPU) int {
+			cpu.regs.D = cpu.regs.B
+			return 4
+		}),
+		0x51: newInstruction("ld D, C", func(cpu *CPU) int {
+			cpu.regs.D = cpu.regs.C
+			return 4
+		}),
+		0x52: newInstruction("ld D, D", func(cpu *CPU) int {
+			return 4
+		}),
+		0x53: newInstruction("ld D, E", func(cpu *CPU) int {
+			cpu.regs.D = cpu.regs.E
+			return 4
+		}),
+		0x54: newInstruction("ld D, H", func(cpu *CPU) int {
+			cpu.regs.D = cpu.regs.H
+			return 4
+		}),
+		0x55: newInstruction("ld D, L", func(cpu *CPU) int {
+			cpu.regs.D = cpu.regs.L
+			return 4
+		}),
+		0x56: newInstruction("ld D, (HL)", func(cpu *CPU) int {
+			cpu.regs.D = cpu.read8(cpu.regs.HL())
+			return 8
+		}),
+		0x57: newInstruction("ld D, A", func(cpu *CPU) int {
+			cpu.regs.D = cpu.regs.A
+			return 4
+		}),
+		0x58: newInstruction("ld E, B", func(cpu *CPU) int {
+			cpu.regs.E = cpu.regs.B
+			return 4
+		}),
+		0x59: newInstruction("ld E, C", func(cpu *CPU) int {
+			cpu.regs.E = cpu.regs.C
+			return 4
+		}),
+		0x5a: newInstruction("ld E, D", func(cpu *CPU) int {
+			cpu.regs.E = cpu.regs.D
+			return 4
+		}),
+		0x5b: newInstruction("ld E, E", func(cpu *CPU) int {
+			return 4
+		}),
+		0x5c: newInstruction("ld E, H", func(cpu *CPU) int {
+			cpu.regs.E = cpu.regs.H
+			return 4
+		}),
+		0x5d: newInstruction("ld E, L", func(cpu *CPU) int {
+			cpu.regs.E = cpu.regs.L
+			return 4
+		}),
+		0x5e: newInstruction("ld E, (HL)", func(cpu *CPU) int {
+			cpu.regs.E = cpu.read8(cpu.regs.HL())
+			return 8
+		}),
+		0x5f: newInstruction("ld E, A", func(cpu *CPU) int {
+			cpu.regs.E = cpu.regs.A
+			return 4
+		}),
+		0x60: newInstruction("ld H, B", func(cpu *CPU) int {
+			cpu.regs.H = cpu.regs.B
+			return 4
+		}),
+		0x61: newInstruction("ld H, C", func(cpu *CPU) int {
+			cpu.regs.H = cpu.regs.C
+			return 4
+		}),
+		0x62: newInstruction("ld H, D", func(cpu *CPU) int {
+			cpu.regs.H = cpu.regs.D
+			return 4
+		}),
+		0x63: newInstruction("ld H, E", func(cpu *CPU) int {
+			cpu.regs.H = cpu.regs.E
+			return 4
+		}),
+		0x64: newInstruction("ld H, H", func(cpu *CPU) int {
+			return 4
+		}),
+		0x65: newInstruction("ld H, L", func(cpu *CPU) int {
+			cpu.regs.H = cpu.regs.L
+			return 4
+		}),
+		0x66: newInstruction("ld H, (HL)", func(cpu *CPU) int {
+			cpu.regs.H = cpu.read8(cpu.regs.HL())
+			return 8
+		}),
+		0x67: newInstruction("ld H, A", func(cpu *CPU) int {
+			cpu.regs.H = cpu.regs.A
+			return 4
+		}),
+		0x68: newInstruction("ld L, B", func(cpu *CPU) int {
+			cpu.regs.L = cpu.regs.B
+			return 4
+		}),
+		0x69: newInstruction("ld L, C", func(cpu *CPU) int {
+			cpu.regs.L = cpu.regs.C
+			return 4
+		}),
+		0x6a: newInstruction("ld L, D", func(cpu *CPU) int {
+			cpu.regs.L = cpu.regs.D
+			return 4
+		}),
+		0x6b: newInstruction("ld L, E", func(cpu *CPU) int {
+			cpu.regs.L = cpu.regs.E
+			return 4
+		}),
+		0x6c: newInstruction("ld L, H", func(cpu *CPU) int {
+			cpu.regs.L = cpu.regs.H
+			return 4
+		}),
+		0x6d: newInstruction("ld L, L", func(cpu *CPU) int {
+			return 4
+		}),
+		0x6e: newInstruction("ld L, (HL)", func(cpu *CPU) int {
+			cpu.regs.L = cpu.read8(cpu.regs.HL())
+			return 8
+		}),
+		0x6f: newInstruction("ld L, A", func(cpu *CPU) int {
+			cpu.regs.L = cpu.regs.A
+			return 4
+		}),
+		0x70: newInstruction("ld (HL), B", func(cpu *CPU) int {
+			cpu.write8(cpu.regs.HL(), cpu.regs.B)
+			return 8
+		}),
+		0x71: newInstruction("ld (HL), C", func(cpu *CPU) int {
+			cpu.write8(cpu.regs.HL(), cpu.regs.C)
+			return 8
+		}),
+		0x72: newInstruction("ld (HL), D", func(cpu *CPU) int {
+			cpu.write8(cpu.regs.HL(), cpu.regs.D)
+			return 8
+		}),
+		0x73: newInstruction("ld (HL), E", func(cpu *CPU) int {
+			cpu.write8(cpu.regs.HL(), cpu.regs.E)
+			return 8
+		}),
+		0x74: newInstruction("ld (HL), H", func(cpu *CPU) int {
+			cpu.write8(cpu.regs.HL(), cpu.regs.H)
+			return 8
+		}),
+		0x75: newInstruction("ld (HL), L", func(cpu *CPU) int {
+			cpu.write8(cpu.regs.HL(), cpu.regs.L)
+			return 8
+		}),
+		0x76: newInstruction("halt", func(cpu *CPU) int {
+			// HALT bug: If IME is disabled and an interrupt is already pending,
+			// HALT exits immediately and the next byte is fetched twice
+			if !cpu.ime && cpu.ie&cpu._if&(1<<intrSentinel-1) != 0 {
+				cpu.haltBug = true
+				return 4
+			}
+			cpu.halt = true
+			return 4
+		}),
+		0x77: newInstruction("ld (HL), A", func(cpu *CPU) int {
+			cpu.write8(cpu.regs.HL(), cpu.regs.A)
+			return 8
+		}),
+		0x78: newInstruction("ld A, B", func(cpu *CPU) int {
+			cpu.regs.A = cpu.regs.B
+			return 4
+		}),
+		0x79: newInstruction("ld A, C", func(cpu *CPU) int {
+			cpu.regs.A = cpu.regs.C
+			return 4
+		}),
+		0x7a: newInstruction("ld A, D", func(cpu *CPU) int {
+			cpu.regs.A = cpu.regs.D
+			return 4
+		}),
+		0x7b: newInstruction("ld A, E", func(cpu *CPU) int {
+			cpu.regs.A = cpu.regs.E
+			return 4
+		}),
+		0x7c: newInstruction("ld A, H", func(cpu *CPU) int {
+			cpu.regs.A = cpu.regs.H
+			return 4
+		}),
+		0x7d: newInstruction("ld A, L", func(cpu *CPU) int {
+			cpu.regs.A = cpu.regs.L
+			return 4
+		}),
+		0x7e: newInstruction("ld A, (HL)", func(cpu *CPU) int {
+			cpu.regs.A = cpu.read8(cpu.regs.HL())
+			return 8
+		}),
+		0x7f: newInstruction("ld A, A", func(cpu *CPU) int {
+			return 4
+		}),
+		0x80: newInstruction("add A, B", func(cpu *CPU) int {
+			cpu.regs.A = cpu.add8(cpu.regs.A, cpu.regs.B, true)
+			return 4
+		}),
+		0x81: newInstruction("add A, C", func(cpu *CPU) int {
+			cpu.regs.A = cpu.add8(cpu.regs.A, cpu.regs.C, true)
+			return 4
+		}),
+		0x82: newInstruction("add A, D", func(cpu *CPU) int {
+			cpu.regs.A = cpu.add8(cpu.regs.A, cpu.regs.D, true)
+			return 4
+		}),
+		0x83: newInstruction("add A, E", func(cpu *CPU) int {
+			cpu.regs.A = cpu.add8(cpu.regs.A, cpu.regs.E, true)
+			return 4
+		}),
+		0x84: newInstruction("add A, H", func(cpu *CPU) int {
+			cpu.regs.A = cpu.add8(cpu.regs.A, cpu.regs.H, true)
+			return 4
+		}),
+		0x85: newInstruction("add A, L", func(cpu *CPU) int {
+			cpu.regs.A = cpu.add8(cpu.regs.A, cpu.regs.L, true)
+			return 4
+		}),
+		0x86: newInstruction("add A, (HL)", func(cpu *CPU) int {
+			cpu.regs.A = cpu.add8(cpu.regs.A, cpu.read8(cpu.regs.HL()), true)
+			return 8
+		}),
+		0x87: newInstruction("add A, A", func(cpu *CPU) int {
+			cpu.regs.A = cpu.add8(cpu.regs.A, cpu.regs.A, true)
+			return 4
+		}),
+		0x88: newInstruction("adc A, B", func(cpu *CPU) int {
+			cpu.regs.A = cpu.adc8(cpu.regs.A, cpu.regs.B)
+			return 4
+		}),
+		0x89: newInstruction("adc A, C", func(cpu *CPU) int {
+			cpu.regs.A = cpu.adc8(cpu.regs.A, cpu.regs.C)
+			return 4
+		}),
+		0x8a: newInstruction("adc A, D", func(cpu *CPU) int {
+			cpu.regs.A = cpu.adc8(cpu.regs.A, cpu.regs.D)
+			return 4
+		}),
+		0x8b: newInstruction("adc A, E", func(cpu *CPU) int {
+			cpu.regs.A = cpu.adc8(cpu.regs.A, cpu.regs.E)
+			return 4
+		}),
+		0x8c: newInstruction("adc A, H", func(cpu *CPU) int {
+			cpu.regs.A = cpu.adc8(cpu.regs.A, cpu.regs.H)
+			return 4
+		}),
+		0x8d: newInstruction("adc A, L", func(cpu *CPU) int {
+			cpu.regs.A = cpu.adc8(cpu.regs.A, cpu.regs.L)
+			return 4
+		}),
+		0x8e: newInstruction("adc A, (HL)", func(cpu *CPU) int {
+			cpu.regs.A = cpu.adc8(cpu.regs.A, cpu.read8(cpu.regs.HL()))
+			return 8
+		}),
+		0x8f: newInstruction("adc A, A", func(cpu *CPU) int {
+			cpu.regs.A = cpu.adc8(cpu.regs.A, cpu.regs.A)
+			return 4
+		}),
+		0x90: newInstruction("sub B", func(cpu *CPU) int {
+			cpu.regs.A = cpu.sub8(cpu.regs.A, cpu.regs.B, true)
+			return 4
+		}),
+		0x91: newInstruction("sub C", func(cpu *CPU) int {
+			cpu.regs.A = cpu.sub8(cpu.regs.A, cpu.regs.C, true)
+			return 4
+		}),
+		0x92: newInstruction("sub D", func(cpu *CPU) int {
+			cpu.regs.A = cpu.sub8(cpu.regs.A, cpu.regs.D, true)
+			return 4
+		}),
+		0x93: newInstruction("sub E", func(cpu *CPU) int {
+			cpu.regs.A = cpu.sub8(cpu.regs.A, cpu.regs.E, true)
+			return 4
+		}),
+		0x94: newInstruction("sub H", func(cpu *CPU) int {
+			cpu.regs.A = cpu.sub8(cpu.regs.A, cpu.regs.H, true)
+			return 4
+		}),
+		0x95: newInstruction("sub L", func(cpu *CPU) int {
+			cpu.regs.A = cpu.sub8(cpu.regs.A, cpu.regs.L, true)
+			return 4
+		}),
+		0x96: newInstruction("sub (HL)", func(cpu *CPU) int {
+			cpu.regs.A = cpu.sub8(cpu.regs.A, cpu.read8(cpu.regs.HL()), true)
+			return 8
+		}),
+		0x97: newInstruction("sub A", func(cpu *CPU) int {
+			cpu.regs.A = cpu.sub8(cpu.regs.A, cpu.regs.A, true)
+			return 4
+		}),
+		0x98: newInstruction("sbc A, B", func(cpu *CPU) int {
+			cpu.regs.A = cpu.sbc8(cpu.regs.A, cpu.regs.B)
+			return 4
+		}),
+		0x99: newInstruction("sbc A, C", func(cpu *CPU) int {
+			cpu.regs.A = cpu.sbc8(cpu.regs.A, cpu.regs.C)
+			return 4
+		}),
+		0x9a: newInstruction("sbc A, D", func(cpu *CPU) int {
+			cpu.regs.A = cpu.sbc8(cpu.regs.A, cpu.regs.D)
+			return 4
+		}),
+		0x9b: newInstruction("sbc A, E", func(cpu *CPU) int {
+			cpu.regs.A = cpu.sbc8(cpu.regs.A, cpu.regs.E)
+			return 4
+		}),
+		0x9c: newInstruction("sbc A, H", func(cpu *CPU) int {
+			cpu.regs.A = cpu.sbc8(cpu.regs.A, cpu.regs.H)
+			return 4
+		}),
+		0x9d: newInstruction("sbc A, L", func(cpu *CPU) int {
+			cpu.regs.A = cpu.sbc8(cpu.regs.A, cpu.regs.L)
+			return 4
+		}),
+		0x9e: newInstruction("sbc A, (HL)", func(cpu *CPU) int {
+			cpu.regs.A = cpu.sbc8(cpu.regs.A, cpu.read8(cpu.regs.HL()))
+			return 8
+		}),
+		0x9f: newInstruction("sbc A, A", func(cpu *CPU) int {
+			cpu.regs.A = cpu.sbc8(cpu.regs.A, cpu.regs.A)
+			return 4
+		}),
+		0xa0: newInstruction("and B", func(cpu *CPU) int {
+			cpu.regs.A = cpu.and8(cpu.regs.A, cpu.regs.B)
+			return 4
+		}),
+		0xa1: newInstruction("and C", func(cpu *CPU) int {
+			cpu.regs.A = cpu.and8(cpu.regs.A, cpu.regs.C)
+			return 4
+		}),
+		0xa2: newInstruction("and D", func(cpu *CPU) int {
+			cpu.regs.A = cpu.and8(cpu.regs.A, cpu.regs.D)
+			return 4
+		}),
+		0xa3: newInstruction("and E", func(cpu *CPU) int {
+			cpu.regs.A = cpu.and8(cpu.regs.A, cpu.regs.E)
+			return 4
+		}),
+		0xa4: newInstruction("and H", func(cpu *CPU) int {
+			cpu.regs.A = cpu.and8(cpu.regs.A, cpu.regs.H)
+			return 4
+		}),
+		0xa5: newInstruction("and L", func(cpu *CPU) int {
+			cpu.regs.A = cpu.and8(cpu.regs.A, cpu.regs.L)
+			return 4
+		}),
+		0xa6: newInstruction("and (HL)", func(cpu *CPU) int {
+			cpu.regs.A = cpu.and8(cpu.regs.A, cpu.read8(cpu.regs.HL()))
+			return 8
+		}),
+		0xa7: newInstruction("and A", func(cpu *CPU) int {
+			cpu.regs.A = cpu.and8(cpu.regs.A, cpu.regs.A)
+			return 4
+		}),
+		0xa8: newInstruction("xor B", func(cpu *CPU) int {
+			cpu.regs.A = cpu.xor8(cpu.regs.A, cpu.regs.B)
+			return 4
+		}),
+		0xa9: newInstruction("xor C", func(cpu *CPU) int {
+			cpu.regs.A = cpu.xor8(cpu.regs.A, cpu.regs.C)
+			return 4
+		}),
+		0xaa: newInstruction("xor D", func(cpu *CPU) int {
+			cpu.regs.A = cpu.xor8(cpu.regs.A, cpu.regs.D)
+			return 4
 		}),
-		0x21: newInstruction("ld HL, d16", func(cpu *CPU) int {
-			cpu.regs.SetHL(cpu.operand16())
-			return 12
+		0xab: newInstruction("xor E", func(cpu *CPU) int {
+			cpu.regs.A = cpu.xor8(cpu.regs.A, cpu.regs.E)
+			return 4
 		}),
-		0x22: newInstruction("ld (HL+), A", func(cpu *CPU) int {
-			cpu.bus.Write8(cpu.regs.HL(), cpu.regs.A)
-			cpu.regs.SetHL(cpu.regs.HL() + 1)
-			return 8
+		0xac: newInstruction("xor H", func(cpu *CPU) int {
+			cpu.regs.A = cpu.xor8(cpu.regs.A, cpu.regs.H)
+			return 4
 		}),
-		0x28: newInstruction("jr Z, r8", func(cpu *CPU) int {
-			data := cpu.operand8()
-			if cpu.regs.Flag(ZFlag) != 0 {
-				cpu.regs.PC += signExtU8ToU16(data)
-				return 12
-			}
-			return 8
+		0xad: newInstruction("xor L", func(cpu *CPU) int {
+			cpu.regs.A = cpu.xor8(cpu.regs.A, cpu.regs.L)
+			return 4
 		}),
-		0x2a: newInstruction("ld A, (HL+)", func(cpu *CPU) int {
-			cpu.regs.A = cpu.bus.Read8(cpu.regs.HL())
-			cpu.regs.SetHL(cpu.regs.HL() + 1)
+		0xae: newInstruction("xor (HL)", func(cpu *CPU) int {
+			cpu.regs.A = cpu.xor8(cpu.regs.A, cpu.read8(cpu.regs.HL()))
 			return 8
 		}),
-		0x2e: newInstruction("ld A, d8", func(cpu *CPU) int {
-			cpu.regs.A = cpu.operand8()
-			return 8
+		0xaf: newInstruction("xor A", func(cpu *CPU) int {
+			cpu.regs.A = cpu.xor8(cpu.regs.A, cpu.regs.A)
+			return 4
 		}),
-		0x30: newInstruction("jr NC, r8", func(cpu *CPU) int {
-			data := cpu.operand8()
-			if cpu.regs.Flag(CFlag) == 0 {
-				cpu.regs.PC += signExtU8ToU16(data)
-				return 12
-			}
-			return 8
+		0xb0: newInstruction("or B", func(cpu *CPU) int {
+			cpu.regs.A = cpu.or8(cpu.regs.A, cpu.regs.B)
+			return 4
 		}),
-		0x31: newInstruction("ld SP, d16", func(cpu *CPU) int {
-			cpu.regs.SP = cpu.operand16()
-			return 12
+		0xb1: newInstruction("or C", func(cpu *CPU) int {
+			cpu.regs.A = cpu.or8(cpu.regs.A, cpu.regs.C)
+			return 4
 		}),
-		0x38: newInstruction("jr C, r8", func(cpu *CPU) int {
-			data := cpu.operand8()
-			if cpu.regs.Flag(CFlag) != 0 {
-				cpu.regs.PC += signExtU8ToU16(data)
-				return 12
-			}
-			return 8
+		0xb2: newInstruction("or D", func(cpu *CPU) int {
+			cpu.regs.A = cpu.or8(cpu.regs.A, cpu.regs.D)
+			return 4
 		}),
-		0x3c: newInstruction("inc A", func(cpu *CPU) int {
-			cpu.regs.A = cpu.add8(cpu.regs.A, 1, false)
+		0xb3: newInstruction("or E", func(cpu *CPU) int {
+			cpu.regs.A = cpu.or8(cpu.regs.A, cpu.regs.E)
 			return 4
 		}),
-		0x3d: newInstruction("dec A", func(cpu *CPU) int {
-			cpu.regs.A = cpu.sub8(cpu.regs.A, 1, false)
+		0xb4: newInstruction("or H", func(cpu *CPU) int {
+			cpu.regs.A = cpu.or8(cpu.regs.A, cpu.regs.H)
 			return 4
 		}),
-		0x3e: newInstruction("ld A, d8", func(cpu *CPU) int {
-			cpu.regs.A = cpu.operand8()
-			return 8
+		0xb5: newInstruction("or L", func(cpu *CPU) int {
+			cpu.regs.A = cpu.or8(cpu.regs.A, cpu.regs.L)
+			return 4
 		}),
-		0x57: newInstruction("ld D, A", func(cpu *CPU) int {
-			cpu.regs.D = cpu.regs.A
+		0xb6: newInstruction("or (HL)", func(cpu *CPU) int {
+			cpu.regs.A = cpu.or8(cpu.regs.A, cpu.read8(cpu.regs.HL()))
 			return 8
 		}),
-		0x5f: newInstruction("ld E, A", func(cpu *CPU) int {
-			cpu.regs.E = cpu.regs.A
-			return 8
+		0xb7: newInstruction("or A", func(cpu *CPU) int {
+			cpu.regs.A = cpu.or8(cpu.regs.A, cpu.regs.A)
+			return 4
 		}),
-		0x76: newInstruction("halt", func(cpu *CPU) int {
-			cpu.halt = true
+		0xb8: newInstruction("cp B", func(cpu *CPU) int {
+			cpu.sub8(cpu.regs.A, cpu.regs.B, true)
 			return 4
 		}),
-		0x78: newInstruction("ld A, B", func(cpu *CPU) int {
-			cpu.regs.A = cpu.regs.B
+		0xb9: newInstruction("cp C", func(cpu *CPU) int {
+			cpu.sub8(cpu.regs.A, cpu.regs.C, true)
 			return 4
 		}),
-		0x7a: newInstruction("ld A, D", func(cpu *CPU) int {
-			cpu.regs.A = cpu.regs.D
+		0xba: newInstruction("cp D", func(cpu *CPU) int {
+			cpu.sub8(cpu.regs.A, cpu.regs.D, true)
 			return 4
 		}),
-		0x7b: newInstruction("ld A, E", func(cpu *CPU) int {
-			cpu.regs.A = cpu.regs.E
+		0xbb: newInstruction("cp E", func(cpu *CPU) int {
+			cpu.sub8(cpu.regs.A, cpu.regs.E, true)
 			return 4
 		}),
-		0xaf: newInstruction("xor A", func(cpu *CPU) int {
-			cpu.regs.A = 0
-			cpu.regs.SetFlag(CFlag, false)
-			cpu.regs.SetFlag(HFlag, false)
-			cpu.regs.SetFlag(NFlag, false)
-			cpu.regs.SetFlag(ZFlag, true)
+		0xbc: newInstruction("cp H", func(cpu *CPU) int {
+			cpu.sub8(cpu.regs.A, cpu.regs.H, true)
 			return 4
 		}),
-		0xa7: newInstruction("and A", func(cpu *CPU) int {
-			cpu.regs.A = cpu.and8(cpu.regs.A, cpu.regs.A)
+		0xbd: newInstruction("cp L", func(cpu *CPU) int {
+			cpu.sub8(cpu.regs.A, cpu.regs.L, true)
 			return 4
 		}),
-		0xb1: newInstruction("or C", func(cpu *CPU) int {
-			cpu.regs.A = cpu.or8(cpu.regs.A, cpu.regs.C)
+		0xbe: newInstruction("cp (HL)", func(cpu *CPU) int {
+			cpu.sub8(cpu.regs.A, cpu.read8(cpu.regs.HL()), true)
+			return 8
+		}),
+		0xbf: newInstruction("cp A", func(cpu *CPU) int {
+			cpu.sub8(cpu.regs.A, cpu.regs.A, true)
 			return 4
 		}),
+		0xc0: newInstruction("ret NZ", func(cpu *CPU) int {
+			// Checking the condition takes an internal cycle
+			cpu.idle()
+			if cpu.regs.Flag(ZFlag) == 0 {
+				return cpu.ret() + 4
+			}
+			return 8
+		}),
+		0xc1: newInstruction("pop BC", func(cpu *CPU) int {
+			cpu.regs.SetBC(cpu.pop16())
+			return 12
+		}),
+		0xc2: newInstruction("jp NZ, a16", func(cpu *CPU) int {
+			return cpu.jp(cpu.regs.Flag(ZFlag) == 0)
+		}),
 		0xc3: newInstruction("jp a16", func(cpu *CPU) int {
-			cpu.regs.PC = cpu.operand16()
+			return cpu.jp(true)
+		}),
+		0xc4: newInstruction("call NZ, a16", func(cpu *CPU) int {
+			return cpu.call(cpu.regs.Flag(ZFlag) == 0)
+		}),
+		0xc5: newInstruction("push BC", func(cpu *CPU) int {
+			cpu.push16(cpu.regs.BC())
 			return 16
 		}),
 		0xc6: newInstruction("add A, d8", func(cpu *CPU) int {
 			cpu.regs.A = cpu.add8(cpu.regs.A, cpu.operand8(), true)
 			return 8
 		}),
+		0xc7: newInstruction("rst 00H", func(cpu *CPU) int {
+			return cpu.rst(0x00)
+		}),
 		0xc8: newInstruction("ret Z", func(cpu *CPU) int {
+			// Checking the condition takes an internal cycle
+			cpu.idle()
 			if cpu.regs.Flag(ZFlag) != 0 {
-				cpu.regs.PC = cpu.bus.Read16(cpu.regs.SP)
-				cpu.regs.SP += 2
-				return 20
+				return cpu.ret() + 4
 			}
 			return 8
 		}),
 		0xc9: newInstruction("ret", func(cpu *CPU) int {
-			cpu.regs.PC = cpu.bus.Read16(cpu.regs.SP)
-			cpu.regs.SP += 2
+			return cpu.ret()
+		}),
+		0xca: newInstruction("jp Z, a16", func(cpu *CPU) int {
+			return cpu.jp(cpu.regs.Flag(ZFlag) != 0)
+		}),
+		0xcc: newInstruction("call Z, a16", func(cpu *CPU) int {
+			return cpu.call(cpu.regs.Flag(ZFlag) != 0)
+		}),
+		0xcd: newInstruction("call a16", func(cpu *CPU) int {
+			return cpu.call(true)
+		}),
+		0xce: newInstruction("adc A, d8", func(cpu *CPU) int {
+			cpu.regs.A = cpu.adc8(cpu.regs.A, cpu.operand8())
+			return 8
+		}),
+		0xcf: newInstruction("rst 08H", func(cpu *CPU) int {
+			return cpu.rst(0x08)
+		}),
+		0xd0: newInstruction("ret NC", func(cpu *CPU) int {
+			// Checking the condition takes an internal cycle
+			cpu.idle()
+			if cpu.regs.Flag(CFlag) == 0 {
+				return cpu.ret() + 4
+			}
+			return 8
+		}),
+		0xd1: newInstruction("pop DE", func(cpu *CPU) int {
+			cpu.regs.SetDE(cpu.pop16())
+			return 12
+		}),
+		0xd2: newInstruction("jp NC, a16", func(cpu *CPU) int {
+			return cpu.jp(cpu.regs.Flag(CFlag) == 0)
+		}),
+		0xd4: newInstruction("call NC, a16", func(cpu *CPU) int {
+			return cpu.call(cpu.regs.Flag(CFlag) == 0)
+		}),
+		0xd5: newInstruction("push DE", func(cpu *CPU) int {
+			cpu.push16(cpu.regs.DE())
 			return 16
 		}),
-		0xcd: newInstruction("call d16", func(cpu *CPU) int {
-			cpu.regs.SP -= 2
-			address := cpu.operand16()
-			cpu.bus.Write16(cpu.regs.SP, cpu.regs.PC)
-			cpu.regs.PC = address
-			return 24
+		0xd6: newInstruction("sub d8", func(cpu *CPU) int {
+			cpu.regs.A = cpu.sub8(cpu.regs.A, cpu.operand8(), true)
+			return 8
+		}),
+		0xd7: newInstruction("rst 10H", func(cpu *CPU) int {
+			return cpu.rst(0x10)
+		}),
+		0xd8: newInstruction("ret C", func(cpu *CPU) int {
+			// Checking the condition takes an internal cycle
+			cpu.idle()
+			if cpu.regs.Flag(CFlag) != 0 {
+				return cpu.ret() + 4
+			}
+			return 8
 		}),
 		0xd9: newInstruction("reti", func(cpu *CPU) int {
 			return cpu.retISR()
 		}),
+		0xda: newInstruction("jp C, a16", func(cpu *CPU) int {
+			return cpu.jp(cpu.regs.Flag(CFlag) != 0)
+		}),
+		0xdc: newInstruction("call C, a16", func(cpu *CPU) int {
+			return cpu.call(cpu.regs.Flag(CFlag) != 0)
+		}),
+		0xde: newInstruction("sbc A, d8", func(cpu *CPU) int {
+			cpu.regs.A = cpu.sbc8(cpu.regs.A, cpu.operand8())
+			return 8
+		}),
+		0xdf: newInstruction("rst 18H", func(cpu *CPU) int {
+			return cpu.rst(0x18)
+		}),
 		0xe0: newInstruction("ldh (a8), A", func(cpu *CPU) int {
 			offset := cpu.operand8()
-			cpu.bus.Write8(0xff00+(uint16)(offset), cpu.regs.A)
+			cpu.write8(0xff00+(uint16)(offset), cpu.regs.A)
+			return 12
+		}),
+		0xe1: newInstruction("pop HL", func(cpu *CPU) int {
+			cpu.regs.SetHL(cpu.pop16())
 			return 12
 		}),
+		0xe2: newInstruction("ld (C), A", func(cpu *CPU) int {
+			cpu.write8(0xff00+(uint16)(cpu.regs.C), cpu.regs.A)
+			return 8
+		}),
+		0xe5: newInstruction("push HL", func(cpu *CPU) int {
+			cpu.push16(cpu.regs.HL())
+			return 16
+		}),
+		0xe6: newInstruction("and d8", func(cpu *CPU) int {
+			cpu.regs.A = cpu.and8(cpu.regs.A, cpu.operand8())
+			return 8
+		}),
+		0xe7: newInstruction("rst 20H", func(cpu *CPU) int {
+			return cpu.rst(0x20)
+		}),
+		0xe8: newInstruction("add SP, r8", func(cpu *CPU) int {
+			cpu.regs.SP = cpu.addSP(cpu.operand8())
+			return 16
+		}),
+		0xe9: newInstruction("jp HL", func(cpu *CPU) int {
+			cpu.regs.PC = cpu.regs.HL()
+			return 4
+		}),
+		0xea: newInstruction("ld (a16), A", func(cpu *CPU) int {
+			cpu.write8(cpu.operand16(), cpu.regs.A)
+			return 16
+		}),
 		0xee: newInstruction("xor d8", func(cpu *CPU) int {
 			cpu.regs.A = cpu.xor8(cpu.regs.A, cpu.operand8())
 			return 8
 		}),
+		0xef: newInstruction("rst 28H", func(cpu *CPU) int {
+			return cpu.rst(0x28)
+		}),
 		0xf0: newInstruction("ldh A, (a8)", func(cpu *CPU) int {
 			offset := cpu.operand8()
-			cpu.regs.A = cpu.bus.Read8(0xff00 + (uint16)(offset))
+			cpu.regs.A = cpu.read8(0xff00 + (uint16)(offset))
 			return 12
 		}),
-		0xfe: newInstruction("cp d8", func(cpu *CPU) int {
-			cpu.sub8(cpu.regs.A, cpu.operand8(), true)
+		0xf1: newInstruction("pop AF", func(cpu *CPU) int {
+			cpu.regs.SetAF(cpu.pop16())
+			return 12
+		}),
+		0xf2: newInstruction("ld A, (C)", func(cpu *CPU) int {
+			cpu.regs.A = cpu.read8(0xff00 + (uint16)(cpu.regs.C))
 			return 8
 		}),
 		0xf3: newInstruction("di", func(cpu *CPU) int {
 			cpu.ime = false
+			cpu.imeScheduled = false
 			return 4
 		}),
-		0xfb: newInstruction("ei", func(cpu *CPU) int {
-			cpu.ime = true
-			return 4
-		}),
-
-		// Prefixed (0xcb 0x??)
-		0xcb7e: newInstruction("bit 7, (HL)", func(cpu *CPU) int {
-			cpu.bit8(cpu.bus.Read8(cpu.regs.HL()), 7)
-			return 12
-		}),
-		0xcbc6: newInstruction("set 0, (HL)", func(cpu *CPU) int {
-			value := cpu.bus.Read8(cpu.regs.HL())
-			cpu.bus.Write8(cpu.regs.HL(), value|1)
+		0xf5: newInstruction("push AF", func(cpu *CPU) int {
+			cpu.push16(cpu.regs.AF())
 			return 16
 		}),
-		0xcbce: newInstruction("set 1, (HL)", func(cpu *CPU) int {
-			value := cpu.bus.Read8(cpu.regs.HL())
-			cpu.bus.Write8(cpu.regs.HL(), value|(1<<1))
-			return 16
+		0xf6: newInstruction("or d8", func(cpu *CPU) int {
+			cpu.regs.A = cpu.or8(cpu.regs.A, cpu.operand8())
+			return 8
 		}),
-		0xcbd6: newInstruction("set 2, (HL)", func(cpu *CPU) int {
-			value := cpu.bus.Read8(cpu.regs.HL())
-			cpu.bus.Write8(cpu.regs.HL(), value|(1<<2))
-			return 16
+		0xf7: newInstruction("rst 30H", func(cpu *CPU) int {
+			return cpu.rst(0x30)
 		}),
-		0xcbde: newInstruction("set 3, (HL)", func(cpu *CPU) int {
-			value := cpu.bus.Read8(cpu.regs.HL())
-			cpu.bus.Write8(cpu.regs.HL(), value|(1<<3))
-			return 16
+		0xf8: newInstruction("ld HL, SP+r8", func(cpu *CPU) int {
+			cpu.regs.SetHL(cpu.addSP(cpu.operand8()))
+			return 12
 		}),
-		0xcbe6: newInstruction("set 4, (HL)", func(cpu *CPU) int {
-			value := cpu.bus.Read8(cpu.regs.HL())
-			cpu.bus.Write8(cpu.regs.HL(), value|(1<<4))
-			return 16
+		0xf9: newInstruction("ld SP, HL", func(cpu *CPU) int {
+			cpu.regs.SP = cpu.regs.HL()
+			return 8
 		}),
-		0xcbee: newInstruction("set 5, (HL)", func(cpu *CPU) int {
-			value := cpu.bus.Read8(cpu.regs.HL())
-			cpu.bus.Write8(cpu.regs.HL(), value|(1<<5))
+		0xfa: newInstruction("ld A, (a16)", func(cpu *CPU) int {
+			cpu.regs.A = cpu.read8(cpu.operand16())
 			return 16
 		}),
-		0xcbf6: newInstruction("set 6, (HL)", func(cpu *CPU) int {
-			value := cpu.bus.Read8(cpu.regs.HL())
-			cpu.bus.Write8(cpu.regs.HL(), value|(1<<6))
-			return 16
+		0xfb: newInstruction("ei", func(cpu *CPU) int {
+			if !cpu.ime {
+				cpu.imeScheduled = true
+			}
+			return 4
 		}),
-		0xcbfe: newInstruction("set 7, (HL)", func(cpu *CPU) int {
-			value := cpu.bus.Read8(cpu.regs.HL())
-			cpu.bus.Write8(cpu.regs.HL(), value|(1<<7))
-			return 16
+		0xfe: newInstruction("cp d8", func(cpu *CPU) int {
+			cpu.sub8(cpu.regs.A, cpu.operand8(), true)
+			return 8
+		}),
+		0xff: newInstruction("rst 38H", func(cpu *CPU) int {
+			return cpu.rst(0x38)
 		}),
 	}
+
+	for opcode, inst := range newPrefixedInstructionSet() {
+		set[opcode] = inst
+	}
+
+	return set
+}
+
+// Prefixed (0xcb 0x??) instructions are regular enough to be generated.
+// Bit 7-6 selects the group, bit 5-3 selects the operation or the bit number,
+// and bit 2-0 selects the operand.
+func newPrefixedInstructionSet() map[uint16]instruction {
+	set := map[uint16]instruction{}
+
+	shifts := []struct {
+		mnemonic string
+		op       func(cpu *CPU, value uint8) uint8
+	}{
+		{"rlc", (*CPU).rlc8},
+		{"rrc", (*CPU).rrc8},
+		{"rl", (*CPU).rl8},
+		{"rr", (*CPU).rr8},
+		{"sla", (*CPU).sla8},
+		{"sra", (*CPU).sra8},
+		{"swap", (*CPU).swap8},
+		{"srl", (*CPU).srl8},
+	}
+
+	for operand := uint8(0); operand < 8; operand++ {
+		operand := operand
+
+		// (HL) needs an extra memory read, and another write if the result is stored
+		readCycles, writeCycles := 8, 8
+		if operand == hlOperand {
+			readCycles, writeCycles = 12, 16
+		}
+
+		for i, shift := range shifts {
+			shift := shift
+			opcode := 0xcb00 | uint16(i)<<3 | uint16(operand)
+			set[opcode] = newInstruction(fmt.Sprintf("%s %s", shift.mnemonic, operandNames[operand]), func(cpu *CPU) int {
+				cpu.setOperand(operand, shift.op(cpu, cpu.operand(operand)))
+				return writeCycles
+			})
+		}
+
+		for b := 0; b < 8; b++ {
+			b := b
+
+			opcode := 0xcb40 | uint16(b)<<3 | uint16(operand)
+			set[opcode] = newInstruction(fmt.Sprintf("bit %d, %s", b, operandNames[operand]), func(cpu *CPU) int {
+				cpu.bit8(cpu.operand(operand), b)
+				return readCycles
+			})
+
+			opcode = 0xcb80 | uint16(b)<<3 | uint16(operand)
+			set[opcode] = newInstruction(fmt.Sprintf("res %d, %s", b, operandNames[operand]), func(cpu *CPU) int {
+				cpu.setOperand(operand, cpu.operand(operand)&^(1<<b))
+				return writeCycles
+			})
+
+			opcode = 0xcbc0 | uint16(b)<<3 | uint16(operand)
+			set[opcode] = newInstruction(fmt.Sprintf("set %d, %s", b, operandNames[operand]), func(cpu *CPU) int {
+				cpu.setOperand(operand, cpu.operand(operand)|(1<<b))
+				return writeCycles
+			})
+		}
+	}
+
+	return set
+}
+
+// Operands encoded in the lowest 3 bits of an opcode
+var operandNames = [8]string{"B", "C", "D", "E", "H", "L", "(HL)", "A"}
+
+const hlOperand = 6
+
+func (c *CPU) operand(index uint8) uint8 {
+	switch index {
+	case 0:
+		return c.regs.B
+	case 1:
+		return c.regs.C
+	case 2:
+		return c.regs.D
+	case 3:
+		return c.regs.E
+	case 4:
+		return c.regs.H
+	case 5:
+		return c.regs.L
+	case hlOperand:
+		return c.read8(c.regs.HL())
+	default:
+		return c.regs.A
+	}
+}
+
+func (c *CPU) setOperand(index uint8, data uint8) {
+	switch index {
+	case 0:
+		c.regs.B = data
+	case 1:
+		c.regs.C = data
+	case 2:
+		c.regs.D = data
+	case 3:
+		c.regs.E = data
+	case 4:
+		c.regs.H = data
+	case 5:
+		c.regs.L = data
+	case hlOperand:
+		c.write8(c.regs.HL(), data)
+	default:
+		c.regs.A = data
+	}
 }
 
 func (c *CPU) operand8() uint8 {
-	data := c.bus.Read8(c.regs.PC)
+	data := c.read8(c.regs.PC)
 	c.regs.PC++
 	return data
 }
 
 func (c *CPU) operand16() uint16 {
-	data := c.bus.Read16(c.regs.PC)
+	data := c.read16(c.regs.PC)
 	c.regs.PC += 2
 	return data
 }
@@ -305,8 +1143,23 @@ func (c *CPU) add8(a uint8, b uint8, updateCFlag bool) uint8 {
 	c.regs.SetFlag(HFlag, (a&0xf)+(b&0xf) > 0xf)
 
 	if updateCFlag {
-		c.regs.SetFlag(CFlag, result <= a)
+		c.regs.SetFlag(CFlag, (uint16)(a)+(uint16)(b) > 0xff)
+	}
+
+	return result
+}
+
+func (c *CPU) adc8(a uint8, b uint8) uint8 {
+	var carry uint8 = 0
+	if c.regs.Flag(CFlag) != 0 {
+		carry = 1
 	}
+	result := a + b + carry
+
+	c.regs.SetFlag(NFlag, false)
+	c.regs.SetFlag(ZFlag, result == 0)
+	c.regs.SetFlag(HFlag, (a&0xf)+(b&0xf)+carry > 0xf)
+	c.regs.SetFlag(CFlag, (uint16)(a)+(uint16)(b)+(uint16)(carry) > 0xff)
 
 	return result
 }
@@ -325,6 +1178,46 @@ func (c *CPU) sub8(a uint8, b uint8, updateCFlag bool) uint8 {
 	return result
 }
 
+func (c *CPU) sbc8(a uint8, b uint8) uint8 {
+	var carry uint8 = 0
+	if c.regs.Flag(CFlag) != 0 {
+		carry = 1
+	}
+	result := a - b - carry
+
+	c.regs.SetFlag(NFlag, true)
+	c.regs.SetFlag(ZFlag, result == 0)
+	c.regs.SetFlag(HFlag, (uint16)(a&0xf) < (uint16)(b&0xf)+(uint16)(carry))
+	c.regs.SetFlag(CFlag, (uint16)(a) < (uint16)(b)+(uint16)(carry))
+
+	return result
+}
+
+// ADD HL, rr leaves Z untouched and takes H from bit 11 and C from bit 15
+func (c *CPU) add16(a uint16, b uint16) uint16 {
+	result := a + b
+
+	c.regs.SetFlag(NFlag, false)
+	c.regs.SetFlag(HFlag, (a&0xfff)+(b&0xfff) > 0xfff)
+	c.regs.SetFlag(CFlag, (uint32)(a)+(uint32)(b) > 0xffff)
+
+	return result
+}
+
+// ADD SP, r8 and LD HL, SP+r8 compute H and C from the unsigned low byte
+// addition even though the operand is signed
+func (c *CPU) addSP(offset uint8) uint16 {
+	sp := c.regs.SP
+	result := sp + signExtU8ToU16(offset)
+
+	c.regs.SetFlag(ZFlag, false)
+	c.regs.SetFlag(NFlag, false)
+	c.regs.SetFlag(HFlag, (sp&0xf)+(uint16)(offset&0xf) > 0xf)
+	c.regs.SetFlag(CFlag, (sp&0xff)+(uint16)(offset) > 0xff)
+
+	return result
+}
+
 func (c *CPU) and8(a uint8, b uint8) uint8 {
 	result := a & b
 
@@ -374,3 +1267,151 @@ func signExtU8ToU16(from uint8) uint16 {
 	}
 	return to
 }
+
+func (c *CPU) rlc8(a uint8) uint8 {
+	result := (a << 1) | (a >> 7)
+	c.setRotateFlags(result, a&0x80 != 0)
+	return result
+}
+
+func (c *CPU) rrc8(a uint8) uint8 {
+	result := (a >> 1) | (a << 7)
+	c.setRotateFlags(result, a&0x01 != 0)
+	return result
+}
+
+func (c *CPU) rl8(a uint8) uint8 {
+	result := a << 1
+	if c.regs.Flag(CFlag) != 0 {
+		result |= 0x01
+	}
+	c.setRotateFlags(result, a&0x80 != 0)
+	return result
+}
+
+func (c *CPU) rr8(a uint8) uint8 {
+	result := a >> 1
+	if c.regs.Flag(CFlag) != 0 {
+		result |= 0x80
+	}
+	c.setRotateFlags(result, a&0x01 != 0)
+	return result
+}
+
+func (c *CPU) sla8(a uint8) uint8 {
+	result := a << 1
+	c.setRotateFlags(result, a&0x80 != 0)
+	return result
+}
+
+// Arithmetic shift keeps the sign bit
+func (c *CPU) sra8(a uint8) uint8 {
+	result := (a >> 1) | (a & 0x80)
+	c.setRotateFlags(result, a&0x01 != 0)
+	return result
+}
+
+func (c *CPU) srl8(a uint8) uint8 {
+	result := a >> 1
+	c.setRotateFlags(result, a&0x01 != 0)
+	return result
+}
+
+func (c *CPU) swap8(a uint8) uint8 {
+	result := (a << 4) | (a >> 4)
+	c.setRotateFlags(result, false)
+	return result
+}
+
+func (c *CPU) setRotateFlags(result uint8, carry bool) {
+	c.regs.SetFlag(NFlag, false)
+	c.regs.SetFlag(ZFlag, result == 0)
+	c.regs.SetFlag(HFlag, false)
+	c.regs.SetFlag(CFlag, carry)
+}
+
+// Adjust A to packed BCD after an addition or subtraction of two BCD numbers
+func (c *CPU) daa() {
+	var adjust uint8 = 0
+	carry := false
+
+	if c.regs.Flag(NFlag) == 0 {
+		if c.regs.Flag(CFlag) != 0 || c.regs.A > 0x99 {
+			adjust |= 0x60
+			carry = true
+		}
+		if c.regs.Flag(HFlag) != 0 || c.regs.A&0xf > 0x9 {
+			adjust |= 0x06
+		}
+		c.regs.A += adjust
+	} else {
+		if c.regs.Flag(CFlag) != 0 {
+			adjust |= 0x60
+			carry = true
+		}
+		if c.regs.Flag(HFlag) != 0 {
+			adjust |= 0x06
+		}
+		c.regs.A -= adjust
+	}
+
+	c.regs.SetFlag(ZFlag, c.regs.A == 0)
+	c.regs.SetFlag(HFlag, false)
+	c.regs.SetFlag(CFlag, carry)
+}
+
+// PUSH, CALL, RST and the interrupt dispatch all spend an internal cycle
+// before writing the high byte and then the low byte
+func (c *CPU) push16(data uint16) {
+	c.idle()
+	c.regs.SP--
+	c.write8(c.regs.SP, (uint8)(data>>8))
+	c.regs.SP--
+	c.write8(c.regs.SP, (uint8)(data&0xff))
+}
+
+func (c *CPU) pop16() uint16 {
+	data := c.read16(c.regs.SP)
+	c.regs.SP += 2
+	return data
+}
+
+// The operand is always fetched, so PC skips it even if the branch is not taken
+func (c *CPU) jr(cond bool) int {
+	offset := c.operand8()
+	if !cond {
+		return 8
+	}
+	c.regs.PC += signExtU8ToU16(offset)
+	return 12
+}
+
+func (c *CPU) jp(cond bool) int {
+	address := c.operand16()
+	if !cond {
+		return 12
+	}
+	c.regs.PC = address
+	return 16
+}
+
+func (c *CPU) call(cond bool) int {
+	address := c.operand16()
+	if !cond {
+		return 12
+	}
+	c.push16(c.regs.PC)
+	c.regs.PC = address
+	return 24
+}
+
+func (c *CPU) ret() int {
+	c.regs.PC = c.pop16()
+	return 16
+}
+
+func (c *CPU) rst(address uint16) int {
+	c.push16(c.regs.PC)
+	c.regs.PC = address
+	return 16
+}
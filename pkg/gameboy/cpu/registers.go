@@ -37,13 +37,23 @@ func newRegisters() Registers {
 }
 
 // Bit position of each flag in F register
+// The lower 4 bits of F are unused and always read as 0
 const (
-	CFlag = 0b1
-	HFlag = 0b10
-	NFlag = 0b100
-	ZFlag = 0b1000
+	CFlag = 0b0001_0000
+	HFlag = 0b0010_0000
+	NFlag = 0b0100_0000
+	ZFlag = 0b1000_0000
 )
 
+func (r *Registers) AF() uint16 {
+	return ((uint16)(r.A) << 8) | (uint16)(r.F)
+}
+
+func (r *Registers) SetAF(data uint16) {
+	r.A = (uint8)((data >> 8) & 0xff)
+	r.F = (uint8)(data & 0xf0)
+}
+
 func (r *Registers) HL() uint16 {
 	return ((uint16)(r.H) << 8) | (uint16)(r.L)
 }
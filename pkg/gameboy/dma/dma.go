@@ -0,0 +1,109 @@
+package dma
+
+import (
+	"github.com/d2verb/gemu/pkg/gameboy/bus"
+	"github.com/d2verb/gemu/pkg/log"
+)
+
+const (
+	TransferLength    = 160
+	CyclesPerTransfer = TransferLength * 4
+)
+
+// OAM is the destination of the transfer. It is written directly because the
+// DMA has priority over the PPU.
+type OAM interface {
+	WriteOAM(offset uint8, data uint8)
+}
+
+// DMA copies 160 bytes from XX00-XX9F to OAM (FE00-FE9F) when XX is written to
+// 0xff46. A byte is copied per M-cycle, and the CPU can only access HRAM (and
+// I/O registers) during the transfer.
+type DMA struct {
+	reg      uint8
+	source   uint16
+	index    int
+	starting bool // The transfer starts one M-cycle after the write
+	active   bool
+	regRange bus.AddressRange
+	oam      OAM
+	bus      *bus.Bus
+}
+
+func New(oam OAM) *DMA {
+	return &DMA{
+		regRange: bus.NewAddressRange(0xff46, 0xff46),
+		oam:      oam,
+	}
+}
+
+func (d *DMA) ConnectToBus(b *bus.Bus) error {
+	if err := b.Map(d.regRange, d); err != nil {
+		return err
+	}
+	d.bus = b
+	return nil
+}
+
+// Step advances the transfer by the given CPU cycles
+func (d *DMA) Step(cycles int) {
+	for ; cycles > 0; cycles -= 4 {
+		if d.active {
+			d.oam.WriteOAM(uint8(d.index), d.bus.Read8(d.source+uint16(d.index)))
+			d.index++
+			if d.index == TransferLength {
+				d.active = false
+			}
+		}
+
+		if d.starting {
+			d.starting = false
+			d.active = true
+			d.index = 0
+			d.source = uint16(d.reg) << 8
+			// Sources above 0xdfff read from the echo of Work RAM
+			if d.source >= 0xe000 {
+				d.source -= 0x2000
+			}
+		}
+	}
+}
+
+// Active reports whether a transfer is in progress
+func (d *DMA) Active() bool {
+	return d.active
+}
+
+// Accessible reports whether the CPU can access the address now
+func (d *DMA) Accessible(address uint16) bool {
+	return !d.active || address >= 0xff00
+}
+
+func (d *DMA) Read8(address uint16) uint8 {
+	if !d.regRange.Contains(address) {
+		log.Fatalf("DMA cannot be accessed at 0x%04x", address)
+	}
+	return d.reg
+}
+
+func (d *DMA) Read16(address uint16) uint16 {
+	loByte := d.Read8(address)
+	hiByte := d.Read8(address + 1)
+	return ((uint16)(hiByte)<<8 | (uint16)(loByte))
+}
+
+func (d *DMA) Write8(address uint16, data uint8) {
+	if !d.regRange.Contains(address) {
+		log.Fatalf("DMA cannot be accessed at 0x%04x", address)
+	}
+	d.reg = data
+	d.starting = true
+}
+
+func (d *DMA) Write16(address uint16, data uint16) {
+	hiByte := (uint8)(data >> 8)
+	loByte := (uint8)(data & 0xff)
+
+	d.Write8(address, loByte)
+	d.Write8(address+1, hiByte)
+}
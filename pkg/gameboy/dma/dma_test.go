@@ -0,0 +1,92 @@
+package dma
+
+import (
+	"testing"
+
+	"github.com/d2verb/gemu/pkg/gameboy/bus"
+	"github.com/d2verb/gemu/pkg/gameboy/ram"
+)
+
+type testOAM [TransferLength]uint8
+
+func (o *testOAM) WriteOAM(offset uint8, data uint8) {
+	o[offset] = data
+}
+
+func newTestDMA(t *testing.T) (*DMA, *testOAM, *bus.Bus) {
+	t.Helper()
+
+	b := bus.New()
+	if err := ram.New().ConnectToBus(b); err != nil {
+		t.Fatal(err)
+	}
+	oam := &testOAM{}
+	d := New(oam)
+	if err := d.ConnectToBus(b); err != nil {
+		t.Fatal(err)
+	}
+	return d, oam, b
+}
+
+func TestTransfer(t *testing.T) {
+	d, oam, b := newTestDMA(t)
+	for i := uint16(0); i < TransferLength; i++ {
+		b.Write8(0xc100+i, uint8(i)^0x5a)
+	}
+
+	b.Write8(0xff46, 0xc1)
+	if got := b.Read8(0xff46); got != 0xc1 {
+		t.Errorf("DMA = 0x%02x, want 0xc1", got)
+	}
+
+	d.Step(4)
+	if !d.Active() {
+		t.Fatalf("transfer should start one M-cycle after the write")
+	}
+
+	d.Step(CyclesPerTransfer - 4)
+	if !d.Active() || oam[TransferLength-2] != (TransferLength-2)^0x5a || oam[TransferLength-1] != 0 {
+		t.Fatalf("transfer should copy a byte per M-cycle")
+	}
+
+	d.Step(4)
+	if d.Active() {
+		t.Fatalf("transfer should take %d cycles", CyclesPerTransfer)
+	}
+	for i := range oam {
+		if oam[i] != uint8(i)^0x5a {
+			t.Fatalf("OAM[%d] = 0x%02x, want 0x%02x", i, oam[i], uint8(i)^0x5a)
+		}
+	}
+}
+
+func TestTransferFromEcho(t *testing.T) {
+	d, oam, b := newTestDMA(t)
+	b.Write8(0xde00, 0x42)
+
+	b.Write8(0xff46, 0xfe)
+	d.Step(4 + CyclesPerTransfer)
+	if oam[0] != 0x42 {
+		t.Errorf("source 0xfe00 should read from 0xde00")
+	}
+}
+
+func TestAccessible(t *testing.T) {
+	d, _, b := newTestDMA(t)
+	if !d.Accessible(0xc000) {
+		t.Errorf("everything should be accessible without a transfer")
+	}
+
+	b.Write8(0xff46, 0xc0)
+	d.Step(4)
+	for _, address := range []uint16{0x0000, 0x8000, 0xc000, 0xfe00} {
+		if d.Accessible(address) {
+			t.Errorf("0x%04x should not be accessible during a transfer", address)
+		}
+	}
+	for _, address := range []uint16{0xff00, 0xff80, 0xfffe} {
+		if !d.Accessible(address) {
+			t.Errorf("0x%04x should be accessible during a transfer", address)
+		}
+	}
+}
@@ -2,32 +2,54 @@ package gameboy
 
 import (
 	"context"
+	"sync"
 
+	"github.com/d2verb/gemu/pkg/audio"
 	"github.com/d2verb/gemu/pkg/debug/pb"
 	"github.com/d2verb/gemu/pkg/gameboy/apu"
 	"github.com/d2verb/gemu/pkg/gameboy/bus"
 	"github.com/d2verb/gemu/pkg/gameboy/cpu"
+	"github.com/d2verb/gemu/pkg/gameboy/dma"
+	"github.com/d2verb/gemu/pkg/gameboy/hdma"
+	"github.com/d2verb/gemu/pkg/gameboy/joypad"
 	"github.com/d2verb/gemu/pkg/gameboy/lcd"
 	"github.com/d2verb/gemu/pkg/gameboy/ppu"
 	"github.com/d2verb/gemu/pkg/gameboy/ram"
 	"github.com/d2verb/gemu/pkg/gameboy/rom"
+	"github.com/d2verb/gemu/pkg/gameboy/serial"
+	"github.com/d2verb/gemu/pkg/gameboy/timer"
 	"github.com/d2verb/gemu/pkg/log"
 )
 
+// The APU samples are passed to the audio sink about every 4ms
+const AudioFlushCycles = 16384
+
 type GameBoy struct {
-	c         *cpu.CPU
-	r         *rom.ROM
-	a         *ram.RAM
-	l         *lcd.LCD
-	p         *ppu.PPU
-	s         *apu.APU
-	b         *bus.Bus
-	ch        chan any
-	debugMode bool
+	c             *cpu.CPU
+	r             *rom.ROM
+	a             *ram.RAM
+	l             *lcd.LCD
+	p             *ppu.PPU
+	s             *apu.APU
+	t             *timer.Timer
+	j             *joypad.Joypad
+	sr            *serial.Serial
+	d             *dma.DMA
+	h             *hdma.HDMA
+	b             *bus.Bus
+	sink          audio.Sink
+	recorder      *audio.Recorder
+	recorderMu    sync.Mutex // recorder is stopped from another goroutine
+	audioCycles   int
+	ch            chan any
+	debugMode     bool
+	cycleAccurate bool
 }
 
 func NewGameBoy(romContent []uint8, ch chan any, debugMode bool) (*GameBoy, error) {
 	l := lcd.New()
+	p := ppu.New(l)
+	c := cpu.New()
 
 	r, err := rom.New(romContent)
 	if err != nil {
@@ -35,29 +57,113 @@ func NewGameBoy(romContent []uint8, ch chan any, debugMode bool) (*GameBoy, erro
 	}
 
 	g := GameBoy{
-		c:         cpu.New(),
+		c:         c,
 		r:         r,
 		a:         ram.New(),
 		l:         l,
-		p:         ppu.New(l),
+		p:         p,
 		s:         apu.New(),
+		t:         timer.New(),
+		j:         joypad.New(),
+		sr:        serial.New(),
+		d:         dma.New(p),
+		h:         hdma.New(c, p),
 		b:         bus.New(),
+		sink:      audio.NewNullSink(),
 		ch:        ch,
 		debugMode: debugMode,
 	}
+	if r.IsCGB() {
+		g.c.EnableCGBMode()
+		g.a.EnableCGBMode()
+		g.s.EnableCGBMode()
+		g.p.EnableCGBMode()
+		g.h.EnableCGBMode()
+	}
+
 	g.c.ConnectToBus(g.b)
 	g.r.ConnectToBus(g.b)
 	g.a.ConnectToBus(g.b)
 	g.p.ConnectToBus(g.b)
 	g.s.ConnectToBus(g.b)
+	g.t.ConnectToBus(g.b)
+	g.j.ConnectToBus(g.b)
+	g.sr.ConnectToBus(g.b)
+	g.d.ConnectToBus(g.b)
+	g.h.ConnectToBus(g.b)
+	g.c.SetAccessCheck(g.d.Accessible)
 
 	return &g, nil
 }
 
+// EnableCycleAccurateMode lets the CPU tick the rest of the system for every
+// memory access, so mid-instruction accesses observe the right PPU state.
+// It is slower than stepping the system once per instruction.
+func (g *GameBoy) EnableCycleAccurateMode() {
+	g.cycleAccurate = true
+	g.c.SetTick(g.tick)
+}
+
+// EnablePixelFIFOMode renders the screen dot by dot with the pixel FIFO instead
+// of a scanline at once, so mid-scanline register writes take effect.
+func (g *GameBoy) EnablePixelFIFOMode() {
+	g.p.EnablePixelFIFO()
+}
+
+// ConnectLink plugs a partner into the link port
+func (g *GameBoy) ConnectLink(l serial.Link) {
+	g.sr.ConnectLink(l)
+}
+
+// SetAudioSink sends the APU output to the sink. A sink which blocks on Write
+// paces the emulation.
+func (g *GameBoy) SetAudioSink(s audio.Sink) {
+	g.sink = s
+}
+
+// RecordAudio writes the APU output to a WAV file at the given rate until
+// StopRecording is called. With stems, the output of each channel is also
+// written next to it.
+func (g *GameBoy) RecordAudio(path string, rate int, stems bool) error {
+	r, err := audio.NewRecorder(path, rate, stems)
+	if err != nil {
+		return err
+	}
+	if stems {
+		g.s.EnableChannelSamples()
+	}
+	g.recorderMu.Lock()
+	g.recorder = r
+	g.recorderMu.Unlock()
+	return nil
+}
+
+// StopRecording finishes the WAV files. It is safe to call while the emulator
+// is running.
+func (g *GameBoy) StopRecording() error {
+	g.recorderMu.Lock()
+	defer g.recorderMu.Unlock()
+
+	if g.recorder == nil {
+		return nil
+	}
+	return g.recorder.Close()
+}
+
 func (g *GameBoy) LCD() *lcd.LCD {
 	return g.l
 }
 
+// Press and Release are safe to call from a goroutine other than the one
+// running the emulator (e.g. the GUI)
+func (g *GameBoy) Press(b joypad.Button) {
+	g.j.Press(b)
+}
+
+func (g *GameBoy) Release(b joypad.Button) {
+	g.j.Release(b)
+}
+
 func (g *GameBoy) Start(ctx context.Context, cancel context.CancelFunc) {
 	log.Debugf("Starting game... (%s)\n", g.r.String())
 
@@ -74,7 +180,56 @@ func (g *GameBoy) Start(ctx context.Context, cancel context.CancelFunc) {
 			}
 
 			cycles := g.c.Step()
-			g.p.Step(cycles)
+			if !g.cycleAccurate {
+				g.tick(cycles)
+			}
+		}
+	}
+}
+
+// tick advances everything but the CPU by the given CPU cycles
+func (g *GameBoy) tick(cycles int) {
+	g.t.Step(cycles)
+	g.j.Step(cycles)
+	g.sr.Step(cycles)
+	g.d.Step(cycles)
+
+	// The PPU and APU keep their clock in double speed mode, so they see
+	// only half of the CPU cycles
+	if g.c.DoubleSpeed() {
+		cycles /= 2
+	}
+	g.p.Step(cycles)
+	g.s.Step(cycles)
+	g.flushAudio(cycles)
+
+	// HBlank DMA follows the PPU mode
+	g.h.Step(cycles)
+}
+
+func (g *GameBoy) flushAudio(cycles int) {
+	g.audioCycles += cycles
+	if g.audioCycles < AudioFlushCycles {
+		return
+	}
+	g.audioCycles = 0
+
+	samples := g.s.Samples()
+	channels := g.s.ChannelSamples()
+
+	if err := g.sink.Write(samples); err != nil {
+		log.Errorf("Audio output stopped: %v\n", err)
+		g.sink = audio.NewNullSink()
+	}
+	g.recorderMu.Lock()
+	defer g.recorderMu.Unlock()
+	if g.recorder != nil {
+		if err := g.recorder.Write(samples, channels); err != nil {
+			log.Errorf("Audio recording stopped: %v\n", err)
+			if err := g.recorder.Close(); err != nil {
+				log.Errorf("Audio recording cannot be closed: %v\n", err)
+			}
+			g.recorder = nil
 		}
 	}
 }
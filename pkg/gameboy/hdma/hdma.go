@@ -0,0 +1,186 @@
+package hdma
+
+import (
+	"github.com/d2verb/gemu/pkg/gameboy/bus"
+	"github.com/d2verb/gemu/pkg/log"
+)
+
+const (
+	BlockLength = 16
+	// The CPU is halted for 8 M-cycles per block, which doubles in CPU cycles
+	// in double speed mode
+	CyclesPerBlock = 32
+)
+
+// HDMA5 bit flags
+const (
+	LengthMask     = 0b1111111
+	HBlankModeFlag = 0b10000000
+)
+
+// CPU is halted while a block is transferred
+type CPU interface {
+	Stall(cycles int)
+	DoubleSpeed() bool
+}
+
+// VRAM is the destination of the transfer. It is written directly because the
+// transfer does not follow the CPU's access rules.
+type VRAM interface {
+	WriteVRAM(offset uint16, data uint8)
+}
+
+// HDMA copies data to VRAM on CGB, either all at once (general purpose DMA)
+// or 16 bytes per HBlank (HBlank DMA).
+type HDMA struct {
+	source      uint16
+	destination uint16
+	blocks      int // Remaining 16-byte blocks
+	active      bool
+	hblank      bool // The PPU was in HBlank on the last step
+	cgbMode     bool
+	regsRange   bus.AddressRange
+	cpu         CPU
+	vram        VRAM
+	bus         *bus.Bus
+}
+
+func New(c CPU, vram VRAM) *HDMA {
+	return &HDMA{
+		regsRange: bus.NewAddressRange(0xff51, 0xff55),
+		cpu:       c,
+		vram:      vram,
+	}
+}
+
+// EnableCGBMode makes HDMA1-HDMA5 available
+func (h *HDMA) EnableCGBMode() {
+	h.cgbMode = true
+}
+
+func (h *HDMA) ConnectToBus(b *bus.Bus) error {
+	if err := b.Map(h.regsRange, h); err != nil {
+		return err
+	}
+	h.bus = b
+	return nil
+}
+
+// Step transfers a block at the beginning of each HBlank while HBlank DMA is
+// active. HBlank is detected from LCDC, STAT and LY. If the transfer is
+// started during HBlank, the first block is transferred immediately.
+func (h *HDMA) Step(cycles int) {
+	if !h.active {
+		h.hblank = false
+		return
+	}
+
+	hblank := h.inHBlank()
+	if hblank && !h.hblank {
+		h.transfer()
+		if h.blocks == 0 {
+			h.active = false
+		}
+	}
+	h.hblank = hblank
+}
+
+func (h *HDMA) inHBlank() bool {
+	lcdc := h.bus.Read8(0xff40)
+	stat := h.bus.Read8(0xff41)
+	ly := h.bus.Read8(0xff44)
+	return lcdc&0x80 != 0 && stat&0b11 == 0 && ly < 144
+}
+
+// transfer copies a block from the source to VRAM and halts the CPU meanwhile
+func (h *HDMA) transfer() {
+	for i := uint16(0); i < BlockLength; i++ {
+		data := h.bus.Read8(h.source + i)
+		h.vram.WriteVRAM((h.destination+i)&0x1fff, data)
+	}
+	h.source += BlockLength
+	h.destination += BlockLength
+	h.blocks--
+
+	cycles := CyclesPerBlock
+	if h.cpu.DoubleSpeed() {
+		cycles *= 2
+	}
+	h.cpu.Stall(cycles)
+}
+
+func (h *HDMA) Read8(address uint16) uint8 {
+	if !h.regsRange.Contains(address) {
+		log.Fatalf("HDMA cannot be accessed at 0x%04x", address)
+	}
+
+	// HDMA1-HDMA4 are write-only
+	if !h.cgbMode || address != 0xff55 {
+		return 0xff
+	}
+
+	// Bit 7 is cleared while HBlank DMA is active, and the lower bits are the
+	// remaining blocks minus 1 (0xff after the transfer completed)
+	data := uint8(h.blocks-1) & LengthMask
+	if !h.active {
+		data |= HBlankModeFlag
+	}
+	return data
+}
+
+func (h *HDMA) Read16(address uint16) uint16 {
+	loByte := h.Read8(address)
+	hiByte := h.Read8(address + 1)
+	return ((uint16)(hiByte)<<8 | (uint16)(loByte))
+}
+
+func (h *HDMA) Write8(address uint16, data uint8) {
+	if !h.regsRange.Contains(address) {
+		log.Fatalf("HDMA cannot be accessed at 0x%04x", address)
+	}
+	if !h.cgbMode {
+		return
+	}
+
+	switch address {
+	case 0xff51:
+		h.source = uint16(data)<<8 | h.source&0xff
+	case 0xff52:
+		// The lower 4 bits are ignored
+		h.source = h.source&0xff00 | uint16(data&0xf0)
+	case 0xff53:
+		// The destination is always in VRAM
+		h.destination = uint16(data&0x1f)<<8 | h.destination&0xff
+	case 0xff54:
+		h.destination = h.destination&0xff00 | uint16(data&0xf0)
+	case 0xff55:
+		h.start(data)
+	}
+}
+
+func (h *HDMA) start(data uint8) {
+	// Writing 0 to bit 7 cancels the active HBlank DMA
+	if h.active && data&HBlankModeFlag == 0 {
+		h.active = false
+		return
+	}
+
+	h.blocks = int(data&LengthMask) + 1
+	if data&HBlankModeFlag != 0 {
+		h.active = true
+		return
+	}
+
+	// General purpose DMA transfers everything at once
+	for h.blocks > 0 {
+		h.transfer()
+	}
+}
+
+func (h *HDMA) Write16(address uint16, data uint16) {
+	hiByte := (uint8)(data >> 8)
+	loByte := (uint8)(data & 0xff)
+
+	h.Write8(address, loByte)
+	h.Write8(address+1, hiByte)
+}
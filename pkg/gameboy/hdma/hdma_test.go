@@ -0,0 +1,226 @@
+package hdma
+
+import (
+	"testing"
+
+	"github.com/d2verb/gemu/pkg/gameboy/bus"
+	"github.com/d2verb/gemu/pkg/gameboy/cpu"
+	"github.com/d2verb/gemu/pkg/gameboy/lcd"
+	"github.com/d2verb/gemu/pkg/gameboy/ppu"
+	"github.com/d2verb/gemu/pkg/gameboy/ram"
+)
+
+type testCPU struct {
+	stalled     int
+	doubleSpeed bool
+}
+
+func (c *testCPU) Stall(cycles int) {
+	c.stalled += cycles
+}
+
+func (c *testCPU) DoubleSpeed() bool {
+	return c.doubleSpeed
+}
+
+// newTestLCD creates an LCD whose frames are discarded
+func newTestLCD(t *testing.T) *lcd.LCD {
+	t.Helper()
+
+	l := lcd.New()
+	go func() {
+		for range l.Updated {
+		}
+	}()
+	t.Cleanup(func() { close(l.Updated) })
+	return l
+}
+
+func newTestHDMA(t *testing.T) (*HDMA, *testCPU, *ppu.PPU, *bus.Bus) {
+	t.Helper()
+	return newTestHDMAWithLCD(t, newTestLCD(t))
+}
+
+func newTestHDMAWithLCD(t *testing.T, l *lcd.LCD) (*HDMA, *testCPU, *ppu.PPU, *bus.Bus) {
+	t.Helper()
+
+	b := bus.New()
+	if err := cpu.New().ConnectToBus(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := ram.New().ConnectToBus(b); err != nil {
+		t.Fatal(err)
+	}
+	p := ppu.New(l)
+	p.EnableCGBMode()
+	if err := p.ConnectToBus(b); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testCPU{}
+	h := New(c, p)
+	h.EnableCGBMode()
+	if err := h.ConnectToBus(b); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := uint16(0); i < 0x100; i++ {
+		b.Write8(0xc000+i, uint8(i))
+	}
+	return h, c, p, b
+}
+
+// setAddresses sets the source and the destination through HDMA1-HDMA4
+func setAddresses(b *bus.Bus, source uint16, destination uint16) {
+	b.Write8(0xff51, uint8(source>>8))
+	b.Write8(0xff52, uint8(source))
+	b.Write8(0xff53, uint8(destination>>8))
+	b.Write8(0xff54, uint8(destination))
+}
+
+// stepUntilLY steps the PPU and the HDMA as GameBoy does
+func stepUntilLY(h *HDMA, p *ppu.PPU, b *bus.Bus, ly uint8) {
+	for b.Read8(0xff44) != ly {
+		p.Step(4)
+		h.Step(4)
+	}
+}
+
+func TestGeneralPurposeDMA(t *testing.T) {
+	_, c, _, b := newTestHDMA(t)
+	b.Write8(0xff40, 0) // LCD off to access VRAM any time
+
+	// The lower 4 bits of the addresses and the upper 3 bits of the destination are ignored
+	setAddresses(b, 0xc00f, 0xe10f)
+	b.Write8(0xff55, 0x02)
+
+	for i := uint16(0); i < 3*BlockLength; i++ {
+		if got := b.Read8(0x8100 + i); got != uint8(i) {
+			t.Fatalf("0x%04x = 0x%02x, want 0x%02x", 0x8100+i, got, uint8(i))
+		}
+	}
+	if got := b.Read8(0x8100 + 3*BlockLength); got != 0 {
+		t.Errorf("only 3 blocks should be transferred")
+	}
+	if c.stalled != 3*CyclesPerBlock {
+		t.Errorf("CPU stalled %d cycles, want %d", c.stalled, 3*CyclesPerBlock)
+	}
+	if got := b.Read8(0xff55); got != 0xff {
+		t.Errorf("HDMA5 = 0x%02x after the transfer, want 0xff", got)
+	}
+}
+
+func TestGeneralPurposeDMADoubleSpeed(t *testing.T) {
+	_, c, _, b := newTestHDMA(t)
+	c.doubleSpeed = true
+	setAddresses(b, 0xc000, 0x8000)
+	b.Write8(0xff55, 0x00)
+
+	if c.stalled != 2*CyclesPerBlock {
+		t.Errorf("CPU stalled %d cycles, want %d", c.stalled, 2*CyclesPerBlock)
+	}
+}
+
+func TestGeneralPurposeDMAStallOnPPU(t *testing.T) {
+	l := newTestLCD(t)
+	_, c, p, b := newTestHDMAWithLCD(t, l)
+
+	colors := [4]uint16{0x0001, 0x0002, 0x0003, 0x0004}
+	b.Write8(0xff68, 0x80)
+	for _, color := range colors {
+		b.Write8(0xff69, uint8(color))
+		b.Write8(0xff69, uint8(color>>8))
+	}
+
+	// The stall of 128 blocks spans about 9 lines, and is given to the PPU at once
+	setAddresses(b, 0xc000, 0x8000)
+	b.Write8(0xff55, 0x7f)
+	p.Step(c.stalled)
+
+	if got, want := b.Read8(0xff44), uint8(c.stalled/ppu.CyclesPerScanLine); got != want {
+		t.Errorf("LY = %d, want %d", got, want)
+	}
+	// Every line passed during the stall is rendered with tile 0
+	for y := 0; y < c.stalled/ppu.CyclesPerScanLine; y++ {
+		low, high := uint8(y*2), uint8(y*2+1)
+		for x := 0; x < lcd.ScreenWidth; x++ {
+			bit := 7 - x%8
+			colorID := (low>>bit)&1 | (high>>bit)&1<<1
+			if got := l.Screen[y][x]; got != colors[colorID] {
+				t.Fatalf("pixel (%d, %d) = 0x%04x, want 0x%04x", x, y, got, colors[colorID])
+			}
+		}
+	}
+
+	// VRAM is written even if the DMA starts while the PPU is drawing pixels
+	for b.Read8(0xff41)&0b11 != 3 {
+		p.Step(4)
+	}
+	setAddresses(b, 0xc000, 0x8800)
+	b.Write8(0xff55, 0x00)
+	for b.Read8(0xff41)&0b11 == 3 {
+		p.Step(4)
+	}
+	for i := uint16(0); i < BlockLength; i++ {
+		if got := b.Read8(0x8800 + i); got != uint8(i) {
+			t.Fatalf("0x%04x = 0x%02x, want 0x%02x", 0x8800+i, got, uint8(i))
+		}
+	}
+}
+
+func TestHBlankDMA(t *testing.T) {
+	h, c, p, b := newTestHDMA(t)
+	setAddresses(b, 0xc000, 0x8000)
+	b.Write8(0xff55, HBlankModeFlag|0x02)
+	if got := b.Read8(0xff55); got != 0x02 {
+		t.Errorf("HDMA5 = 0x%02x, want 0x02 while active", got)
+	}
+
+	for ly := uint8(1); ly <= 3; ly++ {
+		stepUntilLY(h, p, b, ly)
+		if c.stalled != int(ly)*CyclesPerBlock {
+			t.Fatalf("a block should be transferred per HBlank")
+		}
+	}
+	stepUntilLY(h, p, b, 5)
+	if c.stalled != 3*CyclesPerBlock {
+		t.Errorf("transfer should stop after 3 blocks")
+	}
+	if got := b.Read8(0xff55); got != 0xff {
+		t.Errorf("HDMA5 = 0x%02x after the transfer, want 0xff", got)
+	}
+
+	stepUntilLY(h, p, b, 144)
+	for i := uint16(0); i < 3*BlockLength; i++ {
+		if got := b.Read8(0x8000 + i); got != uint8(i) {
+			t.Fatalf("0x%04x = 0x%02x, want 0x%02x", 0x8000+i, got, uint8(i))
+		}
+	}
+}
+
+func TestHBlankDMACancel(t *testing.T) {
+	h, c, p, b := newTestHDMA(t)
+	setAddresses(b, 0xc000, 0x8000)
+	b.Write8(0xff55, HBlankModeFlag|0x03)
+
+	stepUntilLY(h, p, b, 1)
+	b.Write8(0xff55, 0x00)
+	if got := b.Read8(0xff55); got != 0x82 {
+		t.Errorf("HDMA5 = 0x%02x after cancel, want 0x82", got)
+	}
+
+	stepUntilLY(h, p, b, 3)
+	if c.stalled != CyclesPerBlock {
+		t.Errorf("cancelled transfer should not continue")
+	}
+}
+
+func TestDMGMode(t *testing.T) {
+	h, _, _, b := newTestHDMA(t)
+	h.cgbMode = false
+
+	b.Write8(0xff55, 0x00)
+	if got := b.Read8(0xff55); got != 0xff {
+		t.Errorf("HDMA5 = 0x%02x on DMG, want 0xff", got)
+	}
+}
@@ -0,0 +1,148 @@
+package joypad
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/d2verb/gemu/pkg/gameboy/bus"
+	"github.com/d2verb/gemu/pkg/gameboy/cpu"
+	"github.com/d2verb/gemu/pkg/log"
+)
+
+type Button uint8
+
+// The lower 4 buttons are the direction keys and the upper 4 buttons are the
+// action buttons. Both groups share the P10-P13 input lines in this order.
+const (
+	Right Button = iota
+	Left
+	Up
+	Down
+	A
+	B
+	Select
+	Start
+)
+
+// P1 bit flags
+const (
+	SelectDirectionFlag = 0b010000
+	SelectActionFlag    = 0b100000
+)
+
+func (b Button) String() string {
+	return map[Button]string{
+		Right:  "right",
+		Left:   "left",
+		Up:     "up",
+		Down:   "down",
+		A:      "a",
+		B:      "b",
+		Select: "select",
+		Start:  "start",
+	}[b]
+}
+
+func StringToButton(s string) (Button, error) {
+	for b := Right; b <= Start; b++ {
+		if b.String() == s {
+			return b, nil
+		}
+	}
+	return 0, fmt.Errorf("No corresponding button for %s", s)
+}
+
+type Joypad struct {
+	// Buttons are pressed and released from the GUI goroutine, so the state
+	// is shared through an atomic bit set (1 = pressed)
+	pressed   atomic.Uint32
+	selection uint8 // P1 bit 4-5 written by the CPU (0 = selected)
+	lines     uint8 // P10-P13 input lines seen in the last update (0 = low)
+	bus       *bus.Bus
+}
+
+func New() *Joypad {
+	return &Joypad{
+		selection: SelectDirectionFlag | SelectActionFlag,
+		lines:     0x0f,
+	}
+}
+
+func (j *Joypad) ConnectToBus(b *bus.Bus) error {
+	if err := b.Map(bus.NewAddressRange(0xff00, 0xff00), j); err != nil {
+		return err
+	}
+	j.bus = b
+	return nil
+}
+
+// Press and Release can be called from any goroutine. The change is seen by
+// the CPU on the next Step.
+func (j *Joypad) Press(b Button) {
+	for {
+		old := j.pressed.Load()
+		if j.pressed.CompareAndSwap(old, old|(1<<b)) {
+			return
+		}
+	}
+}
+
+func (j *Joypad) Release(b Button) {
+	for {
+		old := j.pressed.Load()
+		if j.pressed.CompareAndSwap(old, old&^(1<<b)) {
+			return
+		}
+	}
+}
+
+func (j *Joypad) Step(cycles int) {
+	j.update()
+}
+
+func (j *Joypad) Read8(address uint16) uint8 {
+	if address != 0xff00 {
+		log.Fatalf("Joypad cannot be accessed at 0x%04x", address)
+	}
+	j.update()
+
+	// Upper 2 bits are unused and always read as 1
+	return 0xc0 | j.selection | j.lines
+}
+
+func (j *Joypad) Read16(address uint16) uint16 {
+	log.Fatalf("Joypad cannot be accessed at 0x%04x", address+1)
+	return 0
+}
+
+func (j *Joypad) Write8(address uint16, data uint8) {
+	if address != 0xff00 {
+		log.Fatalf("Joypad cannot be accessed at 0x%04x", address)
+	}
+	j.selection = data & (SelectDirectionFlag | SelectActionFlag)
+	j.update()
+}
+
+func (j *Joypad) Write16(address uint16, data uint16) {
+	log.Fatalf("Joypad cannot be accessed at 0x%04x", address+1)
+}
+
+// update recomputes the input lines and requests the joypad interrupt if any
+// of them goes from high to low. The interrupt also brings the CPU back from
+// STOP mode.
+func (j *Joypad) update() {
+	pressed := (uint8)(j.pressed.Load())
+
+	var lines uint8 = 0x0f
+	if j.selection&SelectDirectionFlag == 0 {
+		lines &^= pressed & 0x0f
+	}
+	if j.selection&SelectActionFlag == 0 {
+		lines &^= pressed >> 4
+	}
+
+	if j.lines&^lines != 0 {
+		j.bus.SetIF(cpu.IntJoypad)
+	}
+	j.lines = lines
+}
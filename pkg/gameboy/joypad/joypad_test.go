@@ -0,0 +1,89 @@
+package joypad
+
+import (
+	"testing"
+
+	"github.com/d2verb/gemu/pkg/gameboy/bus"
+	"github.com/d2verb/gemu/pkg/gameboy/cpu"
+)
+
+func newTestJoypad(t *testing.T) (*Joypad, *bus.Bus) {
+	t.Helper()
+
+	b := bus.New()
+	if err := cpu.New().ConnectToBus(b); err != nil {
+		t.Fatal(err)
+	}
+	j := New()
+	if err := j.ConnectToBus(b); err != nil {
+		t.Fatal(err)
+	}
+	return j, b
+}
+
+func TestSelectLines(t *testing.T) {
+	j, b := newTestJoypad(t)
+	j.Press(Down)
+	j.Press(Start)
+
+	if got := b.Read8(0xff00); got != 0xff {
+		t.Errorf("P1 = 0x%02x with nothing selected, want 0xff", got)
+	}
+
+	b.Write8(0xff00, SelectActionFlag)
+	if got := b.Read8(0xff00); got != 0xe7 {
+		t.Errorf("P1 = 0x%02x with direction keys selected, want 0xe7", got)
+	}
+
+	b.Write8(0xff00, SelectDirectionFlag)
+	if got := b.Read8(0xff00); got != 0xd7 {
+		t.Errorf("P1 = 0x%02x with action buttons selected, want 0xd7", got)
+	}
+
+	j.Release(Start)
+	if got := b.Read8(0xff00); got != 0xdf {
+		t.Errorf("P1 = 0x%02x after release, want 0xdf", got)
+	}
+}
+
+func TestJoypadInterrupt(t *testing.T) {
+	j, b := newTestJoypad(t)
+	b.Write8(0xff00, SelectDirectionFlag)
+
+	j.Press(Up)
+	j.Step(4)
+	if b.Read8(0xff0f)&cpu.IntJoypad != 0 {
+		t.Errorf("unselected button must not request the interrupt")
+	}
+
+	j.Press(A)
+	j.Step(4)
+	if b.Read8(0xff0f)&cpu.IntJoypad == 0 {
+		t.Errorf("pressing a selected button should request the interrupt")
+	}
+
+	b.Write8(0xff0f, 0)
+	j.Release(A)
+	j.Step(4)
+	if b.Read8(0xff0f)&cpu.IntJoypad != 0 {
+		t.Errorf("releasing a button must not request the interrupt")
+	}
+
+	// Selecting a group with a pressed button also makes a line go low
+	b.Write8(0xff00, SelectActionFlag)
+	if b.Read8(0xff0f)&cpu.IntJoypad == 0 {
+		t.Errorf("selecting the direction keys should request the interrupt")
+	}
+}
+
+func TestStringToButton(t *testing.T) {
+	for b := Right; b <= Start; b++ {
+		got, err := StringToButton(b.String())
+		if err != nil || got != b {
+			t.Errorf("StringToButton(%q) = %v, %v", b.String(), got, err)
+		}
+	}
+	if _, err := StringToButton("turbo"); err == nil {
+		t.Errorf("StringToButton should fail for unknown button")
+	}
+}
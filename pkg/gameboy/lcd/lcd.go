@@ -7,10 +7,16 @@ const (
 	ScreenHeight = 144
 )
 
+// White is the blank pixel in CGB mode
+const White = 0x7fff
+
 type LCD struct {
 	sync.Mutex
 	Updated chan any
-	Screen  [ScreenHeight][ScreenWidth]uint8
+	// Raw pixels: shades (0 White - 3 Black) in DMG mode, RGB555 colors
+	// (0bbbbbgggggrrrrr) in CGB mode. Frontends convert them with a Palette.
+	Screen [ScreenHeight][ScreenWidth]uint16
+	cgb    bool
 }
 
 func New() *LCD {
@@ -18,3 +24,12 @@ func New() *LCD {
 		Updated: make(chan any),
 	}
 }
+
+// EnableCGBMode makes the screen hold RGB555 colors instead of shades
+func (l *LCD) EnableCGBMode() {
+	l.cgb = true
+}
+
+func (l *LCD) IsCGB() bool {
+	return l.cgb
+}
@@ -0,0 +1,46 @@
+package lcd
+
+import "testing"
+
+func TestRGB555(t *testing.T) {
+	if got := RGB555(0x7fff); got != (Color{0xff, 0xff, 0xff}) {
+		t.Errorf("white = %v", got)
+	}
+	if got := RGB555(0x001f); got != (Color{0xff, 0, 0}) {
+		t.Errorf("red = %v", got)
+	}
+	if got := RGB555(0x0200); got != (Color{0, 0x84, 0}) {
+		t.Errorf("green = %v", got)
+	}
+}
+
+func TestParsePalette(t *testing.T) {
+	p, err := ParsePalette("pocket")
+	if err != nil || p != PocketPalette {
+		t.Errorf("pocket palette should be found")
+	}
+
+	p, err = ParsePalette("e0f8d0, #88c070,346856,081820")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p[1] != (Color{0x88, 0xc0, 0x70}) || p[3] != (Color{0x08, 0x18, 0x20}) {
+		t.Errorf("user-defined palette = %v", p)
+	}
+
+	for _, s := range []string{"unknown", "e0f8d0,88c070,346856", "e0f8d0,88c070,346856,0818zz", "e0f8d0,88c070,346856,08182"} {
+		if _, err := ParsePalette(s); err == nil {
+			t.Errorf("ParsePalette(%q) should fail", s)
+		}
+	}
+}
+
+func TestPaletteColor(t *testing.T) {
+	p := DMGPalette
+	if got := p.Color(2, false); got != DMGPalette[2] {
+		t.Errorf("shade 2 = %v, want %v", got, DMGPalette[2])
+	}
+	if got := p.Color(0x001f, true); got != RGB555(0x001f) {
+		t.Errorf("CGB color should ignore the palette")
+	}
+}
@@ -0,0 +1,84 @@
+package lcd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Color is a pixel of the screen in 24-bit RGB
+type Color struct {
+	R uint8
+	G uint8
+	B uint8
+}
+
+// Gray returns the gray color of the brightness v
+func Gray(v uint8) Color {
+	return Color{v, v, v}
+}
+
+// RGB555 converts a 15-bit CGB color (0bbbbbgggggrrrrr) to 24-bit RGB
+func RGB555(c uint16) Color {
+	scale := func(v uint16) uint8 {
+		v &= 0x1f
+		return uint8(v<<3 | v>>2)
+	}
+	return Color{scale(c), scale(c >> 5), scale(c >> 10)}
+}
+
+// Palette gives the colors of the 4 shades of DMG, from White to Black
+type Palette [4]Color
+
+var (
+	GrayPalette = Palette{
+		Gray(0xff), Gray(0xaa), Gray(0x55), Gray(0x00),
+	}
+	// Green LCD of the original Game Boy
+	DMGPalette = Palette{
+		{0x9b, 0xbc, 0x0f}, {0x8b, 0xac, 0x0f}, {0x30, 0x62, 0x30}, {0x0f, 0x38, 0x0f},
+	}
+	// Black and white LCD of Game Boy Pocket
+	PocketPalette = Palette{
+		{0xc4, 0xcf, 0xa1}, {0x8b, 0x95, 0x6d}, {0x4d, 0x53, 0x3c}, {0x1f, 0x1f, 0x1f},
+	}
+)
+
+var palettes = map[string]Palette{
+	"gray":   GrayPalette,
+	"dmg":    DMGPalette,
+	"pocket": PocketPalette,
+}
+
+// ParsePalette returns the palette named "gray", "dmg" or "pocket", or a
+// user-defined palette given as 4 colors like "e0f8d0,88c070,346856,081820".
+func ParsePalette(s string) (Palette, error) {
+	if p, ok := palettes[s]; ok {
+		return p, nil
+	}
+
+	colors := strings.Split(s, ",")
+	if len(colors) != 4 {
+		return Palette{}, fmt.Errorf("Invalid palette %q", s)
+	}
+
+	var p Palette
+	for i, c := range colors {
+		c = strings.TrimPrefix(strings.TrimSpace(c), "#")
+		rgb, err := strconv.ParseUint(c, 16, 24)
+		if err != nil || len(c) != 6 {
+			return Palette{}, fmt.Errorf("Invalid color %q in palette", c)
+		}
+		p[i] = Color{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb)}
+	}
+	return p, nil
+}
+
+// Color converts a raw pixel of the screen. The palette only applies to DMG
+// shades, CGB colors are converted from RGB555 as they are.
+func (p *Palette) Color(pixel uint16, cgb bool) Color {
+	if cgb {
+		return RGB555(pixel)
+	}
+	return p[pixel&0b11]
+}
@@ -0,0 +1,112 @@
+package ppu
+
+import "github.com/d2verb/gemu/pkg/log"
+
+// BG map attribute bit flags (CGB only)
+const (
+	BGPaletteMask  = 0b111
+	BGTileBankFlag = 0b1000
+	BGXFlipFlag    = 0b100000
+	BGYFlipFlag    = 0b1000000
+	BGPriorityFlag = 0b10000000
+)
+
+// Palette specification (BCPS/OCPS) bit flags
+const (
+	PaletteIndexMask     = 0b111111
+	PaletteAutoIncrement = 0b10000000
+)
+
+// colorPalette is the 64 bytes of CGB palette memory, which holds 8 palettes of
+// 4 colors in RGB555. It is accessed through BCPS/BCPD or OCPS/OCPD.
+type colorPalette struct {
+	data [64]uint8
+	spec uint8
+}
+
+func (c *colorPalette) readData() uint8 {
+	return c.data[c.spec&PaletteIndexMask]
+}
+
+// writeData writes the data at the current index unless the palette memory is
+// locked, and increments the index if auto increment is enabled
+func (c *colorPalette) writeData(data uint8, locked bool) {
+	if !locked {
+		c.data[c.spec&PaletteIndexMask] = data
+	}
+	if c.spec&PaletteAutoIncrement != 0 {
+		c.spec = PaletteAutoIncrement | (c.spec+1)&PaletteIndexMask
+	}
+}
+
+// Color returns the color in RGB555
+func (c *colorPalette) Color(palette uint8, colorID uint8) uint16 {
+	i := palette*8 + colorID*2
+	// Bit 15 is unused
+	return (uint16(c.data[i+1])<<8 | uint16(c.data[i])) & 0x7fff
+}
+
+// EnableCGBMode enables VRAM banking, color palettes and BG map attributes
+func (p *PPU) EnableCGBMode() {
+	p.cgbMode = true
+	p.l.EnableCGBMode()
+	for i := range p.bgPalette.data {
+		p.bgPalette.data[i] = 0xff
+		p.objPalette.data[i] = 0xff
+	}
+}
+
+func (p *PPU) vramOffset(address uint16) int {
+	return int(p.vbk)*VRAMBankSize + int(address-p.vramRange.Start)
+}
+
+// CGB registers read 0xff and ignore writes on DMG
+func (p *PPU) readCGBRegister(address uint16) uint8 {
+	if !p.cgbMode {
+		return 0xff
+	}
+
+	switch address {
+	case 0xff4f:
+		return 0xfe | p.vbk
+	case 0xff68:
+		return p.bgPalette.spec | 0x40
+	case 0xff69:
+		if !p.vramAccessible() {
+			return 0xff
+		}
+		return p.bgPalette.readData()
+	case 0xff6a:
+		return p.objPalette.spec | 0x40
+	case 0xff6b:
+		if !p.vramAccessible() {
+			return 0xff
+		}
+		return p.objPalette.readData()
+	default:
+		log.Fatalf("PPU cannot be accessed at 0x%04x", address)
+	}
+	return 0
+}
+
+func (p *PPU) writeCGBRegister(address uint16, data uint8) {
+	if !p.cgbMode {
+		return
+	}
+
+	switch address {
+	case 0xff4f:
+		p.vbk = data & 1
+	case 0xff68:
+		p.bgPalette.spec = data & (PaletteAutoIncrement | PaletteIndexMask)
+	case 0xff69:
+		// Palette memory is locked during mode 3 as well as VRAM
+		p.bgPalette.writeData(data, !p.vramAccessible())
+	case 0xff6a:
+		p.objPalette.spec = data & (PaletteAutoIncrement | PaletteIndexMask)
+	case 0xff6b:
+		p.objPalette.writeData(data, !p.vramAccessible())
+	default:
+		log.Fatalf("PPU cannot be accessed at 0x%04x", address)
+	}
+}
@@ -0,0 +1,238 @@
+package ppu
+
+import (
+	"testing"
+
+	"github.com/d2verb/gemu/pkg/gameboy/bus"
+	"github.com/d2verb/gemu/pkg/gameboy/lcd"
+)
+
+// Colors in RGB555
+const (
+	testRed   uint16 = 0x001f
+	testGreen uint16 = 0x03e0
+	testBlue  uint16 = 0x7c00
+)
+
+func newTestCGBPPU(t *testing.T) (*PPU, *bus.Bus) {
+	t.Helper()
+
+	p, b := newTestPPU(t)
+	p.EnableCGBMode()
+	return p, b
+}
+
+// writePalette writes 4 colors to the palette via BCPS/BCPD or OCPS/OCPD
+func writePalette(b *bus.Bus, specAddress uint16, palette uint8, colors [4]uint16) {
+	b.Write8(specAddress, PaletteAutoIncrement|palette*8)
+	for _, c := range colors {
+		b.Write8(specAddress+1, uint8(c))
+		b.Write8(specAddress+1, uint8(c>>8))
+	}
+}
+
+func TestCGBRegistersOnDMG(t *testing.T) {
+	_, b := newTestPPU(t)
+	for _, address := range []uint16{0xff4f, 0xff68, 0xff69, 0xff6a, 0xff6b} {
+		b.Write8(address, 0)
+		if got := b.Read8(address); got != 0xff {
+			t.Errorf("0x%04x = 0x%02x on DMG, want 0xff", address, got)
+		}
+	}
+}
+
+func TestVRAMBanking(t *testing.T) {
+	p, b := newTestCGBPPU(t)
+
+	b.Write8(0x8000, 0x12)
+	b.Write8(0xff4f, 0xff)
+	if got := b.Read8(0xff4f); got != 0xff {
+		t.Errorf("VBK = 0x%02x, want 0xff", got)
+	}
+	b.Write8(0x8000, 0x34)
+
+	if p.readVRAMBank(0, 0x8000) != 0x12 || p.readVRAMBank(1, 0x8000) != 0x34 {
+		t.Errorf("VRAM banks are not switched")
+	}
+	b.Write8(0xff4f, 0)
+	if got := b.Read8(0x8000); got != 0x12 {
+		t.Errorf("0x8000 = 0x%02x in bank 0, want 0x12", got)
+	}
+}
+
+func TestPaletteMemory(t *testing.T) {
+	p, b := newTestCGBPPU(t)
+
+	writePalette(b, 0xff68, 7, [4]uint16{0x7fff, 0x001f, 0x03e0, 0x7c00})
+	if got := b.Read8(0xff68); got != 0xc0 {
+		t.Errorf("BCPS = 0x%02x, want 0xc0 after wrapping around", got)
+	}
+	if got := p.bgPalette.Color(7, 2); got != testGreen {
+		t.Errorf("BG palette 7 color 2 = %v, want %v", got, testGreen)
+	}
+
+	// Without auto increment, the index stays
+	b.Write8(0xff6a, 0x3e)
+	b.Write8(0xff6b, 0x11)
+	b.Write8(0xff6b, 0x22)
+	if got := b.Read8(0xff6a); got != 0x7e {
+		t.Errorf("OCPS = 0x%02x, want 0x7e", got)
+	}
+	if got := b.Read8(0xff6b); got != 0x22 {
+		t.Errorf("OCPD = 0x%02x, want 0x22", got)
+	}
+	b.Write8(0xff6a, 0x3f)
+	b.Write8(0xff6b, 0xff)
+	if got := p.objPalette.Color(7, 3); got != 0x7f22 {
+		t.Errorf("OBJ palette 7 color 3 = 0x%04x, want 0x7f22 without bit 15", got)
+	}
+
+	// Palette memory is locked in mode 3, but the index is still incremented
+	p.regs.SetSTAT(PixelTransferMode, true)
+	b.Write8(0xff68, PaletteAutoIncrement)
+	b.Write8(0xff69, 0x00)
+	if got := b.Read8(0xff69); got != 0xff {
+		t.Errorf("BCPD should not be readable in mode 3")
+	}
+	if got := b.Read8(0xff68); got != 0xc1 || p.bgPalette.data[0] != 0xff {
+		t.Errorf("BCPD write should be ignored in mode 3")
+	}
+}
+
+func TestCGBBGAttributes(t *testing.T) {
+	p, b := newTestCGBPPU(t)
+	writePalette(b, 0xff68, 0, [4]uint16{0x7fff, 0x7fff, 0x7fff, 0x7fff})
+	writePalette(b, 0xff68, 5, [4]uint16{0x7fff, testRed, testGreen, testBlue})
+
+	// Tile 1 in bank 1 has color 1 on the top-left pixel and color 3 elsewhere
+	b.Write8(0xff4f, 1)
+	for i := uint16(0); i < 16; i++ {
+		b.Write8(0x8010+i, 0xff)
+	}
+	b.Write8(0x8011, 0x7f)
+	// Tile 0 of the map uses tile 1 in bank 1 with palette 5 and both flips
+	b.Write8(0x9800, 5|BGTileBankFlag|BGXFlipFlag|BGYFlipFlag)
+	b.Write8(0xff4f, 0)
+	b.Write8(0x9800, 1)
+
+	if line := renderLine(p, 0); line[0] != testBlue || line[7] != testBlue {
+		t.Errorf("line 0 = %v, want blue", line[:8])
+	}
+	if line := renderLine(p, 7); line[7] != testRed || line[6] != testBlue {
+		t.Errorf("flipped top-left pixel should be at the bottom-right: %v", line[:8])
+	}
+}
+
+func TestCGBSpritePriority(t *testing.T) {
+	tests := []struct {
+		name     string
+		bgAttrs  uint8
+		objAttrs uint8
+		master   bool
+		want     uint16
+	}{
+		{"sprite above", 0, 0, true, testRed},
+		{"sprite behind BG", 0, OBJBGPriorityFlag, true, testGreen},
+		{"BG priority", BGPriorityFlag, 0, true, testGreen},
+		{"master priority off", BGPriorityFlag, OBJBGPriorityFlag, false, testRed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, b := newTestCGBPPU(t)
+			writePalette(b, 0xff68, 0, [4]uint16{0x7fff, testGreen, 0x7fff, 0x7fff})
+			writePalette(b, 0xff6a, 3, [4]uint16{0x7fff, testRed, 0x7fff, 0x7fff})
+			writeTile(b, 1, 0xff, 0x00) // color 1
+			b.Write8(0x9800, 1)
+			b.Write8(0xff4f, 1)
+			b.Write8(0x9800, tt.bgAttrs)
+			b.Write8(0xff4f, 0)
+			if !tt.master {
+				p.regs[lcdcOffset] &^= BGDisplayFlag
+			}
+			setSprite(p, 0, 16, 8, 1, 3|tt.objAttrs)
+
+			if got := renderLine(p, 0)[0]; got != tt.want {
+				t.Errorf("pixel = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCGBSpriteOAMPriority(t *testing.T) {
+	p, b := newTestCGBPPU(t)
+	writePalette(b, 0xff6a, 0, [4]uint16{0, testRed, 0, 0})
+	writePalette(b, 0xff6a, 1, [4]uint16{0, testBlue, 0, 0})
+	writeTile(b, 1, 0xff, 0x00)
+	b.Write8(0xff4f, 1)
+	writeTile(b, 1, 0xff, 0x00)
+	b.Write8(0xff4f, 0)
+
+	// OAM index wins over X on CGB, and bank 1 tiles are used with the flag
+	setSprite(p, 0, 16, 12, 1, 0)
+	setSprite(p, 1, 16, 8, 1, 1|OBJTileBankFlag)
+
+	line := renderLine(p, 0)
+	if line[4] != testRed || line[0] != testBlue {
+		t.Errorf("sprite with smaller OAM index should be drawn above: %v", line[:8])
+	}
+}
+
+func TestCGBPixelFIFOMatchesScanline(t *testing.T) {
+	setup := func(p *PPU, b *bus.Bus) {
+		p.EnableCGBMode()
+		p.regs[0] |= WinEnableFlag
+		p.regs.SetSCX(3)
+		p.regs.SetWY(60)
+		p.regs.SetWX(50)
+		for i := 0; i < 64; i++ {
+			b.Write8(0xff68, uint8(i))
+			b.Write8(0xff69, uint8(i*37))
+			b.Write8(0xff6a, uint8(i))
+			b.Write8(0xff6b, uint8(i*59))
+		}
+		for bank := uint8(0); bank < 2; bank++ {
+			b.Write8(0xff4f, bank)
+			for i := uint16(0); i < 0x2000; i++ {
+				b.Write8(0x8000+i, uint8(i*5+i/16+uint16(bank)))
+			}
+		}
+		b.Write8(0xff4f, 0)
+		for i := 0; i < 20; i++ {
+			setSprite(p, i, uint8(16+i*7), uint8(i*9), uint8(i), uint8(i*0x29))
+		}
+		// Overlapping sprites in descending X
+		for i := 20; i < 30; i++ {
+			setSprite(p, i, 120, uint8(200-i*6), uint8(i), uint8(i*0x13))
+		}
+	}
+
+	scanline, sb := newTestPPU(t)
+	setup(scanline, sb)
+	fifo, fb := newTestPPU(t)
+	fifo.EnablePixelFIFO()
+	setup(fifo, fb)
+
+	step(scanline, CyclesPerScanLine*lcd.ScreenHeight)
+	step(fifo, CyclesPerScanLine*lcd.ScreenHeight)
+
+	for y := 0; y < lcd.ScreenHeight; y++ {
+		if scanline.l.Screen[y] != fifo.l.Screen[y] {
+			t.Fatalf("line %d differs between the renderers", y)
+		}
+	}
+
+	// A sprite after one with larger X in OAM is still drawn
+	p, b := newTestCGBPPU(t)
+	p.EnablePixelFIFO()
+	writePalette(b, 0xff6a, 0, [4]uint16{0, testRed, 0, 0})
+	writePalette(b, 0xff6a, 1, [4]uint16{0, testBlue, 0, 0})
+	writeTile(b, 1, 0xff, 0x00)
+	setSprite(p, 0, 16, 100, 1, 0)
+	setSprite(p, 1, 16, 20, 1, 1)
+
+	step(p, CyclesPerScanLine)
+	if got := p.l.Screen[0][12]; got != testBlue {
+		t.Errorf("pixel = 0x%04x, want 0x%04x", got, testBlue)
+	}
+}
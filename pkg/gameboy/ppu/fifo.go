@@ -0,0 +1,278 @@
+package ppu
+
+import "github.com/d2verb/gemu/pkg/gameboy/lcd"
+
+// Mode 3 takes 172 dots at minimum, as the first tile is fetched twice (12 dots)
+// before 160 pixels are shifted out.
+const (
+	fifoStartupDots   = 6
+	spriteFetchDots   = 6
+	fetcherStepDots   = 2
+	fetcherFetchSteps = 3
+)
+
+// Steps of the pixel fetcher
+const (
+	fetchTileID = iota
+	fetchTileDataLow
+	fetchTileDataHigh
+	fetchPush
+)
+
+type pixelQueue struct {
+	pixels [16]pixel
+	head   int
+	size   int
+}
+
+func (q *pixelQueue) Len() int {
+	return q.size
+}
+
+func (q *pixelQueue) Clear() {
+	q.head = 0
+	q.size = 0
+}
+
+func (q *pixelQueue) Push(pixel pixel) {
+	q.pixels[(q.head+q.size)%len(q.pixels)] = pixel
+	q.size++
+}
+
+func (q *pixelQueue) Pop() pixel {
+	pixel := q.pixels[q.head]
+	q.head = (q.head + 1) % len(q.pixels)
+	q.size--
+	return pixel
+}
+
+func (q *pixelQueue) At(i int) *pixel {
+	return &q.pixels[(q.head+i)%len(q.pixels)]
+}
+
+// pixelFIFO renders a scanline dot by dot during mode 3, so mode 3 gets longer
+// with SCX fine scroll, window and sprites, and mid-scanline register writes
+// take effect on the following pixels.
+type pixelFIFO struct {
+	p *PPU
+
+	bgFIFO  pixelQueue
+	objFIFO pixelQueue
+
+	// Background/window fetcher
+	state    int
+	dots     int
+	progress int
+	tileX    uint8
+	tileID   uint8
+	attrs    uint8
+	tileLine [8]uint8
+	window   bool
+
+	x           int
+	discard     int
+	startup     int
+	sprites     []sprite
+	nextSprite  int
+	objStall    int
+	stalledTile int
+	windowDrawn bool
+	line        [lcd.ScreenWidth]uint16
+}
+
+func newPixelFIFO(p *PPU) *pixelFIFO {
+	return &pixelFIFO{p: p}
+}
+
+// start is called at the beginning of mode 3
+func (f *pixelFIFO) start() {
+	f.bgFIFO.Clear()
+	f.objFIFO.Clear()
+	f.resetFetcher()
+	f.window = false
+	f.x = 0
+	f.discard = int(f.p.regs.SCX() % 8)
+	f.startup = fifoStartupDots
+	f.sprites = f.p.searchOAM(f.p.regs.LY())
+	f.nextSprite = 0
+	f.objStall = 0
+	f.stalledTile = -1
+	f.windowDrawn = false
+}
+
+func (f *pixelFIFO) resetFetcher() {
+	f.state = fetchTileID
+	f.dots = 0
+	f.progress = 0
+	f.tileX = 0
+}
+
+// tick advances the FIFO by a dot, and returns true once the whole line has
+// been pushed to the LCD.
+func (f *pixelFIFO) tick() bool {
+	if f.x >= lcd.ScreenWidth {
+		return true
+	}
+
+	if f.startup > 0 {
+		f.startup--
+		return false
+	}
+
+	if f.objStall == 0 && f.discard == 0 {
+		f.startSpriteFetch()
+	}
+	if f.objStall > 0 {
+		f.objStall--
+		if f.objStall == 0 {
+			f.fetchSprite()
+		}
+		return false
+	}
+
+	f.shift()
+	f.fetch()
+
+	if f.x >= lcd.ScreenWidth {
+		f.finish()
+	}
+	return false
+}
+
+func (f *pixelFIFO) finish() {
+	if f.windowDrawn {
+		f.p.windowLine++
+	}
+
+	f.p.l.Lock()
+	f.p.l.Screen[f.p.regs.LY()] = f.line
+	f.p.l.Unlock()
+}
+
+// startSpriteFetch pauses the FIFO when a sprite begins at the current pixel.
+// The fetcher has to finish the current BG tile fetch before fetching the
+// first sprite on a tile.
+func (f *pixelFIFO) startSpriteFetch() {
+	if f.nextSprite >= len(f.sprites) || f.p.regs.LCDC(OBJEnableFlag) == 0 {
+		return
+	}
+	if int(f.sprites[f.nextSprite].x)-8 > f.x {
+		return
+	}
+
+	f.objStall = spriteFetchDots
+	tile := (f.x + int(f.p.regs.SCX())) / 8
+	if tile == f.stalledTile {
+		return
+	}
+	f.stalledTile = tile
+	if remaining := fetcherStepDots*fetcherFetchSteps - 1 - f.progress; remaining > 0 {
+		f.objStall += remaining
+	}
+}
+
+// fetchSprite overlays the sprite on the OBJ FIFO. Pixels already in the FIFO
+// belong to sprites with smaller X, so only transparent ones are replaced
+// except on CGB where a smaller OAM index wins.
+func (f *pixelFIFO) fetchSprite() {
+	s := f.sprites[f.nextSprite]
+	f.nextSprite++
+
+	for i, colorID := range f.p.spriteTileLine(s, f.p.regs.LY()) {
+		j := int(s.x) - 8 + i - f.x
+		if j < 0 {
+			continue
+		}
+		for f.objFIFO.Len() <= j {
+			f.objFIFO.Push(pixel{})
+		}
+		if f.p.spriteAbove(s, colorID, *f.objFIFO.At(j)) {
+			*f.objFIFO.At(j) = f.p.spritePixel(s, colorID)
+		}
+	}
+}
+
+func (f *pixelFIFO) fetch() {
+	f.progress++
+	if f.state != fetchPush {
+		f.dots++
+		if f.dots < fetcherStepDots {
+			return
+		}
+		f.dots = 0
+	}
+
+	ly := f.p.regs.LY()
+
+	switch f.state {
+	case fetchTileID:
+		var mapAddress uint16
+		if f.window {
+			row := uint16(f.p.windowLine / 8)
+			mapAddress = f.p.windowMapBase() + row*32 + uint16(f.tileX&31)
+		} else {
+			row := uint16((ly + f.p.regs.SCY()) / 8)
+			column := uint16((f.p.regs.SCX()/8 + f.tileX) & 31)
+			mapAddress = f.p.bgMapBase() + row*32 + column
+		}
+		f.tileID = f.p.readVRAM(mapAddress)
+		f.attrs = f.p.bgAttributes(mapAddress)
+		f.state = fetchTileDataLow
+	case fetchTileDataLow:
+		offsetY := (ly + f.p.regs.SCY()) % 8
+		if f.window {
+			offsetY = f.p.windowLine % 8
+		}
+		f.tileLine = f.p.bgTileLine(f.tileID, f.attrs, offsetY)
+		f.state = fetchTileDataHigh
+	case fetchTileDataHigh:
+		f.state = fetchPush
+		f.push()
+	case fetchPush:
+		f.push()
+	}
+}
+
+// push moves the fetched tile to the BG FIFO once it gets empty
+func (f *pixelFIFO) push() {
+	if f.bgFIFO.Len() != 0 {
+		return
+	}
+
+	for _, colorID := range f.tileLine {
+		f.bgFIFO.Push(bgPixel(colorID, f.attrs))
+	}
+	f.tileX++
+	f.state = fetchTileID
+	f.progress = 0
+}
+
+func (f *pixelFIFO) shift() {
+	// The fetcher restarts with the window tiles when the window begins
+	if !f.window && f.discard == 0 && f.p.windowEnabled() && f.x+WindowXOffset >= int(f.p.regs.WX()) {
+		f.window = true
+		f.windowDrawn = true
+		f.bgFIFO.Clear()
+		f.resetFetcher()
+		return
+	}
+
+	if f.bgFIFO.Len() == 0 {
+		return
+	}
+	bg := f.bgFIFO.Pop()
+
+	// SCX fine scroll discards the first pixels of the line
+	if f.discard > 0 {
+		f.discard--
+		return
+	}
+
+	var obj pixel
+	if f.objFIFO.Len() > 0 {
+		obj = f.objFIFO.Pop()
+	}
+
+	f.line[f.x] = f.p.mixPixel(bg, obj)
+	f.x++
+}
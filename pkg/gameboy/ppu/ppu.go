@@ -14,59 +14,180 @@ const (
 	CyclesPerHBlank        = 204
 	CyclesPerScanLine      = CyclesPerOAMSearch + CyclesPerPixelTransfer + CyclesPerHBlank
 	VBlankLines            = 10
+	VRAMBankSize           = 0x2000
+	CyclesPerFrame         = CyclesPerScanLine * (lcd.ScreenHeight + VBlankLines)
+	WindowXOffset          = 7
 )
 
+// Offsets of the registers in ioRange
+const (
+	lcdcOffset = 0
+	statOffset = 1
+	lyOffset   = 4
+	lycOffset  = 5
+)
+
+const dmaAddress = 0xff46
+
 type PPU struct {
-	regs     Registers
-	oam      [160]uint8
-	ioRange  bus.AddressRange
-	oamRange bus.AddressRange
-	cycles   int
-	l        *lcd.LCD
-	bus      *bus.Bus
+	regs      Registers
+	vram      [VRAMBankSize * 2]uint8
+	oam       [160]uint8
+	ioRange   bus.AddressRange
+	vramRange bus.AddressRange
+	oamRange  bus.AddressRange
+	cycles    int
+	// The first frame after the LCD is turned on is not displayed
+	skipFrame bool
+	// The window starts being drawn once LY == WY in a frame, and has its own
+	// line counter which only advances on the lines it is actually drawn
+	windowTriggered bool
+	windowLine      uint8
+	// STAT interrupt is requested on the rising edge of the OR of all the
+	// enabled sources, so a source can block the others
+	statLine bool
+	// Pixel FIFO renderer, nil when the scanline renderer is used
+	fifo *pixelFIFO
+	// CGB only registers
+	cgbMode      bool
+	vbk          uint8 // VRAM bank
+	bgPalette    colorPalette
+	objPalette   colorPalette
+	vbkRange     bus.AddressRange
+	paletteRange bus.AddressRange
+	l            *lcd.LCD
+	bus          *bus.Bus
 }
 
 func New(l *lcd.LCD) *PPU {
-	return &PPU{
-		ioRange:  bus.NewAddressRange(0xff40, 0xff4b),
-		oamRange: bus.NewAddressRange(0xfe00, 0xfe9f),
-		l:        l,
+	p := &PPU{
+		ioRange:      bus.NewAddressRange(0xff40, 0xff4b),
+		vramRange:    bus.NewAddressRange(0x8000, 0x9fff),
+		oamRange:     bus.NewAddressRange(0xfe00, 0xfe9f),
+		vbkRange:     bus.NewAddressRange(0xff4f, 0xff4f),
+		paletteRange: bus.NewAddressRange(0xff68, 0xff6b), // BCPS, BCPD, OCPS, OCPD
+		l:            l,
 	}
+
+	// Values left by the boot ROM
+	p.regs[lcdcOffset] = LCDEnableFlag | BGTileDataFlag | BGDisplayFlag
+	p.regs.SetBGP(0xfc)
+	return p
+}
+
+// EnablePixelFIFO switches from the scanline renderer to the pixel FIFO
+// renderer, which is slower but emulates mode 3 timing.
+func (p *PPU) EnablePixelFIFO() {
+	p.fifo = newPixelFIFO(p)
 }
 
 func (p *PPU) Step(cycles int) {
-	p.cycles += cycles
+	// The LCD still delivers blank frames while it is off to keep the pace
+	if p.regs.LCDC(LCDEnableFlag) == 0 {
+		p.cycles += cycles
+		if p.cycles >= CyclesPerFrame {
+			p.cycles -= CyclesPerFrame
+			p.l.Updated <- nil
+		}
+		return
+	}
 
-	if p.cycles >= CyclesPerScanLine {
-		p.cycles -= CyclesPerScanLine
-		p.regs.SetLY((p.regs.LY() + 1) % (lcd.ScreenHeight + VBlankLines))
+	if p.fifo != nil {
+		for ; cycles > 0; cycles-- {
+			p.stepDot()
+		}
+		return
+	}
 
-		if p.regs.LY() >= lcd.ScreenHeight {
-			p.ChangeMode(VBlankMode)
+	// Cycles are consumed up to the next mode transition at a time, so every
+	// line is rendered even if a DMA stall spans several lines
+	for cycles > 0 {
+		n := p.nextTransition() - p.cycles
+		if n > cycles {
+			n = cycles
+		}
+		p.cycles += n
+		cycles -= n
+
+		if p.cycles >= CyclesPerScanLine {
+			p.cycles -= CyclesPerScanLine
+			p.setLY((p.regs.LY() + 1) % (lcd.ScreenHeight + VBlankLines))
+
+			if p.regs.LY() >= lcd.ScreenHeight {
+				p.ChangeMode(VBlankMode)
+			}
+		}
+
+		if p.regs.LY() < lcd.ScreenHeight {
+			if p.cycles < CyclesPerOAMSearch {
+				// OAM Search
+				p.ChangeMode(OAMSearchMode)
+			} else if p.cycles < CyclesPerOAMSearch+CyclesPerPixelTransfer {
+				// Pixel Transfer
+				p.ChangeMode(PixelTransferMode)
+			} else {
+				// HBlank
+				p.ChangeMode(HBlankMode)
+			}
 		}
 	}
+}
 
+// nextTransition returns the cycle in the line where the next mode begins
+func (p *PPU) nextTransition() int {
+	if p.cycles < CyclesPerOAMSearch {
+		return CyclesPerOAMSearch
+	}
+	if p.cycles < CyclesPerOAMSearch+CyclesPerPixelTransfer {
+		return CyclesPerOAMSearch + CyclesPerPixelTransfer
+	}
+	return CyclesPerScanLine
+}
+
+func (p *PPU) stepDot() {
 	if p.regs.LY() < lcd.ScreenHeight {
-		if p.cycles < CyclesPerOAMSearch {
-			// OAM Search
+		if p.cycles == 0 {
 			p.ChangeMode(OAMSearchMode)
-		} else if p.cycles < CyclesPerPixelTransfer {
-			// Pixel Transfer
+		}
+		if p.cycles == CyclesPerOAMSearch {
 			p.ChangeMode(PixelTransferMode)
-		} else if p.cycles < CyclesPerHBlank {
-			// HBlank
+		}
+		if p.regs.STAT(ModeFlag) == PixelTransferMode && p.fifo.tick() {
 			p.ChangeMode(HBlankMode)
 		}
 	}
+
+	p.cycles++
+	if p.cycles == CyclesPerScanLine {
+		p.cycles = 0
+		p.setLY((p.regs.LY() + 1) % (lcd.ScreenHeight + VBlankLines))
+
+		if p.regs.LY() >= lcd.ScreenHeight {
+			p.ChangeMode(VBlankMode)
+		}
+	}
 }
 
 func (p *PPU) ConnectToBus(b *bus.Bus) error {
-	if err := b.Map(p.ioRange, p); err != nil {
+	// DMA (0xff46) is mapped by the OAM DMA device
+	if err := b.Map(bus.NewAddressRange(p.ioRange.Start, dmaAddress-1), p); err != nil {
+		return err
+	}
+	if err := b.Map(bus.NewAddressRange(dmaAddress+1, p.ioRange.End), p); err != nil {
+		return err
+	}
+	if err := b.Map(p.vramRange, p); err != nil {
 		return err
 	}
 	if err := b.Map(p.oamRange, p); err != nil {
 		return err
 	}
+	if err := b.Map(p.vbkRange, p); err != nil {
+		return err
+	}
+	if err := b.Map(p.paletteRange, p); err != nil {
+		return err
+	}
 	p.bus = b
 	return nil
 }
@@ -74,10 +195,23 @@ func (p *PPU) ConnectToBus(b *bus.Bus) error {
 func (p *PPU) Read8(address uint16) uint8 {
 	if p.ioRange.Contains(address) {
 		offset := address - p.ioRange.Start
+		if offset == statOffset {
+			return p.regs[offset] | 0x80
+		}
 		return p.regs[offset]
+	} else if p.vramRange.Contains(address) {
+		if !p.vramAccessible() {
+			return 0xff
+		}
+		return p.vram[p.vramOffset(address)]
 	} else if p.oamRange.Contains(address) {
+		if !p.oamAccessible() {
+			return 0xff
+		}
 		offset := address - p.oamRange.Start
 		return p.oam[offset]
+	} else if p.vbkRange.Contains(address) || p.paletteRange.Contains(address) {
+		return p.readCGBRegister(address)
 	} else {
 		log.Fatalf("PPU cannot be accessed at 0x%04x", address)
 	}
@@ -93,15 +227,95 @@ func (p *PPU) Read16(address uint16) uint16 {
 func (p *PPU) Write8(address uint16, data uint8) {
 	if p.ioRange.Contains(address) {
 		offset := address - p.ioRange.Start
-		p.regs[offset] = data
+		switch offset {
+		case lcdcOffset:
+			enabled := p.regs.LCDC(LCDEnableFlag) != 0
+			p.regs[offset] = data
+			if enabled && data&LCDEnableFlag == 0 {
+				p.turnOff()
+			} else if !enabled && data&LCDEnableFlag != 0 {
+				p.turnOn()
+			}
+		case statOffset:
+			// Mode and LYC=LY bits are read-only
+			p.regs[offset] = p.regs[offset]&(LYCFlag|ModeFlag) | data&^(LYCFlag|ModeFlag|0x80)
+			p.updateSTATLine()
+		case lyOffset:
+			// LY is read-only
+		case lycOffset:
+			p.regs[offset] = data
+			p.setLY(p.regs.LY())
+		default:
+			p.regs[offset] = data
+		}
+	} else if p.vramRange.Contains(address) {
+		if !p.vramAccessible() {
+			return
+		}
+		p.vram[p.vramOffset(address)] = data
 	} else if p.oamRange.Contains(address) {
+		if !p.oamAccessible() {
+			return
+		}
 		offset := address - p.oamRange.Start
 		p.oam[offset] = data
+	} else if p.vbkRange.Contains(address) || p.paletteRange.Contains(address) {
+		p.writeCGBRegister(address, data)
 	} else {
 		log.Fatalf("PPU cannot be accessed at 0x%04x", address)
 	}
 }
 
+// WriteOAM is used by OAM DMA, which can always access OAM
+func (p *PPU) WriteOAM(offset uint8, data uint8) {
+	p.oam[offset] = data
+}
+
+// WriteVRAM is used by HDMA, which can always access the current VRAM bank
+func (p *PPU) WriteVRAM(offset uint16, data uint8) {
+	p.vram[p.vramOffset(p.vramRange.Start+offset)] = data
+}
+
+// The CPU cannot access VRAM while the PPU is drawing pixels
+func (p *PPU) vramAccessible() bool {
+	return p.regs.LCDC(LCDEnableFlag) == 0 || p.regs.STAT(ModeFlag) != PixelTransferMode
+}
+
+// The CPU cannot access OAM while the PPU is searching or drawing sprites
+func (p *PPU) oamAccessible() bool {
+	mode := p.regs.STAT(ModeFlag)
+	return p.regs.LCDC(LCDEnableFlag) == 0 || mode == HBlankMode || mode == VBlankMode
+}
+
+// turnOff stops the PPU at the top of the screen in HBlank, and blanks the LCD
+func (p *PPU) turnOff() {
+	p.cycles = 0
+	p.regs.SetSTAT(ModeFlag, false)
+	p.regs.SetLY(0)
+	p.regs.SetSTAT(LYCFlag, p.regs.LYC() == 0)
+	p.statLine = false
+	p.windowTriggered = false
+	p.windowLine = 0
+	p.clearScreen()
+}
+
+// turnOn restarts the PPU from the beginning of the frame
+func (p *PPU) turnOn() {
+	p.cycles = 0
+	p.skipFrame = true
+	p.setLY(0)
+}
+
+func (p *PPU) clearScreen() {
+	p.l.Lock()
+	for y := range p.l.Screen {
+		for x := range p.l.Screen[y] {
+			p.l.Screen[y][x] = p.blankPixel()
+		}
+	}
+	p.l.Unlock()
+}
+
 func (p *PPU) Write16(address uint16, data uint16) {
 	hiByte := (uint8)(data >> 8)
 	loByte := (uint8)(data & 0xff)
@@ -110,26 +324,107 @@ func (p *PPU) Write16(address uint16, data uint16) {
 	p.Write8(address+1, hiByte)
 }
 
-func (p *PPU) renderBackground() {
-	var x uint8 = 0
+// pixel is a pixel of BG/window or sprites before the palette is applied
+type pixel struct {
+	colorID  uint8
+	palette  uint8 // OBP0/OBP1 for sprites on DMG, palette number (0-7) on CGB
+	priority bool  // BG-to-OBJ priority of the BG attributes or the sprite
+	index    int   // OAM index of the sprite, which decides the priority on CGB
+}
+
+func (p *PPU) renderScanline() {
+	bg := [lcd.ScreenWidth]pixel{}
+	obj := [lcd.ScreenWidth]pixel{}
+
+	p.renderBackground(&bg)
+	if p.regs.LCDC(OBJEnableFlag) != 0 {
+		p.renderSprites(&obj)
+	}
 
+	ly := p.regs.LY()
 	p.l.Lock()
+	for x := range p.l.Screen[ly] {
+		p.l.Screen[ly][x] = p.mixPixel(bg[x], obj[x])
+	}
+	p.l.Unlock()
+}
+
+func (p *PPU) renderBackground(line *[lcd.ScreenWidth]pixel) {
+	var x uint8 = 0
+	ly := p.regs.LY()
+	windowVisible := false
+
 	for ; x < lcd.ScreenWidth; x++ {
-		tileNumX := uint16((x + p.regs.SCX()) / 8)
-		tileNumY := uint16((p.regs.LY() + p.regs.SCY()) / 8)
-		tileNum := p.BGTileMap(tileNumY*32 + tileNumX)
+		var mapAddress uint16
+		var tileOffsetX, tileOffsetY uint8
+		if p.windowEnabled() && int(x)+WindowXOffset >= int(p.regs.WX()) {
+			windowVisible = true
+			windowX := uint8(int(x) + WindowXOffset - int(p.regs.WX()))
+			mapAddress = p.windowMapBase() + uint16(p.windowLine/8)*32 + uint16(windowX/8)
+			tileOffsetX = windowX % 8
+			tileOffsetY = p.windowLine % 8
+		} else {
+			tileNumX := uint16((x + p.regs.SCX()) / 8)
+			tileNumY := uint16((ly + p.regs.SCY()) / 8)
+			mapAddress = p.bgMapBase() + tileNumY*32 + tileNumX
+			tileOffsetX = (x + p.regs.SCX()) % 8
+			tileOffsetY = (ly + p.regs.SCY()) % 8
+		}
+
+		attrs := p.bgAttributes(mapAddress)
+		tileLine := p.bgTileLine(p.readVRAM(mapAddress), attrs, tileOffsetY)
+		line[x] = bgPixel(tileLine[tileOffsetX], attrs)
+	}
 
-		tileOffsetX := (x + p.regs.SCX()) % 8
-		tileOffsetY := (p.regs.LY() + p.regs.SCY()) % 8
+	if windowVisible {
+		p.windowLine++
+	}
+}
 
-		rawTileLine := p.BGTileData(tileNum, tileOffsetY)
-		tileLine := p.buildTileLine(rawTileLine)
+func (p *PPU) windowEnabled() bool {
+	return p.windowTriggered && p.regs.LCDC(WinEnableFlag) != 0 && p.regs.WX() < lcd.ScreenWidth+WindowXOffset
+}
 
-		p.l.Screen[p.regs.LY()][x] = (255 - tileLine[tileOffsetX]*85)
+func bgPixel(colorID uint8, attrs uint8) pixel {
+	return pixel{
+		colorID:  colorID,
+		palette:  attrs & BGPaletteMask,
+		priority: attrs&BGPriorityFlag != 0,
 	}
-	p.l.Unlock()
 }
 
+// mixPixel decides which of BG/window and sprites is visible, and applies the
+// palette.
+func (p *PPU) mixPixel(bg pixel, obj pixel) uint16 {
+	objVisible := obj.colorID != 0 && p.regs.LCDC(OBJEnableFlag) != 0
+
+	if p.cgbMode {
+		// LCDC bit 0 is the master priority on CGB, which lets sprites be always on top
+		if objVisible && (p.regs.LCDC(BGDisplayFlag) == 0 || bg.colorID == 0 || !bg.priority && !obj.priority) {
+			return p.objPalette.Color(obj.palette, obj.colorID)
+		}
+		return p.bgPalette.Color(bg.palette, bg.colorID)
+	}
+
+	// BG and window are blank (color 0) when disabled
+	var bgShade uint8
+	if p.regs.LCDC(BGDisplayFlag) == 0 {
+		bg.colorID = 0
+	} else {
+		bgShade = p.BGColor(bg.colorID)
+	}
+
+	if objVisible && !(obj.priority && bg.colorID != 0) {
+		palette := p.regs.OBP0()
+		if obj.palette == 1 {
+			palette = p.regs.OBP1()
+		}
+		return uint16(paletteColor(palette, obj.colorID))
+	}
+	return uint16(bgShade)
+}
+
+// buildTileLine decodes a line of 2bpp tile data into color IDs (0-3)
 func (p *PPU) buildTileLine(rawTileLine [2]uint8) [8]uint8 {
 	tile := [8]uint8{}
 
@@ -137,39 +432,129 @@ func (p *PPU) buildTileLine(rawTileLine [2]uint8) [8]uint8 {
 	hiLine := rawTileLine[1]
 
 	for j := 0; j < 8; j++ {
-		paletteID := (hiLine >> j) & 1
-		paletteID = (paletteID << 1) | ((loLine >> j) & 1)
+		colorID := (hiLine >> j) & 1
+		colorID = (colorID << 1) | ((loLine >> j) & 1)
 
-		tile[7-j] = p.BGColor(paletteID)
+		tile[7-j] = colorID
 	}
 
 	return tile
 }
 
+func flipTileLine(line [8]uint8) [8]uint8 {
+	for i := 0; i < 4; i++ {
+		line[i], line[7-i] = line[7-i], line[i]
+	}
+	return line
+}
+
 func (p *PPU) BGColor(paletteID uint8) uint8 {
+	return paletteColor(p.regs.BGP(), paletteID)
+}
+
+func paletteColor(palette uint8, paletteID uint8) uint8 {
 	var mask uint8 = 0b11 << (paletteID * 2)
-	return ((p.regs.BGP() & mask) >> (paletteID * 2)) & 0b11
+	return ((palette & mask) >> (paletteID * 2)) & 0b11
+}
+
+// blankPixel is shown while the LCD is off
+func (p *PPU) blankPixel() uint16 {
+	if p.cgbMode {
+		return lcd.White
+	}
+	return 0
 }
 
-func (p *PPU) BGTileData(tileID uint8, offsetY uint8) [2]uint8 {
-	var baseAddress uint16 = 0x8800
+// bgTileLine returns the color IDs of a line of the BG/window tile from left
+// to right, with the CGB attributes (bank and flips) applied.
+func (p *PPU) bgTileLine(tileID uint8, attrs uint8, offsetY uint8) [8]uint8 {
+	if attrs&BGYFlipFlag != 0 {
+		offsetY = 7 - offsetY
+	}
+	line := p.buildTileLine(p.BGTileData(tileID, offsetY, (attrs&BGTileBankFlag)>>3))
+	if attrs&BGXFlipFlag != 0 {
+		line = flipTileLine(line)
+	}
+	return line
+}
+
+func (p *PPU) BGTileData(tileID uint8, offsetY uint8, bank uint8) [2]uint8 {
+	// 0x8800 addressing mode uses 0x9000 as a base and a signed tile ID
+	baseAddress := uint16(0x9000 + int(int8(tileID))*16)
 	if p.regs.LCDC(BGTileDataFlag) != 0 {
-		baseAddress = 0x8000
+		baseAddress = 0x8000 + uint16(tileID)*16
 	}
-	baseAddress += uint16(tileID) * 16
 
 	return [2]uint8{
-		p.bus.Read8(baseAddress + uint16(offsetY*2)),
-		p.bus.Read8(baseAddress + uint16(offsetY*2+1)),
+		p.readVRAMBank(bank, baseAddress+uint16(offsetY*2)),
+		p.readVRAMBank(bank, baseAddress+uint16(offsetY*2+1)),
 	}
 }
 
-func (p *PPU) BGTileMap(offset uint16) uint8 {
-	var baseAddress uint16 = 0x9800
+func (p *PPU) bgMapBase() uint16 {
 	if p.regs.LCDC(BGTileMapFlag) != 0 {
-		baseAddress = 0x9c00
+		return 0x9c00
+	}
+	return 0x9800
+}
+
+func (p *PPU) windowMapBase() uint16 {
+	if p.regs.LCDC(WinTileMapFlag) != 0 {
+		return 0x9c00
+	}
+	return 0x9800
+}
+
+func (p *PPU) BGTileMap(offset uint16) uint8 {
+	return p.readVRAM(p.bgMapBase() + offset)
+}
+
+func (p *PPU) WindowTileMap(offset uint16) uint8 {
+	return p.readVRAM(p.windowMapBase() + offset)
+}
+
+// bgAttributes returns the CGB attributes of the tile at the map address,
+// which are stored in VRAM bank 1
+func (p *PPU) bgAttributes(mapAddress uint16) uint8 {
+	if !p.cgbMode {
+		return 0
+	}
+	return p.readVRAMBank(1, mapAddress)
+}
+
+// readVRAM is used by the PPU itself, which can always access VRAM
+func (p *PPU) readVRAM(address uint16) uint8 {
+	return p.readVRAMBank(0, address)
+}
+
+func (p *PPU) readVRAMBank(bank uint8, address uint16) uint8 {
+	return p.vram[int(bank)*VRAMBankSize+int(address-p.vramRange.Start)]
+}
+
+func (p *PPU) setLY(ly uint8) {
+	p.regs.SetLY(ly)
+	p.regs.SetSTAT(LYCFlag, ly == p.regs.LYC())
+	p.updateSTATLine()
+}
+
+func (p *PPU) updateSTATLine() {
+	var line bool
+	switch p.regs.STAT(ModeFlag) {
+	case HBlankMode:
+		line = p.regs.STAT(HBlankIntFlag) != 0
+	case VBlankMode:
+		line = p.regs.STAT(VBlankIntFlag) != 0
+	case OAMSearchMode:
+		line = p.regs.STAT(OAMIntFlag) != 0
+	}
+	if p.regs.STAT(LYCFlag) != 0 && p.regs.STAT(LYCIntFlag) != 0 {
+		line = true
+	}
+
+	if line && !p.statLine {
+		p.bus.SetIF(cpu.IntLCD)
 	}
-	return p.bus.Read8(baseAddress + offset)
+	p.statLine = line
 }
 
 func (p *PPU) ChangeMode(nextMode uint8) {
@@ -180,13 +565,28 @@ func (p *PPU) ChangeMode(nextMode uint8) {
 
 	p.regs.SetSTAT(currentMode, false)
 	p.regs.SetSTAT(nextMode, true)
+	p.updateSTATLine()
 
 	switch nextMode {
 	case OAMSearchMode:
+		if p.regs.LY() == p.regs.WY() {
+			p.windowTriggered = true
+		}
 	case PixelTransferMode:
+		if p.fifo != nil {
+			p.fifo.start()
+		}
 	case HBlankMode:
-		p.renderBackground()
+		if p.fifo == nil {
+			p.renderScanline()
+		}
 	case VBlankMode:
+		p.windowTriggered = false
+		p.windowLine = 0
+		if p.skipFrame {
+			p.skipFrame = false
+			p.clearScreen()
+		}
 		p.bus.SetIF(cpu.IntVBlank)
 		p.l.Updated <- nil
 	default:
@@ -0,0 +1,577 @@
+package ppu
+
+import (
+	"testing"
+
+	"github.com/d2verb/gemu/pkg/gameboy/bus"
+	"github.com/d2verb/gemu/pkg/gameboy/cpu"
+	"github.com/d2verb/gemu/pkg/gameboy/lcd"
+)
+
+func newTestPPU(t *testing.T) (*PPU, *bus.Bus) {
+	t.Helper()
+
+	b := bus.New()
+	if err := cpu.New().ConnectToBus(b); err != nil {
+		t.Fatal(err)
+	}
+	l := lcd.New()
+	go func() {
+		for range l.Updated {
+		}
+	}()
+	t.Cleanup(func() { close(l.Updated) })
+
+	p := New(l)
+	if err := p.ConnectToBus(b); err != nil {
+		t.Fatal(err)
+	}
+
+	p.regs[0] = LCDEnableFlag | BGDisplayFlag | OBJEnableFlag | BGTileDataFlag
+	p.regs.SetBGP(0b11100100)
+	p.regs.SetOBP0(0b11100100)
+	p.regs.SetOBP1(0b00011011)
+	return p, b
+}
+
+// writeTile fills every line of the tile with the pattern of color IDs
+func writeTile(b *bus.Bus, tileID uint8, lo uint8, hi uint8) {
+	for i := uint16(0); i < 8; i++ {
+		b.Write8(0x8000+uint16(tileID)*16+i*2, lo)
+		b.Write8(0x8000+uint16(tileID)*16+i*2+1, hi)
+	}
+}
+
+func setSprite(p *PPU, index int, y uint8, x uint8, tileID uint8, attrs uint8) {
+	p.oam[index*4] = y
+	p.oam[index*4+1] = x
+	p.oam[index*4+2] = tileID
+	p.oam[index*4+3] = attrs
+}
+
+func renderLine(p *PPU, ly uint8) [lcd.ScreenWidth]uint16 {
+	p.regs.SetLY(ly)
+	p.renderScanline()
+	return p.l.Screen[ly]
+}
+
+func TestSearchOAMLimit(t *testing.T) {
+	p, _ := newTestPPU(t)
+	for i := 0; i < 12; i++ {
+		setSprite(p, i, 16, uint8(100-i), 0, 0)
+	}
+
+	sprites := p.searchOAM(0)
+	if len(sprites) != MaxSpritesPerLine {
+		t.Fatalf("%d sprites selected, want %d", len(sprites), MaxSpritesPerLine)
+	}
+	// Sorted by X, the last 2 sprites in OAM are dropped
+	for i, s := range sprites {
+		if want := MaxSpritesPerLine - 1 - i; s.index != want {
+			t.Errorf("sprites[%d] is OAM #%d, want #%d", i, s.index, want)
+		}
+	}
+}
+
+func TestSearchOAMHeight(t *testing.T) {
+	p, _ := newTestPPU(t)
+	setSprite(p, 0, 16, 8, 0, 0)
+
+	if n := len(p.searchOAM(8)); n != 0 {
+		t.Errorf("8x8 sprite should not be on line 8")
+	}
+	p.regs[0] |= OBJSizeFlag
+	if n := len(p.searchOAM(15)); n != 1 {
+		t.Errorf("8x16 sprite should be on line 15")
+	}
+}
+
+func TestSpritePriority(t *testing.T) {
+	p, b := newTestPPU(t)
+	writeTile(b, 1, 0xff, 0x00) // color 1
+	writeTile(b, 2, 0x00, 0xff) // color 2
+
+	// Smaller X wins, and OAM index decides on a tie
+	setSprite(p, 0, 16, 12, 1, 0)
+	setSprite(p, 1, 16, 8, 2, 0)
+	setSprite(p, 2, 16, 30, 2, 0)
+	setSprite(p, 3, 16, 30, 1, 0)
+
+	line := renderLine(p, 0)
+	if line[4] != uint16(2) || line[8] != uint16(1) {
+		t.Errorf("sprite with smaller X should be drawn above")
+	}
+	if line[22] != uint16(2) {
+		t.Errorf("sprite with smaller OAM index should be drawn above")
+	}
+}
+
+func TestSpriteTransparencyAndPalette(t *testing.T) {
+	p, b := newTestPPU(t)
+	writeTile(b, 1, 0b11110000, 0b00000000)
+	setSprite(p, 0, 16, 8, 1, 0)
+	setSprite(p, 1, 16, 20, 1, OBJPaletteFlag)
+
+	line := renderLine(p, 0)
+	if line[0] != uint16(1) || line[4] != uint16(0) {
+		t.Errorf("OBP0 sprite is not drawn correctly: %v", line[:8])
+	}
+	if line[12] != uint16(2) {
+		t.Errorf("OBP1 sprite is not drawn correctly: %v", line[12:20])
+	}
+}
+
+func TestSpriteFlip(t *testing.T) {
+	p, b := newTestPPU(t)
+	// Only the top-left pixel is opaque
+	b.Write8(0x8010, 0x80)
+	b.Write8(0x8011, 0x80)
+	setSprite(p, 0, 16, 8, 1, OBJXFlipFlag|OBJYFlipFlag)
+
+	if line := renderLine(p, 7); line[7] != uint16(3) {
+		t.Errorf("flipped pixel should be at the bottom-right")
+	}
+	if line := renderLine(p, 0); line[0] != uint16(0) {
+		t.Errorf("top-left pixel should be transparent")
+	}
+}
+
+func TestSpriteBGPriority(t *testing.T) {
+	p, b := newTestPPU(t)
+	writeTile(b, 1, 0xff, 0xff) // color 3
+	// BG tile 2 has color 1 on the left half, and color 0 on the right half
+	writeTile(b, 2, 0xf0, 0x00)
+	b.Write8(0x9800, 2)
+
+	setSprite(p, 0, 16, 8, 1, OBJBGPriorityFlag)
+	// Hidden by sprite 0 even though sprite 0 itself is behind BG
+	setSprite(p, 1, 16, 9, 1, 0)
+
+	line := renderLine(p, 0)
+	if line[0] != uint16(1) {
+		t.Errorf("BG color 1-3 should be drawn over the sprite")
+	}
+	if line[1] != uint16(1) {
+		t.Errorf("sprite behind the first opaque sprite should not be drawn")
+	}
+	if line[4] != uint16(3) {
+		t.Errorf("sprite should be drawn over BG color 0")
+	}
+}
+
+func Test8x16Sprite(t *testing.T) {
+	p, b := newTestPPU(t)
+	p.regs[0] |= OBJSizeFlag
+	writeTile(b, 2, 0xff, 0x00)
+	writeTile(b, 3, 0x00, 0xff)
+	// Bit 0 of the tile ID is ignored
+	setSprite(p, 0, 16, 8, 3, 0)
+
+	if line := renderLine(p, 0); line[0] != uint16(1) {
+		t.Errorf("upper half should use the even tile")
+	}
+	if line := renderLine(p, 15); line[0] != uint16(2) {
+		t.Errorf("lower half should use the odd tile")
+	}
+}
+
+func TestBGSignedTileData(t *testing.T) {
+	p, b := newTestPPU(t)
+	p.regs[0] &^= BGTileDataFlag
+	b.Write8(0x9800, 0xff) // tile -1 at 0x8ff0
+	b.Write8(0x8ff0, 0xff)
+	b.Write8(0x8ff1, 0xff)
+
+	if line := renderLine(p, 0); line[0] != uint16(3) {
+		t.Errorf("tile data should be read from 0x8ff0")
+	}
+}
+
+// startLine latches the window Y condition as the PPU does in OAM search
+func startLine(p *PPU, ly uint8) {
+	p.regs.SetLY(ly)
+	p.regs.SetSTAT(ModeFlag, false)
+	p.ChangeMode(OAMSearchMode)
+}
+
+func newTestWindowPPU(t *testing.T) (*PPU, *bus.Bus) {
+	t.Helper()
+
+	p, b := newTestPPU(t)
+	p.regs[0] |= WinEnableFlag | WinTileMapFlag
+	writeTile(b, 1, 0xff, 0xff) // color 3
+	// Window map at 0x9c00 uses tile 1 only in the second row
+	for i := uint16(0); i < 32; i++ {
+		b.Write8(0x9c20+i, 1)
+	}
+	return p, b
+}
+
+func TestWindowPosition(t *testing.T) {
+	p, _ := newTestWindowPPU(t)
+	p.regs.SetWY(2)
+	p.regs.SetWX(WindowXOffset + 10)
+
+	for ly := uint8(0); ly < 2+8; ly++ {
+		startLine(p, ly)
+		if line := renderLine(p, ly); line[10] != uint16(0) {
+			t.Fatalf("window row 0 should be drawn at line %d", ly)
+		}
+	}
+
+	startLine(p, 10)
+	line := renderLine(p, 10)
+	if line[9] != uint16(0) || line[10] != uint16(3) {
+		t.Errorf("window should start at X = WX - 7")
+	}
+}
+
+func TestWindowLineCounter(t *testing.T) {
+	p, _ := newTestWindowPPU(t)
+	p.regs.SetWY(0)
+	p.regs.SetWX(WindowXOffset)
+
+	for ly := uint8(0); ly < 4; ly++ {
+		startLine(p, ly)
+		renderLine(p, ly)
+	}
+
+	// Window is disabled for a while, and the counter doesn't advance
+	p.regs[0] &^= WinEnableFlag
+	for ly := uint8(4); ly < 20; ly++ {
+		startLine(p, ly)
+		renderLine(p, ly)
+	}
+	p.regs[0] |= WinEnableFlag
+
+	// Lines 20-23 still show window row 0, and line 24 starts row 1
+	for ly := uint8(20); ly < 24; ly++ {
+		startLine(p, ly)
+		if line := renderLine(p, ly); line[0] != uint16(0) {
+			t.Errorf("window row 0 should be drawn at line %d", ly)
+		}
+	}
+	startLine(p, 24)
+	if line := renderLine(p, 24); line[0] != uint16(3) {
+		t.Errorf("window row 1 should be drawn at line 24")
+	}
+}
+
+func TestWindowWYLatch(t *testing.T) {
+	p, _ := newTestWindowPPU(t)
+	p.regs.SetWY(8)
+	p.regs.SetWX(WindowXOffset)
+
+	// WY is changed before LY reaches it, so the window never appears
+	startLine(p, 0)
+	p.regs.SetWY(0)
+	for ly := uint8(1); ly < 20; ly++ {
+		startLine(p, ly)
+		renderLine(p, ly)
+	}
+	if p.windowLine != 0 {
+		t.Errorf("window should not be drawn before LY == WY")
+	}
+
+	p.ChangeMode(VBlankMode)
+	startLine(p, 0)
+	renderLine(p, 0)
+	if p.windowLine != 1 {
+		t.Errorf("window should be drawn in the next frame")
+	}
+}
+
+// step advances the PPU by M-cycles as the CPU does
+func step(p *PPU, cycles int) {
+	for ; cycles > 0; cycles -= 4 {
+		p.Step(4)
+	}
+}
+
+func clearIF(b *bus.Bus) {
+	b.Write8(0xff0f, 0)
+}
+
+func statRequested(b *bus.Bus) bool {
+	return b.Read8(0xff0f)&cpu.IntLCD != 0
+}
+
+func TestSTATRegister(t *testing.T) {
+	p, b := newTestPPU(t)
+	p.regs.SetSTAT(ModeFlag, false)
+	p.ChangeMode(PixelTransferMode)
+
+	b.Write8(0xff41, 0xff)
+	if got := b.Read8(0xff41); got != 0xfb {
+		t.Errorf("STAT = 0x%02x, want 0xfb", got)
+	}
+	b.Write8(0xff41, 0x00)
+	if got := b.Read8(0xff41); got != 0x83 {
+		t.Errorf("STAT = 0x%02x, want 0x83", got)
+	}
+
+	b.Write8(0xff44, 0x12)
+	if got := b.Read8(0xff44); got != 0 {
+		t.Errorf("LY should be read-only")
+	}
+}
+
+func TestLYCInterrupt(t *testing.T) {
+	p, b := newTestPPU(t)
+	b.Write8(0xff41, LYCIntFlag)
+	b.Write8(0xff45, 3)
+	clearIF(b)
+
+	for i := 0; i < 3; i++ {
+		if statRequested(b) {
+			t.Fatalf("STAT interrupt requested at LY = %d", p.regs.LY())
+		}
+		step(p, CyclesPerScanLine)
+	}
+	if !statRequested(b) || b.Read8(0xff41)&LYCFlag == 0 {
+		t.Errorf("STAT interrupt should be requested at LY = LYC")
+	}
+
+	step(p, CyclesPerScanLine)
+	if b.Read8(0xff41)&LYCFlag != 0 {
+		t.Errorf("LYC=LY flag should be cleared")
+	}
+
+	// Writing LYC also compares it with LY
+	clearIF(b)
+	b.Write8(0xff45, 4)
+	if !statRequested(b) {
+		t.Errorf("STAT interrupt should be requested when LYC is written")
+	}
+}
+
+func TestModeInterrupts(t *testing.T) {
+	tests := []struct {
+		name   string
+		flag   uint8
+		cycles int
+	}{
+		{"OAM", OAMIntFlag, CyclesPerScanLine},
+		{"HBlank", HBlankIntFlag, CyclesPerOAMSearch + CyclesPerPixelTransfer},
+		{"VBlank", VBlankIntFlag, CyclesPerScanLine * lcd.ScreenHeight},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, b := newTestPPU(t)
+			b.Write8(0xff41, tt.flag)
+			step(p, 4)
+			clearIF(b)
+
+			step(p, tt.cycles-8)
+			if statRequested(b) {
+				t.Fatalf("STAT interrupt requested too early")
+			}
+			step(p, 4)
+			if !statRequested(b) {
+				t.Errorf("STAT interrupt should be requested")
+			}
+		})
+	}
+}
+
+func TestSTATBlocking(t *testing.T) {
+	p, b := newTestPPU(t)
+	b.Write8(0xff41, HBlankIntFlag|LYCIntFlag)
+	b.Write8(0xff45, 1)
+	step(p, CyclesPerOAMSearch+CyclesPerPixelTransfer)
+	clearIF(b)
+
+	// The line stays high from HBlank of line 0 into LY = LYC of line 1
+	step(p, CyclesPerScanLine-CyclesPerOAMSearch-CyclesPerPixelTransfer)
+	if statRequested(b) {
+		t.Errorf("LYC interrupt should be blocked by HBlank")
+	}
+
+	// The line is kept high by LYC through line 1 so HBlank is blocked too
+	step(p, CyclesPerOAMSearch+CyclesPerPixelTransfer)
+	if statRequested(b) {
+		t.Errorf("HBlank interrupt should be blocked by LYC")
+	}
+}
+
+// mode3Length steps a scanline dot by dot and counts the dots in mode 3
+func mode3Length(p *PPU) int {
+	length := 0
+	for i := 0; i < CyclesPerScanLine; i++ {
+		p.Step(1)
+		if p.regs.STAT(ModeFlag) == PixelTransferMode {
+			length++
+		}
+	}
+	return length
+}
+
+func TestPixelFIFOMode3Length(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(p *PPU)
+		want  int
+	}{
+		{"minimum", func(p *PPU) {}, 172},
+		{"SCX", func(p *PPU) { p.regs.SetSCX(3) }, 175},
+		{"window", func(p *PPU) {
+			p.regs[0] |= WinEnableFlag
+			p.regs.SetWX(WindowXOffset + 80)
+		}, 178},
+		{"sprite", func(p *PPU) { setSprite(p, 0, 16, 8, 0, 0) }, 183},
+		{"unaligned sprite", func(p *PPU) { setSprite(p, 0, 16, 8+5, 0, 0) }, 178},
+		{"sprites on a tile", func(p *PPU) {
+			setSprite(p, 0, 16, 16, 0, 0)
+			setSprite(p, 1, 16, 16, 0, 0)
+		}, 189},
+		{"sprite disabled", func(p *PPU) {
+			setSprite(p, 0, 16, 8, 0, 0)
+			p.regs[0] &^= OBJEnableFlag
+		}, 172},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newTestPPU(t)
+			p.EnablePixelFIFO()
+			tt.setup(p)
+
+			if got := mode3Length(p); got != tt.want {
+				t.Errorf("mode 3 length = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPixelFIFOMidScanlineWrite(t *testing.T) {
+	p, b := newTestPPU(t)
+	p.EnablePixelFIFO()
+	writeTile(b, 0, 0xff, 0x00) // color 1
+
+	// Pixel 0 is shifted out at dot 80 + 12
+	p.Step(CyclesPerOAMSearch + 12 + 100)
+	p.regs.SetBGP(0b00001000)
+	p.Step(CyclesPerScanLine - CyclesPerOAMSearch - 12 - 100)
+
+	line := p.l.Screen[0]
+	if line[99] != uint16(1) || line[100] != uint16(2) {
+		t.Errorf("BGP write should take effect at pixel 100: %v", line[98:102])
+	}
+}
+
+func TestPixelFIFOMatchesScanline(t *testing.T) {
+	setup := func(p *PPU, b *bus.Bus) {
+		p.regs[0] |= WinEnableFlag | OBJSizeFlag
+		p.regs.SetSCX(13)
+		p.regs.SetSCY(5)
+		p.regs.SetWY(40)
+		p.regs.SetWX(90)
+		for i := uint16(0); i < 0x1800; i++ {
+			b.Write8(0x8000+i, uint8(i*7+i/16))
+		}
+		for i := uint16(0); i < 0x800; i++ {
+			b.Write8(0x9800+i, uint8(i*3))
+		}
+		for i := 0; i < 15; i++ {
+			setSprite(p, i, uint8(16+i*9), uint8(i*11), uint8(i), uint8(i*0x30)&0xf0)
+		}
+	}
+
+	scanline, sb := newTestPPU(t)
+	setup(scanline, sb)
+	fifo, fb := newTestPPU(t)
+	fifo.EnablePixelFIFO()
+	setup(fifo, fb)
+
+	step(scanline, CyclesPerScanLine*lcd.ScreenHeight)
+	step(fifo, CyclesPerScanLine*lcd.ScreenHeight)
+
+	for y := 0; y < lcd.ScreenHeight; y++ {
+		if scanline.l.Screen[y] != fifo.l.Screen[y] {
+			t.Fatalf("line %d differs between the renderers", y)
+		}
+	}
+}
+
+func TestLCDOff(t *testing.T) {
+	p, b := newTestPPU(t)
+	b.Write8(0xff45, 0)
+	step(p, CyclesPerScanLine*3+CyclesPerOAMSearch+8)
+	if p.regs.LY() != 3 || p.regs.STAT(ModeFlag) != PixelTransferMode {
+		t.Fatalf("PPU should be drawing line 3")
+	}
+
+	b.Write8(0xff40, p.regs.LCDC(0xff)&^LCDEnableFlag)
+	step(p, CyclesPerScanLine*3)
+	if got := b.Read8(0xff44); got != 0 {
+		t.Errorf("LY = %d, want 0", got)
+	}
+	if got := b.Read8(0xff41); got&ModeFlag != HBlankMode || got&LYCFlag == 0 {
+		t.Errorf("STAT = 0x%02x, want HBlank with LYC=LY", got)
+	}
+	if p.l.Screen[0][0] != uint16(0) {
+		t.Errorf("screen should be blank")
+	}
+}
+
+func TestLCDOnSkipsFirstFrame(t *testing.T) {
+	p, b := newTestPPU(t)
+	b.Write8(0xff40, p.regs.LCDC(0xff)&^LCDEnableFlag)
+	writeTile(b, 0, 0xff, 0xff)
+	b.Write8(0xff40, p.regs.LCDC(0xff)|LCDEnableFlag)
+
+	step(p, CyclesPerScanLine*lcd.ScreenHeight)
+	if p.l.Screen[0][0] != uint16(0) {
+		t.Errorf("first frame should not be displayed")
+	}
+
+	step(p, CyclesPerFrame)
+	if p.l.Screen[0][0] != uint16(3) {
+		t.Errorf("second frame should be displayed")
+	}
+}
+
+func TestVRAMAndOAMBlocking(t *testing.T) {
+	tests := []struct {
+		mode uint8
+		vram bool
+		oam  bool
+	}{
+		{HBlankMode, true, true},
+		{VBlankMode, true, true},
+		{OAMSearchMode, true, false},
+		{PixelTransferMode, false, false},
+	}
+
+	for _, tt := range tests {
+		p, b := newTestPPU(t)
+		p.regs.SetSTAT(ModeFlag, false)
+		p.regs.SetSTAT(tt.mode, true)
+
+		b.Write8(0x8000, 0x12)
+		b.Write8(0xfe00, 0x34)
+		p.regs.SetSTAT(ModeFlag, false)
+		if got := p.vram[0] == 0x12; got != tt.vram {
+			t.Errorf("mode %d: VRAM write accessible = %v, want %v", tt.mode, got, tt.vram)
+		}
+		if got := p.oam[0] == 0x34; got != tt.oam {
+			t.Errorf("mode %d: OAM write accessible = %v, want %v", tt.mode, got, tt.oam)
+		}
+
+		p.vram[0], p.oam[0] = 0x12, 0x34
+		p.regs.SetSTAT(tt.mode, true)
+		if got := b.Read8(0x8000) == 0x12; got != tt.vram {
+			t.Errorf("mode %d: VRAM read accessible = %v, want %v", tt.mode, got, tt.vram)
+		}
+		if got := b.Read8(0xfe00) == 0x34; got != tt.oam {
+			t.Errorf("mode %d: OAM read accessible = %v, want %v", tt.mode, got, tt.oam)
+		}
+
+		// Everything is accessible while the LCD is off
+		p.regs[lcdcOffset] &^= LCDEnableFlag
+		if b.Read8(0x8000) != 0x12 || b.Read8(0xfe00) != 0x34 {
+			t.Errorf("mode %d: VRAM and OAM should be accessible while the LCD is off", tt.mode)
+		}
+	}
+}
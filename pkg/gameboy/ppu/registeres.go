@@ -16,7 +16,12 @@ const (
 
 // LCD status bit flags
 const (
-	ModeFlag = 0b11
+	ModeFlag      = 0b11
+	LYCFlag       = 0b100
+	HBlankIntFlag = 0b1000
+	VBlankIntFlag = 0b10000
+	OAMIntFlag    = 0b100000
+	LYCIntFlag    = 0b1000000
 )
 
 // LCD mode types
@@ -67,6 +72,14 @@ func (r *Registers) SetLY(data uint8) {
 	r[4] = data
 }
 
+func (r *Registers) LYC() uint8 {
+	return r[5]
+}
+
+func (r *Registers) SetLYC(data uint8) {
+	r[5] = data
+}
+
 // BGP - BG Palette Data
 //
 // Bit 7-6 - Shade for Color Number 3
@@ -87,3 +100,41 @@ func (r *Registers) BGP() uint8 {
 func (r *Registers) SetBGP(data uint8) {
 	r[7] = data
 }
+
+// OBP0/OBP1 - Object Palette 0/1 Data
+//
+// Same as BGP, but the lower two bits are ignored because color number 0 is
+// transparent for sprites.
+func (r *Registers) OBP0() uint8 {
+	return r[8]
+}
+
+func (r *Registers) SetOBP0(data uint8) {
+	r[8] = data
+}
+
+func (r *Registers) OBP1() uint8 {
+	return r[9]
+}
+
+func (r *Registers) SetOBP1(data uint8) {
+	r[9] = data
+}
+
+// WY - Window Y Position
+func (r *Registers) WY() uint8 {
+	return r[10]
+}
+
+func (r *Registers) SetWY(data uint8) {
+	r[10] = data
+}
+
+// WX - Window X Position plus 7
+func (r *Registers) WX() uint8 {
+	return r[11]
+}
+
+func (r *Registers) SetWX(data uint8) {
+	r[11] = data
+}
@@ -0,0 +1,140 @@
+package ppu
+
+import (
+	"sort"
+
+	"github.com/d2verb/gemu/pkg/gameboy/lcd"
+)
+
+const (
+	MaxSpritesPerLine = 10
+	SpriteCount       = 40
+)
+
+// OAM attribute bit flags
+const (
+	OBJCGBPaletteMask = 0b111  // CGB only
+	OBJTileBankFlag   = 0b1000 // CGB only
+	OBJPaletteFlag    = 0b10000
+	OBJXFlipFlag      = 0b100000
+	OBJYFlipFlag      = 0b1000000
+	OBJBGPriorityFlag = 0b10000000
+)
+
+type sprite struct {
+	y      uint8
+	x      uint8
+	tileID uint8
+	attrs  uint8
+	index  int
+}
+
+func (p *PPU) spriteHeight() uint8 {
+	if p.regs.LCDC(OBJSizeFlag) != 0 {
+		return 16
+	}
+	return 8
+}
+
+// searchOAM returns the sprites on the line ly sorted by X (or OAM index on a
+// tie), which is the drawing priority order on DMG. Only the first 10 sprites
+// in OAM which overlap the line are selected.
+func (p *PPU) searchOAM(ly uint8) []sprite {
+	height := int(p.spriteHeight())
+	sprites := make([]sprite, 0, MaxSpritesPerLine)
+
+	for i := 0; i < SpriteCount && len(sprites) < MaxSpritesPerLine; i++ {
+		s := sprite{
+			y:      p.oam[i*4],
+			x:      p.oam[i*4+1],
+			tileID: p.oam[i*4+2],
+			attrs:  p.oam[i*4+3],
+			index:  i,
+		}
+
+		top := int(s.y) - 16
+		if int(ly) >= top && int(ly) < top+height {
+			sprites = append(sprites, s)
+		}
+	}
+
+	sort.SliceStable(sprites, func(i, j int) bool {
+		return sprites[i].x < sprites[j].x
+	})
+
+	return sprites
+}
+
+// renderSprites fills the line with the sprite pixels. The first opaque sprite
+// pixel hides the pixels of the sprites behind it even if it is hidden by BG
+// itself.
+func (p *PPU) renderSprites(line *[lcd.ScreenWidth]pixel) {
+	ly := p.regs.LY()
+
+	for _, s := range p.searchOAM(ly) {
+		for i, colorID := range p.spriteTileLine(s, ly) {
+			x := int(s.x) - 8 + i
+			if x < 0 || x >= len(line) || !p.spriteAbove(s, colorID, line[x]) {
+				continue
+			}
+			line[x] = p.spritePixel(s, colorID)
+		}
+	}
+}
+
+// spriteAbove reports whether the sprite pixel replaces the sprite pixel drawn
+// before. Sprites are drawn in X order, so the drawn pixel wins on DMG, while
+// a smaller OAM index wins on CGB.
+func (p *PPU) spriteAbove(s sprite, colorID uint8, drawn pixel) bool {
+	if drawn.colorID == 0 {
+		return true
+	}
+	return p.cgbMode && colorID != 0 && s.index < drawn.index
+}
+
+func (p *PPU) spritePixel(s sprite, colorID uint8) pixel {
+	palette := (s.attrs & OBJPaletteFlag) >> 4
+	if p.cgbMode {
+		palette = s.attrs & OBJCGBPaletteMask
+	}
+	return pixel{
+		colorID:  colorID,
+		palette:  palette,
+		priority: s.attrs&OBJBGPriorityFlag != 0,
+		index:    s.index,
+	}
+}
+
+// spriteTileLine returns the color IDs of the sprite on the line ly from left
+// to right, with the flips applied.
+func (p *PPU) spriteTileLine(s sprite, ly uint8) [8]uint8 {
+	height := p.spriteHeight()
+	row := ly + 16 - s.y
+	if s.attrs&OBJYFlipFlag != 0 {
+		row = height - 1 - row
+	}
+
+	tileID := s.tileID
+	if height == 16 {
+		tileID &= 0xfe
+	}
+	var bank uint8
+	if p.cgbMode {
+		bank = (s.attrs & OBJTileBankFlag) >> 3
+	}
+	tileLine := p.buildTileLine(p.OBJTileData(tileID, row, bank))
+
+	if s.attrs&OBJXFlipFlag != 0 {
+		tileLine = flipTileLine(tileLine)
+	}
+	return tileLine
+}
+
+// OBJTileData always uses 0x8000 addressing mode.
+func (p *PPU) OBJTileData(tileID uint8, offsetY uint8, bank uint8) [2]uint8 {
+	address := 0x8000 + uint16(tileID)*16 + uint16(offsetY)*2
+	return [2]uint8{
+		p.readVRAMBank(bank, address),
+		p.readVRAMBank(bank, address+1),
+	}
+}
@@ -5,27 +5,37 @@ import (
 	"github.com/d2verb/gemu/pkg/log"
 )
 
+const (
+	WRAMBankSize  = 0x1000
+	WRAMBankCount = 8 // Bank 0 and switchable banks 1-7 (banks 2-7 are CGB only)
+)
+
 type RAM struct {
-	ram       [0x407f]uint8 // 8KB Video RAM and 8KB Work RAM
-	vramRange bus.AddressRange
+	wram      [WRAMBankSize * WRAMBankCount]uint8
+	hram      [0x7f]uint8
+	svbk      uint8 // WRAM bank at 0xd000-0xdfff (CGB only)
+	cgbMode   bool
 	wramRange bus.AddressRange
 	eramRange bus.AddressRange
 	hramRange bus.AddressRange
+	svbkRange bus.AddressRange
 }
 
 func New() *RAM {
 	return &RAM{
-		vramRange: bus.NewAddressRange(0x8000, 0x9fff),
 		wramRange: bus.NewAddressRange(0xc000, 0xdfff),
 		eramRange: bus.NewAddressRange(0xe000, 0xfdff),
 		hramRange: bus.NewAddressRange(0xff80, 0xfffe),
+		svbkRange: bus.NewAddressRange(0xff70, 0xff70),
 	}
 }
 
+// EnableCGBMode makes WRAM banks 1-7 switchable via SVBK (0xff70)
+func (r *RAM) EnableCGBMode() {
+	r.cgbMode = true
+}
+
 func (r *RAM) ConnectToBus(b *bus.Bus) error {
-	if err := b.Map(r.vramRange, r); err != nil {
-		return err
-	}
 	if err := b.Map(r.wramRange, r); err != nil {
 		return err
 	}
@@ -35,22 +45,42 @@ func (r *RAM) ConnectToBus(b *bus.Bus) error {
 	if err := b.Map(r.hramRange, r); err != nil {
 		return err
 	}
+	if err := b.Map(r.svbkRange, r); err != nil {
+		return err
+	}
 	return nil
 }
 
+// wramOffset maps 0xc000-0xdfff to the current banks
+func (r *RAM) wramOffset(offset uint16) int {
+	if offset < WRAMBankSize {
+		return int(offset)
+	}
+
+	// Bank 0 cannot be selected and is treated as bank 1
+	bank := int(r.svbk & 0b111)
+	if bank == 0 {
+		bank = 1
+	}
+	return bank*WRAMBankSize + int(offset-WRAMBankSize)
+}
+
 func (r *RAM) Read8(address uint16) uint8 {
-	if r.vramRange.Contains(address) {
-		offset := address - r.vramRange.Start
-		return r.ram[offset]
-	} else if r.wramRange.Contains(address) {
-		offset := address - r.wramRange.Start + 0x2000
-		return r.ram[offset]
+	if r.wramRange.Contains(address) {
+		offset := address - r.wramRange.Start
+		return r.wram[r.wramOffset(offset)]
 	} else if r.eramRange.Contains(address) {
+		// Echo RAM mirrors Work RAM
 		offset := address - r.eramRange.Start
-		return r.ram[offset]
+		return r.wram[r.wramOffset(offset)]
 	} else if r.hramRange.Contains(address) {
-		offset := address - r.hramRange.Start + 0x4000
-		return r.ram[offset]
+		offset := address - r.hramRange.Start
+		return r.hram[offset]
+	} else if r.svbkRange.Contains(address) {
+		if !r.cgbMode {
+			return 0xff
+		}
+		return 0xf8 | r.svbk
 	} else {
 		log.Fatalf("RAM cannot be accessed at 0x%04x", address)
 	}
@@ -64,18 +94,20 @@ func (r *RAM) Read16(address uint16) uint16 {
 }
 
 func (r *RAM) Write8(address uint16, data uint8) {
-	if r.vramRange.Contains(address) {
-		offset := address - r.vramRange.Start
-		r.ram[offset] = data
-	} else if r.wramRange.Contains(address) {
-		offset := address - r.wramRange.Start + 0x2000
-		r.ram[offset] = data
+	if r.wramRange.Contains(address) {
+		offset := address - r.wramRange.Start
+		r.wram[r.wramOffset(offset)] = data
 	} else if r.eramRange.Contains(address) {
+		// Echo RAM mirrors Work RAM
 		offset := address - r.eramRange.Start
-		r.ram[offset] = data
+		r.wram[r.wramOffset(offset)] = data
 	} else if r.hramRange.Contains(address) {
-		offset := address - r.hramRange.Start + 0x4000
-		r.ram[offset] = data
+		offset := address - r.hramRange.Start
+		r.hram[offset] = data
+	} else if r.svbkRange.Contains(address) {
+		if r.cgbMode {
+			r.svbk = data & 0b111
+		}
 	} else {
 		log.Fatalf("RAM cannot be accessed at 0x%04x", address)
 	}
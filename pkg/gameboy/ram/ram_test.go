@@ -0,0 +1,65 @@
+package ram
+
+import (
+	"testing"
+
+	"github.com/d2verb/gemu/pkg/gameboy/bus"
+)
+
+func newTestRAM(t *testing.T) (*RAM, *bus.Bus) {
+	t.Helper()
+
+	b := bus.New()
+	r := New()
+	if err := r.ConnectToBus(b); err != nil {
+		t.Fatal(err)
+	}
+	return r, b
+}
+
+func TestEchoRAM(t *testing.T) {
+	_, b := newTestRAM(t)
+
+	b.Write8(0xc123, 0x42)
+	if got := b.Read8(0xe123); got != 0x42 {
+		t.Errorf("0xe123 = 0x%02x, want 0x42", got)
+	}
+	b.Write8(0xfdff, 0x24)
+	if got := b.Read8(0xddff); got != 0x24 {
+		t.Errorf("0xddff = 0x%02x, want 0x24", got)
+	}
+}
+
+func TestWRAMBanking(t *testing.T) {
+	r, b := newTestRAM(t)
+
+	// SVBK is not available on DMG
+	b.Write8(0xff70, 2)
+	if got := b.Read8(0xff70); got != 0xff {
+		t.Errorf("SVBK = 0x%02x on DMG, want 0xff", got)
+	}
+
+	r.EnableCGBMode()
+	for bank := uint8(0); bank < WRAMBankCount; bank++ {
+		b.Write8(0xff70, bank)
+		b.Write8(0xd000, 0x10+bank)
+	}
+
+	// Bank 0 selects bank 1
+	for bank, want := range []uint8{0x11, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17} {
+		b.Write8(0xff70, uint8(bank))
+		if got := b.Read8(0xd000); got != want {
+			t.Errorf("bank %d: 0xd000 = 0x%02x, want 0x%02x", bank, got, want)
+		}
+	}
+	if got := b.Read8(0xff70); got != 0xff {
+		t.Errorf("SVBK = 0x%02x, want 0xff", got)
+	}
+
+	// Bank 0 at 0xc000-0xcfff is fixed
+	b.Write8(0xc000, 0x42)
+	b.Write8(0xff70, 3)
+	if got := b.Read8(0xc000); got != 0x42 {
+		t.Errorf("0xc000 should not be banked")
+	}
+}
@@ -0,0 +1,151 @@
+package rom
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/d2verb/gemu/pkg/gameboy/bus"
+	"github.com/d2verb/gemu/pkg/log"
+)
+
+const (
+	ROMBankSize = 0x4000
+	RAMBankSize = 0x2000
+)
+
+// External RAM size for each RAM size code at 0x149
+var ramSizes = map[uint8]int{
+	0: 0,
+	1: 0x800,
+	2: 0x2000,
+	3: 0x8000,
+	4: 0x20000,
+	5: 0x10000,
+}
+
+// Nintendo logo in the header at 0x104-0x133
+var nintendoLogo = []uint8{
+	0xce, 0xed, 0x66, 0x66, 0xcc, 0x0d, 0x00, 0x0b, 0x03, 0x73, 0x00, 0x83,
+	0x00, 0x0c, 0x00, 0x0d, 0x00, 0x08, 0x11, 0x1f, 0x88, 0x89, 0x00, 0x0e,
+	0xdc, 0xcc, 0x6e, 0xe6, 0xdd, 0xdd, 0xd9, 0x99, 0xbb, 0xbb, 0x67, 0x63,
+	0x6e, 0x0e, 0xec, 0xcc, 0xdd, 0xdc, 0x99, 0x9f, 0xbb, 0xb9, 0x33, 0x3e,
+}
+
+// MBC1 switches up to 2MB of ROM and 32KB of RAM. The 2-bit secondary register
+// (BANK2) selects either the upper ROM bank bits or the RAM bank.
+//
+// MBC1M multicarts are wired so that BANK2 becomes bits 4-5 of the ROM bank,
+// and bit 4 of BANK1 is ignored. Each game is 256KB and starts at bank 0x00,
+// 0x10, 0x20 or 0x30.
+type MBC1 struct {
+	data       []uint8
+	eram       []uint8
+	ramEnabled bool
+	bank1      uint8 // 5-bit ROM bank
+	bank2      uint8
+	mode       uint8 // 1 also maps BANK2 to 0x0000-0x3fff and RAM
+	multicart  bool
+	bankRange  bus.AddressRange
+	eramRange  bus.AddressRange
+}
+
+func NewMBC1(data []uint8) (MBC, error) {
+	if len(data) < 2*ROMBankSize || len(data)%ROMBankSize != 0 {
+		return nil, fmt.Errorf("ROM size 0x%x is not supported by MBC1", len(data))
+	}
+	return &MBC1{
+		data:      data,
+		eram:      make([]uint8, ramSizes[data[0x149]]),
+		bank1:     1,
+		multicart: isMulticart(data),
+		bankRange: bus.NewAddressRange(0x0000, 0x7fff),
+		eramRange: bus.NewAddressRange(0xa000, 0xbfff),
+	}, nil
+}
+
+// isMulticart detects MBC1M from the header of the second game in a 1MB ROM
+func isMulticart(data []uint8) bool {
+	if len(data) != 0x100000 {
+		return false
+	}
+	offset := 0x10*ROMBankSize + 0x104
+	return bytes.Equal(data[offset:offset+len(nintendoLogo)], nintendoLogo)
+}
+
+func (m *MBC1) AddressRanges() []bus.AddressRange {
+	return []bus.AddressRange{
+		m.bankRange,
+		m.eramRange,
+	}
+}
+
+func (m *MBC1) Data() []uint8 {
+	return m.data
+}
+
+// romBank returns the bank mapped to 0x0000-0x3fff or 0x4000-0x7fff
+func (m *MBC1) romBank(address uint16) int {
+	shift := 5
+	bank1 := m.bank1
+	if m.multicart {
+		shift = 4
+		bank1 &= 0xf
+	}
+
+	var bank int
+	if address >= ROMBankSize {
+		bank = int(m.bank2)<<shift | int(bank1)
+	} else if m.mode == 1 {
+		bank = int(m.bank2) << shift
+	}
+	// Unused upper bits are ignored on smaller ROMs
+	return bank % (len(m.data) / ROMBankSize)
+}
+
+// ramOffset returns the offset of external RAM mapped to the address
+func (m *MBC1) ramOffset(address uint16) int {
+	offset := int(address - m.eramRange.Start)
+	if m.mode == 1 {
+		offset += int(m.bank2) * RAMBankSize
+	}
+	return offset % len(m.eram)
+}
+
+func (m *MBC1) Read8(address uint16) uint8 {
+	if m.bankRange.Contains(address) {
+		offset := m.romBank(address)*ROMBankSize + int(address%ROMBankSize)
+		return m.data[offset]
+	} else if m.eramRange.Contains(address) {
+		if !m.ramEnabled || len(m.eram) == 0 {
+			return 0xff
+		}
+		return m.eram[m.ramOffset(address)]
+	} else {
+		log.Fatalf("ROM cannot be accessed at 0x%04x", address)
+	}
+	return 0
+}
+
+func (m *MBC1) Write8(address uint16, data uint8) {
+	switch {
+	case address < 0x2000:
+		m.ramEnabled = data&0xf == 0xa
+	case address < 0x4000:
+		// Bank 0 cannot be selected by BANK1, so 0x20, 0x40 and 0x60 are
+		// mapped to 0x21, 0x41 and 0x61 instead
+		m.bank1 = data & 0b11111
+		if m.bank1 == 0 {
+			m.bank1 = 1
+		}
+	case address < 0x6000:
+		m.bank2 = data & 0b11
+	case address < 0x8000:
+		m.mode = data & 1
+	case m.eramRange.Contains(address):
+		if m.ramEnabled && len(m.eram) != 0 {
+			m.eram[m.ramOffset(address)] = data
+		}
+	default:
+		log.Fatalf("ROM cannot be accessed at 0x%04x", address)
+	}
+}
@@ -0,0 +1,171 @@
+package rom
+
+import (
+	"testing"
+)
+
+// newTestROM creates a ROM whose banks start with their bank number
+func newTestROM(banks int, mbcType uint8, ramSize uint8) []uint8 {
+	data := make([]uint8, banks*ROMBankSize)
+	for i := 0; i < banks; i++ {
+		data[i*ROMBankSize] = uint8(i)
+	}
+	data[0x147] = mbcType
+	data[0x149] = ramSize
+	return data
+}
+
+func newTestMBC1(t *testing.T, data []uint8) MBC {
+	t.Helper()
+
+	m, err := NewMBC1(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestNewMBC1(t *testing.T) {
+	for _, mbcType := range []uint8{0x01, 0x02, 0x03} {
+		r, err := New(newTestROM(4, mbcType, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := r.m.(*MBC1); !ok {
+			t.Errorf("type 0x%02x: expected MBC1, got %T", mbcType, r.m)
+		}
+	}
+
+	// ROMs smaller than 2 banks or with a partial bank are rejected
+	for _, size := range []int{0x150, ROMBankSize, 3*ROMBankSize + 0x100} {
+		data := make([]uint8, size)
+		data[0x147] = 0x01
+		if _, err := New(data); err == nil {
+			t.Errorf("size 0x%x: expected an error", size)
+		}
+	}
+}
+
+func TestMBC1ROMBank(t *testing.T) {
+	tests := []struct {
+		banks    int
+		bank1    uint8
+		bank2    uint8
+		mode     uint8
+		expected [2]uint8 // Banks at 0x0000 and 0x4000
+	}{
+		{128, 0x00, 0, 0, [2]uint8{0x00, 0x01}},
+		{128, 0x01, 0, 0, [2]uint8{0x00, 0x01}},
+		{128, 0x1f, 0, 0, [2]uint8{0x00, 0x1f}},
+		// Only the lower 5 bits are used
+		{128, 0xe2, 0, 0, [2]uint8{0x00, 0x02}},
+		{128, 0x02, 1, 0, [2]uint8{0x00, 0x22}},
+		// Bank 0x20 becomes 0x21
+		{128, 0x00, 1, 0, [2]uint8{0x00, 0x21}},
+		{128, 0x00, 3, 0, [2]uint8{0x00, 0x61}},
+		// Mode 1 maps BANK2 to 0x0000-0x3fff
+		{128, 0x00, 2, 1, [2]uint8{0x40, 0x41}},
+		// Upper bits are ignored on smaller ROMs
+		{16, 0x13, 0, 0, [2]uint8{0x00, 0x03}},
+		{32, 0x04, 1, 1, [2]uint8{0x00, 0x04}},
+		{64, 0x04, 1, 1, [2]uint8{0x20, 0x24}},
+		{128, 0x04, 3, 1, [2]uint8{0x60, 0x64}},
+	}
+
+	for _, tt := range tests {
+		m := newTestMBC1(t, newTestROM(tt.banks, 0x01, 0))
+		m.Write8(0x2000, tt.bank1)
+		m.Write8(0x4000, tt.bank2)
+		m.Write8(0x6000, tt.mode)
+
+		got := [2]uint8{m.Read8(0x0000), m.Read8(0x4000)}
+		if got != tt.expected {
+			t.Errorf("%d banks, BANK1 0x%02x, BANK2 %d, mode %d: expected %v, got %v",
+				tt.banks, tt.bank1, tt.bank2, tt.mode, tt.expected, got)
+		}
+	}
+}
+
+func TestMBC1RAM(t *testing.T) {
+	m := newTestMBC1(t, newTestROM(64, 0x03, 3))
+
+	// RAM is disabled by default
+	m.Write8(0xa000, 0x12)
+	if got := m.Read8(0xa000); got != 0xff {
+		t.Errorf("expected 0xff while disabled, got 0x%02x", got)
+	}
+
+	m.Write8(0x0000, 0x0a)
+	m.Write8(0xa000, 0x12)
+	if got := m.Read8(0xa000); got != 0x12 {
+		t.Errorf("expected 0x12, got 0x%02x", got)
+	}
+
+	// BANK2 selects the RAM bank only in mode 1
+	m.Write8(0x4000, 2)
+	if got := m.Read8(0xa000); got != 0x12 {
+		t.Errorf("expected bank 0 in mode 0, got 0x%02x", got)
+	}
+	m.Write8(0x6000, 1)
+	m.Write8(0xa000, 0x34)
+	m.Write8(0x6000, 0)
+	if got := m.Read8(0xa000); got != 0x12 {
+		t.Errorf("expected 0x12 in bank 0, got 0x%02x", got)
+	}
+	m.Write8(0x6000, 1)
+	if got := m.Read8(0xa000); got != 0x34 {
+		t.Errorf("expected 0x34 in bank 2, got 0x%02x", got)
+	}
+
+	// Any value other than 0x0a in the lower 4 bits disables RAM
+	m.Write8(0x0000, 0x0b)
+	if got := m.Read8(0xa000); got != 0xff {
+		t.Errorf("expected 0xff while disabled, got 0x%02x", got)
+	}
+}
+
+func TestMBC1SmallRAM(t *testing.T) {
+	// 2KB RAM is mirrored
+	m := newTestMBC1(t, newTestROM(4, 0x02, 1))
+	m.Write8(0x0000, 0x0a)
+	m.Write8(0xa000, 0x56)
+	if got := m.Read8(0xa800); got != 0x56 {
+		t.Errorf("expected 0x56, got 0x%02x", got)
+	}
+
+	// No RAM
+	m = newTestMBC1(t, newTestROM(4, 0x01, 0))
+	m.Write8(0x0000, 0x0a)
+	m.Write8(0xa000, 0x56)
+	if got := m.Read8(0xa000); got != 0xff {
+		t.Errorf("expected 0xff without RAM, got 0x%02x", got)
+	}
+}
+
+func TestMBC1Multicart(t *testing.T) {
+	data := newTestROM(64, 0x01, 0)
+	copy(data[0x104:], nintendoLogo)
+	copy(data[0x10*ROMBankSize+0x104:], nintendoLogo)
+
+	m := newTestMBC1(t, data)
+	if !m.(*MBC1).multicart {
+		t.Fatal("multicart was not detected")
+	}
+
+	// BANK2 is bits 4-5 and bit 4 of BANK1 is ignored
+	m.Write8(0x2000, 0x13)
+	m.Write8(0x4000, 1)
+	if got := m.Read8(0x4000); got != 0x13 {
+		t.Errorf("expected bank 0x13, got 0x%02x", got)
+	}
+	m.Write8(0x6000, 1)
+	m.Write8(0x4000, 2)
+	if got := m.Read8(0x0000); got != 0x20 {
+		t.Errorf("expected bank 0x20, got 0x%02x", got)
+	}
+
+	// A 1MB ROM without the second logo is not a multicart
+	if newTestMBC1(t, newTestROM(64, 0x01, 0)).(*MBC1).multicart {
+		t.Error("multicart was detected without the logo")
+	}
+}
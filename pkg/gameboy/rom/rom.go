@@ -18,6 +18,14 @@ func New(data []uint8) (*ROM, error) {
 		return &ROM{
 			m: NewMBC0(data),
 		}, nil
+	case 0x01, 0x02, 0x03:
+		m, err := NewMBC1(data)
+		if err != nil {
+			return nil, err
+		}
+		return &ROM{
+			m: m,
+		}, nil
 	default:
 		return nil, fmt.Errorf("MBC type %d is not supported", mbcType)
 	}
@@ -38,6 +46,11 @@ func (r *ROM) MBCType() uint8 {
 	return r.m.Data()[0x147]
 }
 
+// CGB flag at 0x143: 0x80 supports CGB functions, 0xc0 works on CGB only
+func (r *ROM) IsCGB() bool {
+	return r.m.Data()[0x143]&0x80 != 0
+}
+
 func (r *ROM) ConnectToBus(b *bus.Bus) error {
 	for _, _range := range r.m.AddressRanges() {
 		if err := b.Map(_range, r); err != nil {
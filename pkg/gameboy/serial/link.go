@@ -0,0 +1,103 @@
+package serial
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/d2verb/gemu/pkg/log"
+)
+
+// Link is the partner at the other end of the link cable
+type Link interface {
+	// Transfer exchanges a byte when this side drives the clock. It receives
+	// the byte shifted out of SB and returns the byte shifted in from the partner.
+	Transfer(data uint8) uint8
+
+	// Poll is called while this side waits for the partner's clock. It returns
+	// the byte from the partner and true once the partner has started a
+	// transfer, in which case data is sent back as the reply.
+	Poll(data uint8) (uint8, bool)
+
+	// Step is called on every step of the serial port after Transfer or Poll.
+	// A Poll in the same step means this side is ready for an external clock.
+	Step(cycles int)
+
+	// Close disconnects the partner
+	Close() error
+}
+
+// NullLink is an unplugged link cable. Without a partner the input line is
+// pulled up, so every transfer receives 0xff and an external clock never comes.
+type NullLink struct{}
+
+func NewNullLink() *NullLink {
+	return &NullLink{}
+}
+
+func (n *NullLink) Transfer(data uint8) uint8 {
+	return 0xff
+}
+
+func (n *NullLink) Poll(data uint8) (uint8, bool) {
+	return 0, false
+}
+
+func (n *NullLink) Step(cycles int) {
+}
+
+func (n *NullLink) Close() error {
+	return nil
+}
+
+// PrintLink writes every byte sent with the internal clock to w as it is.
+// Test ROMs (e.g. Blargg's) report their results this way.
+type PrintLink struct {
+	NullLink
+	w io.Writer
+}
+
+func NewPrintLink(w io.Writer) *PrintLink {
+	return &PrintLink{w: w}
+}
+
+func (p *PrintLink) Transfer(data uint8) uint8 {
+	p.w.Write([]uint8{data})
+	return p.NullLink.Transfer(data)
+}
+
+// LogLink is a PrintLink which writes to the debug log line by line
+type LogLink struct {
+	PrintLink
+	line strings.Builder
+}
+
+func NewLogLink() *LogLink {
+	l := &LogLink{}
+	l.w = &l.line
+	return l
+}
+
+func (l *LogLink) Transfer(data uint8) uint8 {
+	if data == '\n' {
+		log.Debugf("(serial) %s\n", l.line.String())
+		l.line.Reset()
+		return l.NullLink.Transfer(data)
+	}
+	return l.PrintLink.Transfer(data)
+}
+
+// NewLink creates a link backend by name {null, stdout, log}
+func NewLink(name string) (Link, error) {
+	switch name {
+	case "null":
+		return NewNullLink(), nil
+	case "stdout":
+		return NewPrintLink(os.Stdout), nil
+	case "log":
+		return NewLogLink(), nil
+	default:
+		return nil, fmt.Errorf("No corresponding serial link for %s", name)
+	}
+}
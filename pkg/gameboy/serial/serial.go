@@ -0,0 +1,115 @@
+package serial
+
+import (
+	"github.com/d2verb/gemu/pkg/gameboy/bus"
+	"github.com/d2verb/gemu/pkg/gameboy/cpu"
+	"github.com/d2verb/gemu/pkg/log"
+)
+
+// A bit is shifted every 512 cycles with the internal clock (8192 Hz)
+const CyclesPerTransfer = 512 * 8
+
+// SC bit flags
+const (
+	ClockSelectFlag   = 0b1        // 0: External clock, 1: Internal clock
+	TransferStartFlag = 0b10000000 // Set to start, cleared when done
+)
+
+type Serial struct {
+	sb     uint8 // Serial transfer data
+	sc     uint8 // Serial transfer control
+	cycles int   // Cycles left for the transfer with the internal clock
+	link   Link
+	bus    *bus.Bus
+}
+
+func New() *Serial {
+	return &Serial{
+		link: NewNullLink(),
+	}
+}
+
+// ConnectLink plugs the other end of the link cable
+func (s *Serial) ConnectLink(l Link) {
+	s.link = l
+}
+
+func (s *Serial) ConnectToBus(b *bus.Bus) error {
+	if err := b.Map(bus.NewAddressRange(0xff01, 0xff02), s); err != nil {
+		return err
+	}
+	s.bus = b
+	return nil
+}
+
+func (s *Serial) Step(cycles int) {
+	s.transfer(cycles)
+	s.link.Step(cycles)
+}
+
+func (s *Serial) transfer(cycles int) {
+	if s.sc&TransferStartFlag == 0 {
+		return
+	}
+
+	if s.sc&ClockSelectFlag == 0 {
+		// The partner drives the clock, so the transfer completes only when
+		// the partner starts one
+		if data, ok := s.link.Poll(s.sb); ok {
+			s.complete(data)
+		}
+		return
+	}
+
+	s.cycles -= cycles
+	if s.cycles <= 0 {
+		s.complete(s.link.Transfer(s.sb))
+	}
+}
+
+func (s *Serial) complete(data uint8) {
+	s.sb = data
+	s.sc &^= TransferStartFlag
+	s.bus.SetIF(cpu.IntSerial)
+}
+
+func (s *Serial) Read8(address uint16) uint8 {
+	switch address {
+	case 0xff01:
+		return s.sb
+	case 0xff02:
+		// Bit 1-6 are unused and always read as 1
+		return s.sc | 0x7e
+	default:
+		log.Fatalf("Serial cannot be accessed at 0x%04x", address)
+	}
+	return 0
+}
+
+func (s *Serial) Read16(address uint16) uint16 {
+	loByte := s.Read8(address)
+	hiByte := s.Read8(address + 1)
+	return ((uint16)(hiByte)<<8 | (uint16)(loByte))
+}
+
+func (s *Serial) Write8(address uint16, data uint8) {
+	switch address {
+	case 0xff01:
+		s.sb = data
+	case 0xff02:
+		s.sc = data & (TransferStartFlag | ClockSelectFlag)
+		if s.sc&TransferStartFlag != 0 {
+			s.cycles = CyclesPerTransfer
+		}
+	default:
+		log.Fatalf("Serial cannot be accessed at 0x%04x", address)
+	}
+}
+
+func (s *Serial) Write16(address uint16, data uint16) {
+	hiByte := (uint8)(data >> 8)
+	loByte := (uint8)(data & 0xff)
+
+	s.Write8(address, loByte)
+	s.Write8(address+1, hiByte)
+}
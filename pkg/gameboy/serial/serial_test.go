@@ -0,0 +1,203 @@
+package serial
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/d2verb/gemu/pkg/gameboy/bus"
+	"github.com/d2verb/gemu/pkg/gameboy/cpu"
+)
+
+func newTestSerial(t *testing.T, l Link) (*Serial, *bus.Bus) {
+	t.Helper()
+
+	b := bus.New()
+	if err := cpu.New().ConnectToBus(b); err != nil {
+		t.Fatal(err)
+	}
+	s := New()
+	s.ConnectLink(l)
+	if err := s.ConnectToBus(b); err != nil {
+		t.Fatal(err)
+	}
+	return s, b
+}
+
+// slaveLink starts a transfer from the partner side once armed
+type slaveLink struct {
+	NullLink
+	armed    bool
+	data     uint8
+	received uint8
+}
+
+func (l *slaveLink) Poll(data uint8) (uint8, bool) {
+	if !l.armed {
+		return 0, false
+	}
+	l.armed = false
+	l.received = data
+	return l.data, true
+}
+
+func TestInternalClockTransfer(t *testing.T) {
+	var out bytes.Buffer
+	s, b := newTestSerial(t, NewPrintLink(&out))
+
+	b.Write8(0xff01, 'A')
+	b.Write8(0xff02, TransferStartFlag|ClockSelectFlag)
+
+	s.Step(CyclesPerTransfer - 4)
+	if b.Read8(0xff02)&TransferStartFlag == 0 {
+		t.Fatalf("transfer finished too early")
+	}
+
+	s.Step(4)
+	if got := b.Read8(0xff02); got != 0x7f {
+		t.Errorf("SC = 0x%02x, want 0x7f", got)
+	}
+	if got := b.Read8(0xff01); got != 0xff {
+		t.Errorf("SB = 0x%02x, want 0xff from an unplugged partner", got)
+	}
+	if b.Read8(0xff0f)&cpu.IntSerial == 0 {
+		t.Errorf("serial interrupt should be requested")
+	}
+	if out.String() != "A" {
+		t.Errorf("printed %q, want \"A\"", out.String())
+	}
+}
+
+func TestExternalClockTransfer(t *testing.T) {
+	l := &slaveLink{data: 0x42}
+	s, b := newTestSerial(t, l)
+
+	b.Write8(0xff01, 0x24)
+	b.Write8(0xff02, TransferStartFlag)
+
+	s.Step(CyclesPerTransfer * 2)
+	if b.Read8(0xff02)&TransferStartFlag == 0 {
+		t.Fatalf("transfer must wait for the external clock")
+	}
+
+	l.armed = true
+	s.Step(4)
+	if got := b.Read8(0xff01); got != 0x42 {
+		t.Errorf("SB = 0x%02x, want 0x42", got)
+	}
+	if l.received != 0x24 {
+		t.Errorf("partner received 0x%02x, want 0x24", l.received)
+	}
+	if b.Read8(0xff0f)&cpu.IntSerial == 0 {
+		t.Errorf("serial interrupt should be requested")
+	}
+}
+
+func TestNewLink(t *testing.T) {
+	for _, name := range []string{"null", "stdout", "log"} {
+		if _, err := NewLink(name); err != nil {
+			t.Errorf("NewLink(%q) failed: %v", name, err)
+		}
+	}
+	if _, err := NewLink("modem"); err == nil {
+		t.Errorf("NewLink should fail for unknown link")
+	}
+}
+
+func newTestTCPLinks(t *testing.T) (*TCPLink, *TCPLink) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+
+	master, err := DialTCPLink(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	slave := NewTCPLink(<-accepted)
+	t.Cleanup(func() {
+		master.Close()
+		slave.Close()
+	})
+
+	return master, slave
+}
+
+func TestTCPLinkTransfer(t *testing.T) {
+	masterLink, slaveLink := newTestTCPLinks(t)
+	master, mb := newTestSerial(t, masterLink)
+	slave, sb := newTestSerial(t, slaveLink)
+
+	sb.Write8(0xff01, 0x24)
+	sb.Write8(0xff02, TransferStartFlag)
+	slave.Step(4)
+
+	mb.Write8(0xff01, 0x42)
+	mb.Write8(0xff02, TransferStartFlag|ClockSelectFlag)
+	master.Step(CyclesPerTransfer)
+	if got := mb.Read8(0xff01); got != 0x24 {
+		t.Errorf("master SB = 0x%02x, want 0x24", got)
+	}
+
+	slave.Step(4)
+	if got := sb.Read8(0xff01); got != 0x42 {
+		t.Errorf("slave SB = 0x%02x, want 0x42", got)
+	}
+	for _, b := range []*bus.Bus{mb, sb} {
+		if b.Read8(0xff02)&TransferStartFlag != 0 || b.Read8(0xff0f)&cpu.IntSerial == 0 {
+			t.Errorf("transfer should be completed on both sides")
+		}
+	}
+}
+
+func TestTCPLinkSlaveNotReady(t *testing.T) {
+	masterLink, slaveLink := newTestTCPLinks(t)
+	master, mb := newTestSerial(t, masterLink)
+	slave, _ := newTestSerial(t, slaveLink)
+	slave.Step(4)
+
+	mb.Write8(0xff01, 0x42)
+	mb.Write8(0xff02, TransferStartFlag|ClockSelectFlag)
+	master.Step(CyclesPerTransfer)
+	if got := mb.Read8(0xff01); got != 0xff {
+		t.Errorf("master SB = 0x%02x, want 0xff", got)
+	}
+}
+
+func TestTCPLinkSync(t *testing.T) {
+	masterLink, slaveLink := newTestTCPLinks(t)
+
+	done := make(chan bool)
+	go func() {
+		// The first period can run ahead, the second one waits for the partner
+		masterLink.Step(SyncCycles)
+		masterLink.Step(SyncCycles)
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("master should wait for the slave")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	slaveLink.Step(SyncCycles)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("master should be released by the slave")
+	}
+}
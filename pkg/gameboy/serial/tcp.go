@@ -0,0 +1,194 @@
+package serial
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/d2verb/gemu/pkg/log"
+)
+
+// Both sides wait for each other once per frame, so neither runs ahead of
+// the partner by more than a frame
+const SyncCycles = 70224
+
+// Every message is 2 bytes: a message type and a data byte
+const (
+	msgTransfer = 'T' // The sender drives the clock and shifts out data
+	msgReply    = 'R' // Reply to msgTransfer with the receiver's SB
+	msgSync     = 'S' // The sender has run another SyncCycles cycles
+)
+
+// TCPLink connects two emulators with a link cable over TCP.
+//
+// The side using the internal clock (master) sends its byte and waits for the
+// reply. The reply is sent by the reader goroutine of the other side (slave),
+// so the master never waits for the slave's emulation loop. If the slave is
+// not waiting for an external clock, the master receives 0xff as if nothing
+// was connected.
+type TCPLink struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	replies chan uint8
+
+	mu             sync.Mutex
+	cond           *sync.Cond
+	closed         bool
+	ready          bool  // This side is waiting for the partner's clock
+	polled         bool  // Poll was called in the current step
+	sb             uint8 // SB of this side while it is ready
+	received       uint8 // Byte received from the partner's transfer
+	completed      bool  // The partner's transfer completed and received is valid
+	cycles         int
+	periods        int
+	partnerPeriods int
+}
+
+func NewTCPLink(conn net.Conn) *TCPLink {
+	t := &TCPLink{
+		conn:    conn,
+		replies: make(chan uint8, 1),
+	}
+	t.cond = sync.NewCond(&t.mu)
+	go t.read()
+	return t
+}
+
+// ListenTCPLink waits for a partner to connect to addr (e.g. ":9001")
+func ListenTCPLink(addr string) (*TCPLink, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	log.Debugf("Waiting for link partner (%s)...\n", l.Addr())
+	conn, err := l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewTCPLink(conn), nil
+}
+
+// DialTCPLink connects to a partner listening on addr (e.g. "localhost:9001")
+func DialTCPLink(addr string) (*TCPLink, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewTCPLink(conn), nil
+}
+
+func (t *TCPLink) Close() error {
+	return t.conn.Close()
+}
+
+func (t *TCPLink) Transfer(data uint8) uint8 {
+	if err := t.send(msgTransfer, data); err != nil {
+		return 0xff
+	}
+
+	reply, ok := <-t.replies
+	if !ok {
+		return 0xff
+	}
+	return reply
+}
+
+func (t *TCPLink) Poll(data uint8) (uint8, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.completed {
+		t.completed = false
+		t.ready = false
+		t.polled = false
+		return t.received, true
+	}
+
+	t.ready = true
+	t.polled = true
+	t.sb = data
+	return 0, false
+}
+
+func (t *TCPLink) Step(cycles int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.polled {
+		t.ready = false
+	}
+	t.polled = false
+
+	t.cycles += cycles
+	if t.cycles < SyncCycles {
+		return
+	}
+	t.cycles -= SyncCycles
+	t.periods++
+
+	t.mu.Unlock()
+	err := t.send(msgSync, 0)
+	t.mu.Lock()
+	if err != nil {
+		return
+	}
+
+	// Allow the partner to be a period behind, so both sides don't stop at
+	// every sync point
+	for !t.closed && t.partnerPeriods < t.periods-1 {
+		t.cond.Wait()
+	}
+}
+
+func (t *TCPLink) send(msgType uint8, data uint8) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+
+	_, err := t.conn.Write([]uint8{msgType, data})
+	return err
+}
+
+func (t *TCPLink) read() {
+	defer func() {
+		t.mu.Lock()
+		t.closed = true
+		t.cond.Broadcast()
+		t.mu.Unlock()
+		close(t.replies)
+	}()
+
+	msg := make([]uint8, 2)
+	for {
+		if _, err := io.ReadFull(t.conn, msg); err != nil {
+			log.Errorf("Link cable disconnected: %v\n", err)
+			return
+		}
+
+		switch msg[0] {
+		case msgTransfer:
+			t.mu.Lock()
+			var reply uint8 = 0xff
+			if t.ready && !t.completed {
+				reply = t.sb
+				t.received = msg[1]
+				t.completed = true
+			}
+			t.mu.Unlock()
+			if err := t.send(msgReply, reply); err != nil {
+				return
+			}
+		case msgReply:
+			t.replies <- msg[1]
+		case msgSync:
+			t.mu.Lock()
+			t.partnerPeriods++
+			t.cond.Broadcast()
+			t.mu.Unlock()
+		default:
+			log.Errorf("Unknown link message: 0x%02x\n", msg[0])
+			return
+		}
+	}
+}
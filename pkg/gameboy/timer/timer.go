@@ -0,0 +1,149 @@
+package timer
+
+import (
+	"github.com/d2verb/gemu/pkg/gameboy/bus"
+	"github.com/d2verb/gemu/pkg/gameboy/cpu"
+	"github.com/d2verb/gemu/pkg/log"
+)
+
+// TAC bit flags
+const (
+	TimerEnableFlag = 0b100
+	ClockSelectFlag = 0b11
+)
+
+// Bit of the internal divider which clocks TIMA for each clock select.
+// TIMA is incremented on the falling edge of the selected bit.
+var clockSelectBits = [4]uint16{
+	9, // 4096 Hz
+	3, // 262144 Hz
+	5, // 65536 Hz
+	7, // 16384 Hz
+}
+
+type Timer struct {
+	div       uint16 // Internal 16-bit divider. DIV is its upper 8 bits
+	tima      uint8  // Timer Counter
+	tma       uint8  // Timer Modulo
+	tac       uint8  // Timer Control
+	overflow  bool   // TIMA overflowed and reads 0 until the next M-cycle
+	reloaded  bool   // TIMA was reloaded from TMA in the current M-cycle
+	regsRange bus.AddressRange
+	bus       *bus.Bus
+}
+
+func New() *Timer {
+	return &Timer{
+		regsRange: bus.NewAddressRange(0xff04, 0xff07),
+	}
+}
+
+func (t *Timer) ConnectToBus(b *bus.Bus) error {
+	if err := b.Map(t.regsRange, t); err != nil {
+		return err
+	}
+	t.bus = b
+	return nil
+}
+
+// Step advances the timer by the given CPU cycles. The timer runs at the
+// CPU clock, so it runs twice as fast in CGB double speed mode.
+func (t *Timer) Step(cycles int) {
+	for ; cycles > 0; cycles -= 4 {
+		t.reloaded = false
+
+		// TIMA is reloaded one M-cycle after the overflow
+		if t.overflow {
+			t.overflow = false
+			t.reloaded = true
+			t.tima = t.tma
+			t.bus.SetIF(cpu.IntTimer)
+		}
+
+		t.setDiv(t.div + 4)
+	}
+}
+
+func (t *Timer) Read8(address uint16) uint8 {
+	switch address {
+	case 0xff04:
+		return uint8(t.div >> 8)
+	case 0xff05:
+		return t.tima
+	case 0xff06:
+		return t.tma
+	case 0xff07:
+		// Upper 5 bits are unused and always read as 1
+		return t.tac | 0xf8
+	default:
+		log.Fatalf("Timer cannot be accessed at 0x%04x", address)
+	}
+	return 0
+}
+
+func (t *Timer) Read16(address uint16) uint16 {
+	loByte := t.Read8(address)
+	hiByte := t.Read8(address + 1)
+	return ((uint16)(hiByte)<<8 | (uint16)(loByte))
+}
+
+func (t *Timer) Write8(address uint16, data uint8) {
+	switch address {
+	case 0xff04:
+		// Writing any value resets the whole internal divider
+		t.setDiv(0)
+	case 0xff05:
+		// A write in the reload cycle is ignored, and a write in the cycle
+		// before the reload cancels it
+		if !t.reloaded {
+			t.tima = data
+			t.overflow = false
+		}
+	case 0xff06:
+		t.tma = data
+		if t.reloaded {
+			t.tima = data
+		}
+	case 0xff07:
+		// Changing TAC can cause a falling edge of the timer signal as well
+		before := t.signal()
+		t.tac = data & (TimerEnableFlag | ClockSelectFlag)
+		if before && !t.signal() {
+			t.increment()
+		}
+	default:
+		log.Fatalf("Timer cannot be accessed at 0x%04x", address)
+	}
+}
+
+func (t *Timer) Write16(address uint16, data uint16) {
+	hiByte := (uint8)(data >> 8)
+	loByte := (uint8)(data & 0xff)
+
+	t.Write8(address, loByte)
+	t.Write8(address+1, hiByte)
+}
+
+func (t *Timer) setDiv(div uint16) {
+	before := t.signal()
+	t.div = div
+	if before && !t.signal() {
+		t.increment()
+	}
+}
+
+// signal is the selected divider bit ANDed with the timer enable flag
+func (t *Timer) signal() bool {
+	if t.tac&TimerEnableFlag == 0 {
+		return false
+	}
+	bit := clockSelectBits[t.tac&ClockSelectFlag]
+	return (t.div>>bit)&1 != 0
+}
+
+func (t *Timer) increment() {
+	t.tima++
+	if t.tima == 0 {
+		t.overflow = true
+	}
+}
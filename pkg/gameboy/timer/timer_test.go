@@ -0,0 +1,159 @@
+package timer
+
+import (
+	"testing"
+
+	"github.com/d2verb/gemu/pkg/gameboy/bus"
+	"github.com/d2verb/gemu/pkg/gameboy/cpu"
+)
+
+func newTestTimer(t *testing.T) (*Timer, *bus.Bus) {
+	t.Helper()
+
+	b := bus.New()
+	if err := cpu.New().ConnectToBus(b); err != nil {
+		t.Fatal(err)
+	}
+	timer := New()
+	if err := timer.ConnectToBus(b); err != nil {
+		t.Fatal(err)
+	}
+	return timer, b
+}
+
+func TestDIV(t *testing.T) {
+	timer, b := newTestTimer(t)
+
+	timer.Step(252)
+	if got := b.Read8(0xff04); got != 0 {
+		t.Errorf("DIV = %d, want 0", got)
+	}
+	timer.Step(4)
+	if got := b.Read8(0xff04); got != 1 {
+		t.Errorf("DIV = %d, want 1", got)
+	}
+
+	b.Write8(0xff04, 0x12)
+	if got := b.Read8(0xff04); got != 0 {
+		t.Errorf("DIV = %d after write, want 0", got)
+	}
+}
+
+func TestTIMAFrequency(t *testing.T) {
+	tests := []struct {
+		tac    uint8
+		period int
+	}{
+		{0b100, 1024},
+		{0b101, 16},
+		{0b110, 64},
+		{0b111, 256},
+	}
+
+	for _, tt := range tests {
+		timer, b := newTestTimer(t)
+		b.Write8(0xff07, tt.tac)
+
+		timer.Step(tt.period*3 - 4)
+		if got := b.Read8(0xff05); got != 2 {
+			t.Errorf("TAC=0x%02x: TIMA = %d, want 2", tt.tac, got)
+		}
+		timer.Step(4)
+		if got := b.Read8(0xff05); got != 3 {
+			t.Errorf("TAC=0x%02x: TIMA = %d, want 3", tt.tac, got)
+		}
+	}
+}
+
+func TestTIMADisabled(t *testing.T) {
+	timer, b := newTestTimer(t)
+	b.Write8(0xff07, 0b001)
+
+	timer.Step(1024)
+	if got := b.Read8(0xff05); got != 0 {
+		t.Errorf("TIMA = %d, want 0", got)
+	}
+	if got := b.Read8(0xff07); got != 0xf9 {
+		t.Errorf("TAC = 0x%02x, want 0xf9", got)
+	}
+}
+
+func TestOverflowReload(t *testing.T) {
+	timer, b := newTestTimer(t)
+	b.Write8(0xff06, 0xab)
+	b.Write8(0xff05, 0xff)
+	b.Write8(0xff07, 0b101)
+
+	timer.Step(16)
+	if got := b.Read8(0xff05); got != 0 {
+		t.Errorf("TIMA = 0x%02x right after overflow, want 0x00", got)
+	}
+	if b.Read8(0xff0f)&cpu.IntTimer != 0 {
+		t.Errorf("timer interrupt must be delayed by an M-cycle")
+	}
+
+	timer.Step(4)
+	if got := b.Read8(0xff05); got != 0xab {
+		t.Errorf("TIMA = 0x%02x, want TMA (0xab)", got)
+	}
+	if b.Read8(0xff0f)&cpu.IntTimer == 0 {
+		t.Errorf("timer interrupt should be requested")
+	}
+}
+
+func TestOverflowCancelledByTIMAWrite(t *testing.T) {
+	timer, b := newTestTimer(t)
+	b.Write8(0xff06, 0xab)
+	b.Write8(0xff05, 0xff)
+	b.Write8(0xff07, 0b101)
+
+	timer.Step(16)
+	b.Write8(0xff05, 0x42)
+	timer.Step(4)
+	if got := b.Read8(0xff05); got != 0x42 {
+		t.Errorf("TIMA = 0x%02x, want 0x42", got)
+	}
+	if b.Read8(0xff0f)&cpu.IntTimer != 0 {
+		t.Errorf("timer interrupt should be cancelled")
+	}
+}
+
+func TestWritesInReloadCycle(t *testing.T) {
+	timer, b := newTestTimer(t)
+	b.Write8(0xff06, 0xab)
+	b.Write8(0xff05, 0xff)
+	b.Write8(0xff07, 0b101)
+
+	timer.Step(20)
+	b.Write8(0xff05, 0x42)
+	if got := b.Read8(0xff05); got != 0xab {
+		t.Errorf("TIMA = 0x%02x, write in the reload cycle should be ignored", got)
+	}
+	b.Write8(0xff06, 0xcd)
+	if got := b.Read8(0xff05); got != 0xcd {
+		t.Errorf("TIMA = 0x%02x, TMA written in the reload cycle should be loaded", got)
+	}
+}
+
+func TestFallingEdgeOnDIVReset(t *testing.T) {
+	timer, b := newTestTimer(t)
+	b.Write8(0xff07, 0b101)
+
+	// Bit 3 of the divider is set
+	timer.Step(8)
+	b.Write8(0xff04, 0)
+	if got := b.Read8(0xff05); got != 1 {
+		t.Errorf("TIMA = %d, resetting DIV should cause an increment", got)
+	}
+}
+
+func TestFallingEdgeOnTACWrite(t *testing.T) {
+	timer, b := newTestTimer(t)
+	b.Write8(0xff07, 0b101)
+
+	timer.Step(8)
+	b.Write8(0xff07, 0b001)
+	if got := b.Read8(0xff05); got != 1 {
+		t.Errorf("TIMA = %d, disabling the timer should cause an increment", got)
+	}
+}
@@ -11,31 +11,52 @@ import (
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
 	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/driver/desktop"
+	"github.com/d2verb/gemu/pkg/gameboy/joypad"
 	"github.com/d2verb/gemu/pkg/gameboy/lcd"
 )
 
 const FPS = 59.73
 
+// Input receives the joypad state from the keyboard
+type Input interface {
+	Press(joypad.Button)
+	Release(joypad.Button)
+}
+
 type GUI struct {
 	app            fyne.App
 	win            fyne.Window
 	l              *lcd.LCD
+	input          Input
+	keyMap         KeyMap
+	palette        lcd.Palette
 	screenHash     string
 	ratio          int
 	prevUpdateTime int64
+	paceByAudio    bool
 }
 
-func NewGUI(winTitle string, l *lcd.LCD, ratio int) GUI {
+func NewGUI(winTitle string, l *lcd.LCD, ratio int, input Input, keyMap KeyMap, palette lcd.Palette) GUI {
 	a := app.New()
 	return GUI{
 		app:            a,
 		win:            a.NewWindow(winTitle),
 		l:              l,
+		input:          input,
+		keyMap:         keyMap,
+		palette:        palette,
 		ratio:          ratio,
 		prevUpdateTime: nowInNanosecond(),
 	}
 }
 
+// PaceByAudio stops AdjustFPS from sleeping, as the audio sink paces the
+// emulation instead
+func (g *GUI) PaceByAudio() {
+	g.paceByAudio = true
+}
+
 func (g *GUI) Start(ctx context.Context, cancel context.CancelFunc) {
 	// Start a goroutine to update the screen content
 	go func() {
@@ -46,22 +67,19 @@ func (g *GUI) Start(ctx context.Context, cancel context.CancelFunc) {
 				// Lock() prevents the LCD screen buffer from overwriting
 				// by the goroutine of emulator while this copy process
 				g.l.Lock()
-				screen := make([][]uint8, len(g.l.Screen))
-				for i := range g.l.Screen {
-					screen[i] = make([]uint8, len(g.l.Screen[i]))
-					copy(screen[i], g.l.Screen[i][:])
-				}
+				screen := g.l.Screen
 				g.l.Unlock()
+				cgb := g.l.IsCGB()
 
 				// If screen content is the same, skip gui updating
-				screenHash := calcScreenHash(screen)
+				screenHash := calcScreenHash(&screen)
 				if screenHash != g.screenHash {
 					g.screenHash = screenHash
 					g.win.SetContent(canvas.NewRasterWithPixels(func(x, y, w, h int) color.Color {
 						actualX := x * lcd.ScreenWidth / w
 						actualY := y * lcd.ScreenHeight / h
-						dot := screen[actualY][actualX]
-						return color.RGBA{dot, dot, dot, 0xff}
+						dot := g.palette.Color(screen[actualY][actualX], cgb)
+						return color.RGBA{dot.R, dot.G, dot.B, 0xff}
 					}))
 				}
 
@@ -72,10 +90,26 @@ func (g *GUI) Start(ctx context.Context, cancel context.CancelFunc) {
 			default:
 				continue
 			}
-			g.AdjustFPS()
+			if !g.paceByAudio {
+				g.AdjustFPS()
+			}
 		}
 	}()
 
+	// Key release events are only available on desktop
+	if c, ok := g.win.Canvas().(desktop.Canvas); ok {
+		c.SetOnKeyDown(func(e *fyne.KeyEvent) {
+			if button, ok := g.keyMap[e.Name]; ok {
+				g.input.Press(button)
+			}
+		})
+		c.SetOnKeyUp(func(e *fyne.KeyEvent) {
+			if button, ok := g.keyMap[e.Name]; ok {
+				g.input.Release(button)
+			}
+		})
+	}
+
 	g.win.Resize(fyne.NewSize(float32(lcd.ScreenWidth*g.ratio), float32(lcd.ScreenHeight*g.ratio)))
 	g.win.SetFixedSize(true)
 	g.win.ShowAndRun()
@@ -94,10 +128,15 @@ func nowInNanosecond() int64 {
 	return time.Now().Unix()*int64(time.Second) + time.Now().UnixNano()
 }
 
-func calcScreenHash(screen [][]uint8) string {
+func calcScreenHash(screen *[lcd.ScreenHeight][lcd.ScreenWidth]uint16) string {
 	h := sha256.New()
+	line := make([]uint8, lcd.ScreenWidth*2)
 	for i := range screen {
-		h.Write(screen[i])
+		for j, dot := range screen[i] {
+			line[j*2] = uint8(dot)
+			line[j*2+1] = uint8(dot >> 8)
+		}
+		h.Write(line)
 	}
 	return hex.EncodeToString(h.Sum(nil))
 }
@@ -0,0 +1,59 @@
+package gui
+
+import (
+	"fmt"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"github.com/d2verb/gemu/pkg/gameboy/joypad"
+)
+
+// KeyMap maps a key on the keyboard to a button of the Game Boy
+type KeyMap map[fyne.KeyName]joypad.Button
+
+func DefaultKeyMap() KeyMap {
+	return KeyMap{
+		fyne.KeyRight:     joypad.Right,
+		fyne.KeyLeft:      joypad.Left,
+		fyne.KeyUp:        joypad.Up,
+		fyne.KeyDown:      joypad.Down,
+		fyne.KeyX:         joypad.A,
+		fyne.KeyZ:         joypad.B,
+		fyne.KeyBackspace: joypad.Select,
+		fyne.KeyReturn:    joypad.Start,
+	}
+}
+
+// ParseKeyMap overrides the default key map with comma separated
+// "button=key" pairs. Example: "a=S,b=A,start=Space"
+//
+// Buttons are {right, left, up, down, a, b, select, start} and keys are
+// Fyne key names (e.g. "Up", "Return", "BackSpace", "X").
+func ParseKeyMap(s string) (KeyMap, error) {
+	keyMap := DefaultKeyMap()
+	if s == "" {
+		return keyMap, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		buttonName, keyName, ok := strings.Cut(pair, "=")
+		if !ok || keyName == "" {
+			return nil, fmt.Errorf("Invalid key mapping: %s", pair)
+		}
+
+		button, err := joypad.StringToButton(strings.ToLower(strings.TrimSpace(buttonName)))
+		if err != nil {
+			return nil, err
+		}
+
+		// Each button is bound to exactly one key
+		for key, b := range keyMap {
+			if b == button {
+				delete(keyMap, key)
+			}
+		}
+		keyMap[fyne.KeyName(strings.TrimSpace(keyName))] = button
+	}
+
+	return keyMap, nil
+}